@@ -0,0 +1,38 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package main
+
+import (
+	"fmt"
+	"github.com/assetsadapterstore/macblock-adapter/macblock"
+	"gopkg.in/urfave/cli.v1"
+	"os"
+)
+
+func main() {
+
+	app := cli.NewApp()
+	app.Name = "macblock"
+	app.Usage = "the macblock adapter operator command line interface"
+	app.Commands = []cli.Command{
+		macblock.CmdUnscan,
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
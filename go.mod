@@ -13,7 +13,8 @@ require (
 	github.com/kr/pretty v0.1.0 // indirect
 	github.com/shopspring/decimal v0.0.0-20180709203117-cd690d0c9e24
 	github.com/tidwall/gjson v1.2.1
-	golang.org/x/crypto v0.0.0-20190513172903-22d7a77e9e5f // indirect
+	go.etcd.io/bbolt v1.3.2
+	golang.org/x/crypto v0.0.0-20190513172903-22d7a77e9e5f
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
 	gopkg.in/urfave/cli.v1 v1.20.0
 )
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"fmt"
+	"github.com/blocktree/openwallet/openwallet"
+	"strings"
+)
+
+const (
+	AddressPrefix = "MAC" //地址前缀
+	AddressLength = 30    //地址长度，包含前缀
+)
+
+//AddressDecoder MAC地址解析器
+//MAC地址由节点生成，公私钥不在本地，只支持地址格式校验
+type AddressDecoder struct {
+	wm *WalletManager //钱包管理者
+}
+
+//NewAddressDecoder 地址解析器
+func NewAddressDecoder(wm *WalletManager) *AddressDecoder {
+	decoder := AddressDecoder{}
+	decoder.wm = wm
+	return &decoder
+}
+
+//PrivateKeyToWIF 私钥转WIF
+func (decoder *AddressDecoder) PrivateKeyToWIF(priv []byte, isTestnet bool) (string, error) {
+	return "", fmt.Errorf("PrivateKeyToWIF not supported, keys of %s are kept by the node", Symbol)
+}
+
+//PublicKeyToAddress 公钥转地址
+func (decoder *AddressDecoder) PublicKeyToAddress(pub []byte, isTestnet bool) (string, error) {
+	return "", fmt.Errorf("PublicKeyToAddress not supported, addresses of %s are created by the node", Symbol)
+}
+
+//RedeemScriptToAddress 多重签名赎回脚本转地址
+func (decoder *AddressDecoder) RedeemScriptToAddress(pubs [][]byte, required uint64, isTestnet bool) (string, error) {
+	return "", fmt.Errorf("RedeemScriptToAddress not supported")
+}
+
+//WIFToPrivateKey WIF转私钥
+func (decoder *AddressDecoder) WIFToPrivateKey(wif string, isTestnet bool) ([]byte, error) {
+	return nil, fmt.Errorf("WIFToPrivateKey not supported, keys of %s are kept by the node", Symbol)
+}
+
+//AddressVerify 地址校验
+func (decoder *AddressDecoder) AddressVerify(address string, opts ...interface{}) bool {
+	return CheckAddress(address) == nil
+}
+
+//CheckAddress 校验地址格式，返回不合法的具体原因
+//地址格式：MAC前缀 + 27位字母或数字，共30位
+func CheckAddress(address string) error {
+
+	if len(address) == 0 {
+		return openwallet.Errorf(ErrAddressEmpty, "address is empty")
+	}
+
+	if !strings.HasPrefix(address, AddressPrefix) {
+		return openwallet.Errorf(ErrAddressPrefix, "address: '%s' does not start with %s", address, AddressPrefix)
+	}
+
+	//position为第几个字符，从0开始，不是字节下标
+	position := 0
+	for _, c := range address {
+		if !isAddressCharacter(c) {
+			return openwallet.Errorf(ErrAddressInvalidCharacter, "address: '%s' contains invalid character %q at position %d", address, c, position)
+		}
+		position++
+	}
+
+	if len(address) != AddressLength {
+		return openwallet.Errorf(ErrAddressLength, "address: '%s' has %d characters, want %d", address, len(address), AddressLength)
+	}
+
+	return nil
+}
+
+//isAddressCharacter 地址只包含ASCII字母和数字
+func isAddressCharacter(c rune) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
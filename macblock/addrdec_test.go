@@ -0,0 +1,98 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestAddressDecoder_AddressVerify(t *testing.T) {
+
+	decoder := NewAddressDecoder(nil)
+
+	tests := []struct {
+		address string
+		code    uint64
+	}{
+		{"MACcbc6a02cab9F8ACJYVUJIQBAUlV", 0},
+		{"MACja4a7fbe76dBwVUBYFAWZVUWNlA", 0},
+		{"MACx6150b0728bVdQDOAABCYFAUN1U", 0},
+		{"MACcaf763e4780EMgCOUFAHUFCRRgA", 0},
+		{"", ErrAddressEmpty},
+		{"macx6150b0728bVdQDOAABCYFAUN1U", ErrAddressPrefix},
+		{"MAx6150b0728bVdQDOAABCYFAUN1U", ErrAddressPrefix},
+		{" MACx6150b0728bVdQDOAABCYFAUN1U", ErrAddressPrefix},
+		{"MAC", ErrAddressLength},
+		{"MACx6150b0728bVdQDOAABCYFAUN1", ErrAddressLength},
+		{"MACx6150b0728bVdQDOAABCYFAUN1UU", ErrAddressLength},
+		{"MACx6150b0728bVdQDOAABCYFAUN1 ", ErrAddressInvalidCharacter},
+		{"MACx6150b0728bVdQDOAABCYF-UN1U", ErrAddressInvalidCharacter},
+		{"MACx6150b0728bVdQDOAABCYFAUNé", ErrAddressInvalidCharacter},
+		{"MACx6150b0728bVdQDOAABCYFAUN1U\n", ErrAddressInvalidCharacter},
+	}
+
+	for _, test := range tests {
+		err := CheckAddress(test.address)
+		if code := ErrorCode(err); code != test.code {
+			t.Errorf("CheckAddress(%q) code = %d, want %d; error: %v", test.address, code, test.code, err)
+		}
+		if valid := decoder.AddressVerify(test.address); valid != (test.code == 0) {
+			t.Errorf("AddressVerify(%q) = %v", test.address, valid)
+		}
+	}
+}
+
+func TestCheckAddress_Properties(t *testing.T) {
+
+	decoder := NewAddressDecoder(nil)
+	valid := "MACx6150b0728bVdQDOAABCYFAUN1U"
+	r := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 1000; i++ {
+
+		//随机替换一个字符，合法字符仍然通过，不合法字符报告替换的位置
+		runes := []rune(valid)
+		position := len(AddressPrefix) + r.Intn(len(runes)-len(AddressPrefix))
+		c := rune(r.Intn(0x3000))
+		runes[position] = c
+		address := string(runes)
+
+		err := CheckAddress(address)
+		if decoder.AddressVerify(address) != (err == nil) {
+			t.Fatalf("AddressVerify(%q) does not match CheckAddress: %v", address, err)
+		}
+		if isAddressCharacter(c) {
+			if err != nil {
+				t.Fatalf("CheckAddress(%q) unexpected error: %v", address, err)
+			}
+			continue
+		}
+		if ErrorCode(err) != ErrAddressInvalidCharacter || !strings.Contains(err.Error(), fmt.Sprintf("at position %d", position)) {
+			t.Fatalf("CheckAddress(%q) error = %v, want invalid character at position %d", address, err, position)
+		}
+
+		//截断或追加字符后长度不正确
+		n := r.Intn(len(valid) + 10)
+		address = (valid + valid)[:n]
+		err = CheckAddress(address)
+		if decoder.AddressVerify(address) != (err == nil) || (err == nil) != (n == AddressLength) {
+			t.Fatalf("CheckAddress(%q) error = %v", address, err)
+		}
+	}
+}
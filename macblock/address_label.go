@@ -0,0 +1,223 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"fmt"
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"strings"
+	"time"
+)
+
+const (
+	addressLabelCacheSize = 10000 //地址标签缓存的地址数，超过时清空
+)
+
+//地址来源
+const (
+	AddressSourceCreated   = "created"   //通过CreateNewWallet创建
+	AddressSourceImported  = "imported"  //导入的钱包
+	AddressSourceWatchOnly = "watchOnly" //只观察，没有密钥
+)
+
+//AddressLabel 地址标签
+type AddressLabel struct {
+	Address   string `storm:"id"`
+	Label     string
+	SourceKey string   `storm:"index"` //所属用户
+	Tags      []string //用途标签，如：hot, partner
+	Source    string   `storm:"index"` //地址来源
+	Note      string
+	CreateAt  int64
+	UpdateAt  int64
+}
+
+//HasTag 是否包含标签
+func (l *AddressLabel) HasTag(tag string) bool {
+	for _, t := range l.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+//AddressLabelQuery 地址标签查询条件，为空的条件不过滤
+type AddressLabelQuery struct {
+	Keyword   string //匹配地址、标签或备注，不区分大小写
+	SourceKey string
+	Tag       string
+	Source    string
+}
+
+//SaveAddressLabel 保存地址标签，已存在时更新，保留创建时间
+func (wm *WalletManager) SaveAddressLabel(label *AddressLabel) error {
+
+	if err := CheckAddress(label.Address); err != nil {
+		return err
+	}
+
+	switch label.Source {
+	case "":
+		label.Source = AddressSourceImported
+	case AddressSourceCreated, AddressSourceImported, AddressSourceWatchOnly:
+	default:
+		return fmt.Errorf("address source: '%s' is not supported", label.Source)
+	}
+
+	now := time.Now().Unix()
+	exist, err := wm.GetAddressLabel(label.Address)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	if exist != nil {
+		label.CreateAt = exist.CreateAt
+	} else {
+		label.CreateAt = now
+	}
+	label.UpdateAt = now
+
+	defer wm.invalidateAddressLabel(label.Address)
+	return wm.blockChainDB.Save(label)
+}
+
+//GetAddressLabel 查询地址标签，不存在时返回storm.ErrNotFound
+func (wm *WalletManager) GetAddressLabel(address string) (*AddressLabel, error) {
+	var label AddressLabel
+	err := wm.blockChainDB.One("Address", address, &label)
+	if err != nil {
+		return nil, err
+	}
+	return &label, nil
+}
+
+//DeleteAddressLabel 删除地址标签
+func (wm *WalletManager) DeleteAddressLabel(address string) error {
+	defer wm.invalidateAddressLabel(address)
+	return wm.blockChainDB.DeleteStruct(&AddressLabel{Address: address})
+}
+
+//SearchAddressLabels 查询地址标签
+func (wm *WalletManager) SearchAddressLabels(query *AddressLabelQuery) ([]*AddressLabel, error) {
+
+	matchers := make([]q.Matcher, 0)
+	if len(query.SourceKey) > 0 {
+		matchers = append(matchers, q.Eq("SourceKey", query.SourceKey))
+	}
+	if len(query.Source) > 0 {
+		matchers = append(matchers, q.Eq("Source", query.Source))
+	}
+
+	var all []*AddressLabel
+	err := wm.blockChainDB.Select(matchers...).OrderBy("Address").Find(&all)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	keyword := strings.ToLower(query.Keyword)
+	list := make([]*AddressLabel, 0)
+	for _, label := range all {
+		if len(query.Tag) > 0 && !label.HasTag(query.Tag) {
+			continue
+		}
+		if len(keyword) > 0 &&
+			!strings.Contains(strings.ToLower(label.Address), keyword) &&
+			!strings.Contains(strings.ToLower(label.Label), keyword) &&
+			!strings.Contains(strings.ToLower(label.Note), keyword) {
+			continue
+		}
+		list = append(list, label)
+	}
+
+	return list, nil
+}
+
+//lookupAddressLabel 查询地址标签，不存在或出错时返回nil
+//扫描时每笔交易都要查询，结果缓存，没有标签的地址也缓存
+func (wm *WalletManager) lookupAddressLabel(address string) *AddressLabel {
+
+	if wm.blockChainDB == nil {
+		return nil
+	}
+
+	wm.labelMu.Lock()
+	label, ok := wm.labelCache[address]
+	wm.labelMu.Unlock()
+
+	if !ok {
+		var err error
+		label, err = wm.GetAddressLabel(address)
+		if err != nil && err != storm.ErrNotFound {
+			return nil
+		}
+
+		wm.labelMu.Lock()
+		if wm.labelCache == nil || len(wm.labelCache) >= addressLabelCacheSize {
+			wm.labelCache = make(map[string]*AddressLabel)
+		}
+		wm.labelCache[address] = label
+		wm.labelMu.Unlock()
+	}
+
+	if label == nil {
+		return nil
+	}
+	//返回副本，调用方修改后不影响缓存
+	copied := *label
+	return &copied
+}
+
+//invalidateAddressLabel 地址标签修改后清除缓存
+func (wm *WalletManager) invalidateAddressLabel(address string) {
+	wm.labelMu.Lock()
+	defer wm.labelMu.Unlock()
+	delete(wm.labelCache, address)
+}
+
+//labelExtParam 地址标签写入交易单扩展参数的字段
+func labelExtParam(label *AddressLabel) map[string]interface{} {
+	return map[string]interface{}{
+		"label":     label.Label,
+		"sourceKey": label.SourceKey,
+		"tags":      label.Tags,
+	}
+}
+
+//AddressBalanceReport 带地址标签的余额
+//openwallet.Balance没有标签字段，需要标签和所属用户时使用GetBalanceReport
+type AddressBalanceReport struct {
+	*AccountBalance
+	Label *AddressLabel //没有标签时为nil
+}
+
+//GetBalanceReport 查询地址余额和标签
+func (wm *WalletManager) GetBalanceReport(address ...string) ([]*AddressBalanceReport, error) {
+
+	reports := make([]*AddressBalanceReport, 0, len(address))
+	for _, a := range address {
+		balance, err := wm.GetAssetBalanceAds(a)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, &AddressBalanceReport{
+			AccountBalance: balance,
+			Label:          wm.lookupAddressLabel(a),
+		})
+	}
+
+	return reports, nil
+}
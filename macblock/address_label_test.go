@@ -0,0 +1,109 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"github.com/asdine/storm"
+	"github.com/blocktree/openwallet/openwallet"
+	"net/url"
+	"testing"
+)
+
+func TestWalletManager_AddressLabels(t *testing.T) {
+
+	wm, cleanup := testNewOfflineWalletManager(t, map[string]testNodeAction{
+		"GetAssetBalanceAds": func(form url.Values) string {
+			return `{"errCode": 0, "AllAsset": "12.5", "AssetBalance": "10", "LockedBalance": "2.5"}`
+		},
+	})
+	defer cleanup()
+
+	hot := "MACcbc6a02cab9F8ACJYVUJIQBAUlV"
+	partner := "MACja4a7fbe76dBwVUBYFAWZVUWNlA"
+
+	if err := wm.SaveAddressLabel(&AddressLabel{Address: "MACbad"}); err == nil {
+		t.Errorf("SaveAddressLabel with invalid address should fail")
+	}
+	if err := wm.SaveAddressLabel(&AddressLabel{Address: hot, Source: "unknown"}); err == nil {
+		t.Errorf("SaveAddressLabel with unknown source should fail")
+	}
+
+	wm.SaveAddressLabel(&AddressLabel{Address: hot, Label: "Hot wallet", SourceKey: "ops", Tags: []string{"hot"}, Source: AddressSourceCreated})
+	wm.SaveAddressLabel(&AddressLabel{Address: partner, Label: "Partner A", SourceKey: "partner-a", Tags: []string{"partner", "weekly"}, Note: "settlement"})
+
+	label, err := wm.GetAddressLabel(partner)
+	if err != nil || label.Source != AddressSourceImported || label.CreateAt == 0 {
+		t.Fatalf("GetAddressLabel = %+v, error: %v", label, err)
+	}
+
+	tests := []struct {
+		query AddressLabelQuery
+		want  int
+	}{
+		{AddressLabelQuery{}, 2},
+		{AddressLabelQuery{Keyword: "partner"}, 1},
+		{AddressLabelQuery{Keyword: "SETTLE"}, 1},
+		{AddressLabelQuery{Tag: "hot"}, 1},
+		{AddressLabelQuery{SourceKey: "partner-a", Tag: "weekly"}, 1},
+		{AddressLabelQuery{Source: AddressSourceWatchOnly}, 0},
+	}
+	for _, test := range tests {
+		list, err := wm.SearchAddressLabels(&test.query)
+		if err != nil || len(list) != test.want {
+			t.Errorf("SearchAddressLabels(%+v) = %d, want %d; error: %v", test.query, len(list), test.want, err)
+		}
+	}
+
+	reports, err := wm.GetBalanceReport(hot, "MACx6150b0728bVdQDOAABCYFAUN1U")
+	if err != nil || reports[0].Label.Label != "Hot wallet" || reports[1].Label != nil {
+		t.Errorf("GetBalanceReport = %+v, error: %v", reports, err)
+	}
+
+	//标签通过GetBalanceReport返回，不占用AccountID
+	balances, _ := wm.Blockscanner.GetBalanceByAddress(partner)
+	if balances[0].AccountID != "" {
+		t.Errorf("GetBalanceByAddress AccountID = %s", balances[0].AccountID)
+	}
+	reports, _ = wm.GetBalanceReport(partner)
+	if reports[0].Label.Label != "Partner A" || reports[0].Label.SourceKey != "partner-a" {
+		t.Errorf("GetBalanceReport label = %+v", reports[0].Label)
+	}
+
+	bs := wm.Blockscanner.(*MACBlockScanner)
+	result := bs.ExtractTransaction(1, "hash", &Transaction{TxID: "0x1", FromToken: hot, ToToken: partner, Amount: "1"}, func(target openwallet.ScanTarget) (string, bool) {
+		return "ops", target.Address == hot
+	})
+	tx := result.extractData["ops"].Transaction
+	if tx.GetExtParam().Get("fromLabel.label").String() != "Hot wallet" || tx.GetExtParam().Get("toLabel.sourceKey").String() != "partner-a" {
+		t.Errorf("transaction ExtParam = %s", tx.ExtParam)
+	}
+
+	if err := wm.DeleteAddressLabel(hot); err != nil {
+		t.Fatalf("DeleteAddressLabel unexpected error: %v", err)
+	}
+	if _, err := wm.GetAddressLabel(hot); err != storm.ErrNotFound {
+		t.Errorf("GetAddressLabel after delete error = %v", err)
+	}
+
+	//缓存随保存和删除更新
+	if label := wm.lookupAddressLabel(hot); label != nil {
+		t.Errorf("lookupAddressLabel after delete = %+v", label)
+	}
+	wm.SaveAddressLabel(&AddressLabel{Address: hot, Label: "Cold wallet"})
+	if label := wm.lookupAddressLabel(hot); label == nil || label.Label != "Cold wallet" {
+		t.Errorf("lookupAddressLabel after save = %+v", label)
+	}
+}
@@ -0,0 +1,364 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/openwallet/crypto"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	addressPoolAlias = "pool" //预生成钱包的别名
+)
+
+//地址池记录状态
+const (
+	PoolAddressAvailable = "available" //可分配
+	PoolAddressAssigned  = "assigned"  //已分配
+)
+
+//PoolAddress 地址池记录
+type PoolAddress struct {
+	Address  string `storm:"id"`
+	KeyFile  string //钱包密钥文件，使用钱包自己的密码加密
+	Password string //钱包密码，使用地址池密码加密，hex编码，旧记录为空时钱包密码就是地址池密码
+	Status   string `storm:"index"`
+	Owner    string //分配给的用户
+	CreateAt int64  `storm:"index"` //创建时间，纳秒
+	AssignAt int64
+}
+
+//AddressPoolMetrics 地址池指标
+type AddressPoolMetrics struct {
+	Depth           int //可分配数量
+	Assigned        int //已分配数量
+	Created         int //本次启动后创建的数量
+	RefillFailures  int //本次启动后补充失败的次数
+	LastRefillError string
+	LastRefillAt    int64
+}
+
+//AddressPool 预生成钱包的地址池，低于低水位时在后台通过CreateNewWallet补充
+//每个钱包使用随机生成的密码，加密保存在地址池记录中，分配后交给用户的只有该钱包的密码
+type AddressPool struct {
+	wm       *WalletManager
+	keydir   string
+	password string
+	Size     int           //补充到的数量
+	LowWater int           //低于该数量时补充
+	Interval time.Duration //定时检查间隔
+	mu       sync.Mutex    //分配锁
+	refillMu sync.Mutex    //补充锁
+	metrics  AddressPoolMetrics
+	refill   chan struct{}
+	quit     chan struct{}
+	wg       sync.WaitGroup
+}
+
+//NewAddressPool 创建地址池
+//@param keydir 密钥文件目录
+//@param password 地址池密码，用于加密每个钱包的密码
+func NewAddressPool(wm *WalletManager, keydir, password string, size, lowWater int) *AddressPool {
+	pool := AddressPool{
+		wm:       wm,
+		keydir:   keydir,
+		password: password,
+		Size:     size,
+		LowWater: lowWater,
+		Interval: time.Minute,
+		refill:   make(chan struct{}, 1),
+	}
+	return &pool
+}
+
+//Start 启动后台补充
+func (pool *AddressPool) Start() {
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if pool.quit != nil {
+		return
+	}
+	pool.quit = make(chan struct{})
+
+	pool.wg.Add(1)
+	go func(quit chan struct{}) {
+		defer pool.wg.Done()
+		ticker := time.NewTicker(pool.Interval)
+		defer ticker.Stop()
+		for {
+			pool.Refill()
+			select {
+			case <-ticker.C:
+			case <-pool.refill:
+			case <-quit:
+				return
+			}
+		}
+	}(pool.quit)
+}
+
+//Stop 停止后台补充，等待创建中的钱包完成
+func (pool *AddressPool) Stop() {
+	pool.mu.Lock()
+	if pool.quit != nil {
+		close(pool.quit)
+		pool.quit = nil
+	}
+	pool.mu.Unlock()
+	pool.wg.Wait()
+}
+
+//Take 分配一个地址给用户，返回地址和该钱包的密码，地址池为空时返回错误
+func (pool *AddressPool) Take(owner string) (*PoolAddress, string, error) {
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	tx, err := pool.wm.blockChainDB.Begin(true)
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	var addr PoolAddress
+	err = tx.Select(q.Eq("Status", PoolAddressAvailable)).OrderBy("CreateAt").First(&addr)
+	if err != nil {
+		if err == storm.ErrNotFound {
+			pool.kick()
+			return nil, "", fmt.Errorf("address pool is empty")
+		}
+		return nil, "", err
+	}
+
+	addr.Status = PoolAddressAssigned
+	addr.Owner = owner
+	addr.AssignAt = time.Now().Unix()
+
+	err = tx.Save(&addr)
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, "", err
+	}
+
+	//地址标签记录所属用户
+	if label := pool.wm.lookupAddressLabel(addr.Address); label != nil {
+		label.SourceKey = owner
+		if err := pool.wm.SaveAddressLabel(label); err != nil {
+			pool.wm.Log.Std.Warning("address: %s label can not be saved; unexpected error: %v", addr.Address, err)
+		}
+	}
+
+	password, err := pool.walletPassword(&addr)
+	if err != nil {
+		return nil, "", err
+	}
+
+	depth, err := pool.depth()
+	if err == nil && depth < pool.LowWater {
+		pool.kick()
+	}
+
+	return &addr, password, nil
+}
+
+//Wallet 解析地址池钱包的密钥文件，返回钱包和钱包密码
+func (pool *AddressPool) Wallet(address string) (*MACWallet, string, error) {
+	var addr PoolAddress
+	err := pool.wm.blockChainDB.One("Address", address, &addr)
+	if err != nil {
+		return nil, "", err
+	}
+	password, err := pool.walletPassword(&addr)
+	if err != nil {
+		return nil, "", err
+	}
+	wallet, err := pool.wm.GetWalletInfo(addr.KeyFile, password)
+	if err != nil {
+		return nil, "", err
+	}
+	return wallet, password, nil
+}
+
+//Resolver 地址池钱包的WalletResolver，用于转账队列和定时转账
+func (pool *AddressPool) Resolver() WalletResolver {
+	return pool.Wallet
+}
+
+//walletPassword 解密钱包密码
+func (pool *AddressPool) walletPassword(addr *PoolAddress) (string, error) {
+	if len(addr.Password) == 0 {
+		return pool.password, nil
+	}
+	encrypted, err := hex.DecodeString(addr.Password)
+	if err != nil || len(encrypted) == 0 || len(encrypted)%16 != 0 {
+		return "", fmt.Errorf("address: %s password is invalid", addr.Address)
+	}
+	password, err := crypto.AESDecrypt(encrypted, crypto.SHA256([]byte(pool.password)))
+	if err != nil {
+		return "", err
+	}
+	return string(password), nil
+}
+
+//validate 检查补充数量设置
+func (pool *AddressPool) validate() error {
+	if pool.LowWater <= 0 {
+		return fmt.Errorf("address pool low water: %d must be greater than 0", pool.LowWater)
+	}
+	if pool.Size < pool.LowWater {
+		return fmt.Errorf("address pool size: %d must not be less than low water: %d", pool.Size, pool.LowWater)
+	}
+	return nil
+}
+
+//Metrics 地址池指标
+func (pool *AddressPool) Metrics() (*AddressPoolMetrics, error) {
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	metrics := pool.metrics
+
+	depth, err := pool.depth()
+	if err != nil {
+		return nil, err
+	}
+	metrics.Depth = depth
+
+	assigned, err := pool.wm.blockChainDB.Select(q.Eq("Status", PoolAddressAssigned)).Count(new(PoolAddress))
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	metrics.Assigned = assigned
+
+	return &metrics, nil
+}
+
+//Refill 可分配数量低于低水位时补充到Size，创建失败时停止，等待下次补充
+func (pool *AddressPool) Refill() error {
+
+	if err := pool.validate(); err != nil {
+		return err
+	}
+
+	pool.refillMu.Lock()
+	defer pool.refillMu.Unlock()
+
+	pool.mu.Lock()
+	depth, err := pool.depth()
+	pool.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if depth >= pool.LowWater {
+		return nil
+	}
+
+	for ; depth < pool.Size; depth++ {
+
+		err = pool.create()
+
+		pool.mu.Lock()
+		pool.metrics.LastRefillAt = time.Now().Unix()
+		if err != nil {
+			pool.metrics.RefillFailures++
+			pool.metrics.LastRefillError = err.Error()
+		} else {
+			pool.metrics.Created++
+		}
+		pool.mu.Unlock()
+
+		if err != nil {
+			pool.wm.Log.Std.Error("address pool can not create wallet; unexpected error: %v", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+//create 创建一个钱包加入地址池，钱包使用随机生成的密码
+func (pool *AddressPool) create() error {
+
+	seed := make([]byte, 16)
+	if _, err := rand.Read(seed); err != nil {
+		return err
+	}
+	password := hex.EncodeToString(seed)
+
+	encrypted, err := crypto.AESEncrypt([]byte(password), crypto.SHA256([]byte(pool.password)))
+	if err != nil {
+		return err
+	}
+
+	wallet, keyFile, err := pool.wm.CreateNewWallet(pool.keydir, addressPoolAlias, password)
+	if err != nil {
+		return err
+	}
+
+	addr := &PoolAddress{
+		Address:  wallet.Address,
+		KeyFile:  keyFile,
+		Password: hex.EncodeToString(encrypted),
+		Status:   PoolAddressAvailable,
+		CreateAt: time.Now().UnixNano(),
+	}
+
+	err = CheckAddress(wallet.Address)
+	if err == nil {
+		err = pool.wm.blockChainDB.Save(addr)
+	}
+	if err != nil {
+		//没有加入地址池的钱包不保留密钥文件
+		if removeErr := os.Remove(keyFile); removeErr != nil {
+			pool.wm.Log.Std.Warning("address pool can not remove key file: %s; unexpected error: %v", keyFile, removeErr)
+		}
+		return err
+	}
+
+	return nil
+}
+
+//depth 可分配数量
+func (pool *AddressPool) depth() (int, error) {
+	depth, err := pool.wm.blockChainDB.Select(q.Eq("Status", PoolAddressAvailable)).Count(new(PoolAddress))
+	if err != nil && err != storm.ErrNotFound {
+		return 0, err
+	}
+	return depth, nil
+}
+
+//kick 通知后台补充
+func (pool *AddressPool) kick() {
+	select {
+	case pool.refill <- struct{}{}:
+	default:
+	}
+}
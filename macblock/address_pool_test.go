@@ -0,0 +1,169 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestAddressPool_TakeAndRefill(t *testing.T) {
+
+	var (
+		mu      sync.Mutex
+		created = 0
+		failing = false
+	)
+
+	wm, cleanup := testNewOfflineWalletManager(t, map[string]testNodeAction{
+		"IncreaseTokenAddress2": func(form url.Values) string {
+			mu.Lock()
+			defer mu.Unlock()
+			if failing {
+				return `{"errCode": 1, "Msg": "node busy"}`
+			}
+			created++
+			return fmt.Sprintf(`{"errCode": 0, "NewTokenAddress": "MACpool%023d"}`, created)
+		},
+		"GetmyWalletKey2": func(form url.Values) string {
+			return `{"errCode": 0, "WalletKey": "key"}`
+		},
+		"GetMnemonicWords2": func(form url.Values) string {
+			return `{"errCode": 0, "MnemonicWords": "words"}`
+		},
+		"GetMtsign2": func(form url.Values) string {
+			return `{"errCode": 0, "Mtsign": "sign"}`
+		},
+	})
+	defer cleanup()
+
+	pool := NewAddressPool(wm, filepath.Join(wm.Config.DataDir, "key"), "pool password", 5, 3)
+
+	if _, _, err := pool.Take("alice"); err == nil {
+		t.Fatalf("Take from empty pool should fail")
+	}
+
+	if err := pool.Refill(); err != nil {
+		t.Fatalf("Refill unexpected error: %v", err)
+	}
+
+	//并发分配不会重复
+	var (
+		wg    sync.WaitGroup
+		taken sync.Map
+	)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			addr, password, err := pool.Take(fmt.Sprintf("user%d", i))
+			if err != nil {
+				t.Errorf("Take unexpected error: %v", err)
+				return
+			}
+			if _, dup := taken.LoadOrStore(addr.Address, password); dup {
+				t.Errorf("address: %s was taken twice", addr.Address)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	metrics, _ := pool.Metrics()
+	if metrics.Depth != 2 || metrics.Assigned != 3 || metrics.Created != 5 {
+		t.Errorf("Metrics = %+v", metrics)
+	}
+
+	//每个钱包的密码不同，也不是地址池密码
+	passwords := make(map[string]bool)
+	taken.Range(func(key, value interface{}) bool {
+		wallet, password, err := pool.Wallet(key.(string))
+		if err != nil || wallet.Address != key.(string) || wallet.MtSign != "sign" {
+			t.Errorf("Wallet(%s) = %+v, error: %v", key, wallet, err)
+		}
+		if password != value.(string) || password == "pool password" || passwords[password] {
+			t.Errorf("Wallet(%s) password is shared", key)
+		}
+		passwords[password] = true
+		var addr PoolAddress
+		wm.blockChainDB.One("Address", key, &addr)
+		if w, err := wm.GetWalletInfo(addr.KeyFile, "pool password"); err == nil && w.MtSign == "sign" {
+			t.Errorf("key file of %s can be decrypted with the pool password", key)
+		}
+		if label, _ := wm.GetAddressLabel(key.(string)); label == nil || label.Source != AddressSourceCreated || len(label.SourceKey) == 0 {
+			t.Errorf("GetAddressLabel(%s) = %+v", key, label)
+		}
+		return true
+	})
+
+	mu.Lock()
+	failing = true
+	mu.Unlock()
+
+	if err := pool.Refill(); err == nil {
+		t.Errorf("Refill should fail while the node is failing")
+	}
+
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+
+	if err := pool.Refill(); err != nil {
+		t.Fatalf("Refill unexpected error: %v", err)
+	}
+
+	metrics, _ = pool.Metrics()
+	if metrics.Depth != 5 || metrics.RefillFailures != 1 || len(metrics.LastRefillError) == 0 {
+		t.Errorf("Metrics = %+v", metrics)
+	}
+}
+
+func TestAddressPool_InvalidAddress(t *testing.T) {
+
+	wm, cleanup := testNewOfflineWalletManager(t, map[string]testNodeAction{
+		"IncreaseTokenAddress2": func(form url.Values) string {
+			return `{"errCode": 0, "NewTokenAddress": "MACbad"}`
+		},
+		"GetmyWalletKey2": func(form url.Values) string {
+			return `{"errCode": 0, "WalletKey": "key"}`
+		},
+		"GetMnemonicWords2": func(form url.Values) string {
+			return `{"errCode": 0, "MnemonicWords": "words"}`
+		},
+		"GetMtsign2": func(form url.Values) string {
+			return `{"errCode": 0, "Mtsign": "sign"}`
+		},
+	})
+	defer cleanup()
+
+	keydir := filepath.Join(wm.Config.DataDir, "key")
+
+	pool := NewAddressPool(wm, keydir, "pool password", 2, 3)
+	if err := pool.Refill(); err == nil {
+		t.Errorf("Refill should reject size less than low water")
+	}
+
+	//节点返回的地址不合法时删除密钥文件
+	pool.Size = 3
+	if err := pool.Refill(); ErrorCode(err) != ErrAddressLength {
+		t.Errorf("Refill error = %v, want code %d", err, ErrAddressLength)
+	}
+	if files, _ := filepath.Glob(filepath.Join(keydir, "*")); len(files) != 0 {
+		t.Errorf("key files were not removed: %v", files)
+	}
+}
@@ -0,0 +1,59 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"github.com/blocktree/openwallet/openwallet"
+	"github.com/shopspring/decimal"
+	"regexp"
+)
+
+//amountFormat 金额字符串格式：十进制，不带符号、指数和多余的前导0
+var amountFormat = regexp.MustCompile(`^(0|[1-9][0-9]*)(\.[0-9]+)?$`)
+
+//ParseAmount 解析并校验金额
+//@param decimals 小数位精度
+//@param maximum 单笔上限，为0时不限制
+func ParseAmount(amount string, decimals int32, maximum decimal.Decimal) (decimal.Decimal, error) {
+
+	if !amountFormat.MatchString(amount) {
+		return decimal.Zero, openwallet.Errorf(ErrAmountInvalidFormat, "amount: '%s' is not a valid decimal string", amount)
+	}
+
+	value, err := decimal.NewFromString(amount)
+	if err != nil {
+		return decimal.Zero, openwallet.Errorf(ErrAmountInvalidFormat, "amount: '%s' is not a valid decimal string", amount)
+	}
+
+	if !value.IsPositive() {
+		return decimal.Zero, openwallet.Errorf(ErrAmountNotPositive, "amount: '%s' must be greater than 0", amount)
+	}
+
+	if !value.Truncate(decimals).Equal(value) {
+		return decimal.Zero, openwallet.Errorf(ErrAmountPrecision, "amount: '%s' has more than %d decimal places", amount, decimals)
+	}
+
+	if maximum.IsPositive() && value.GreaterThan(maximum) {
+		return decimal.Zero, openwallet.Errorf(ErrAmountExceedMaximum, "amount: '%s' exceeds the maximum: %s", amount, maximum.String())
+	}
+
+	return value, nil
+}
+
+//ValidateAmount 按币种精度和配置的单笔上限校验转账金额
+func (wm *WalletManager) ValidateAmount(amount string) (decimal.Decimal, error) {
+	return ParseAmount(amount, wm.Decimal(), wm.Config.MaxTransferAmount)
+}
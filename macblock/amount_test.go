@@ -0,0 +1,88 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"github.com/shopspring/decimal"
+	"github.com/tidwall/gjson"
+	"testing"
+)
+
+func TestParseAmount(t *testing.T) {
+
+	maximum := decimal.New(1000, 0)
+
+	tests := []struct {
+		amount string
+		want   string
+		code   uint64
+	}{
+		{amount: "0.01", want: "0.01"},
+		{amount: "1", want: "1"},
+		{amount: "1000", want: "1000"},
+		{amount: "0.12345678", want: "0.12345678"},
+		{amount: "0.100000000", want: "0.1"},
+		{amount: "", code: ErrAmountInvalidFormat},
+		{amount: "abc", code: ErrAmountInvalidFormat},
+		{amount: "-1", code: ErrAmountInvalidFormat},
+		{amount: "+1", code: ErrAmountInvalidFormat},
+		{amount: "1e3", code: ErrAmountInvalidFormat},
+		{amount: " 1", code: ErrAmountInvalidFormat},
+		{amount: "01", code: ErrAmountInvalidFormat},
+		{amount: ".5", code: ErrAmountInvalidFormat},
+		{amount: "1.", code: ErrAmountInvalidFormat},
+		{amount: "0", code: ErrAmountNotPositive},
+		{amount: "0.00", code: ErrAmountNotPositive},
+		{amount: "0.123456789", code: ErrAmountPrecision},
+		{amount: "1000.00000001", code: ErrAmountExceedMaximum},
+	}
+
+	for _, test := range tests {
+		value, err := ParseAmount(test.amount, Decimals, maximum)
+		if test.code != 0 {
+			if ErrorCode(err) != test.code {
+				t.Errorf("ParseAmount(%q) error = %v, want code %d", test.amount, err, test.code)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseAmount(%q) unexpected error: %v", test.amount, err)
+			continue
+		}
+		if value.String() != test.want {
+			t.Errorf("ParseAmount(%q) = %s, want %s", test.amount, value.String(), test.want)
+		}
+	}
+
+	//上限为0时不限制
+	if _, err := ParseAmount("100000000", Decimals, decimal.Zero); err != nil {
+		t.Errorf("ParseAmount without maximum unexpected error: %v", err)
+	}
+}
+
+func TestNewTransaction_InvalidAmount(t *testing.T) {
+	json := gjson.Parse(`{"hash":"0x01","fromtoken":"a","totoken":"b","amount":"-0.5"}`)
+	tx := NewTransaction(&json)
+	if ErrorCode(tx.amountErr) != ErrAmountInvalidFormat {
+		t.Errorf("NewTransaction amount error = %v, want code %d", tx.amountErr, ErrAmountInvalidFormat)
+	}
+
+	json = gjson.Parse(`{"hash":"0x02","fromtoken":"a","totoken":"b","amount":"0.01000000"}`)
+	tx = NewTransaction(&json)
+	if tx.amountErr != nil || tx.Amount != "0.01" {
+		t.Errorf("NewTransaction amount = %s, error = %v", tx.Amount, tx.amountErr)
+	}
+}
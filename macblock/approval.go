@@ -0,0 +1,455 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/asdine/storm"
+	"github.com/blocktree/openwallet/common"
+	"github.com/blocktree/openwallet/crypto"
+	"github.com/blocktree/openwallet/openwallet"
+	"github.com/shopspring/decimal"
+	"golang.org/x/crypto/ed25519"
+	"time"
+)
+
+//提案状态
+const (
+	ProposalStatusPending   = "pending"   //等待审批
+	ProposalStatusApproved  = "approved"  //审批通过，等待执行
+	ProposalStatusRejected  = "rejected"  //已拒绝
+	ProposalStatusExpired   = "expired"   //已过期
+	ProposalStatusExecuting = "executing" //正在发送，防止重复执行
+	ProposalStatusExecuted  = "executed"  //已执行
+)
+
+//审批签名的操作类型
+const (
+	ProposalActionApprove = "approve"
+	ProposalActionReject  = "reject"
+)
+
+//ApprovalRequiredError 转账金额超过审批阈值，已创建待审批提案
+type ApprovalRequiredError struct {
+	ProposalID string
+}
+
+//Error 错误信息
+func (err *ApprovalRequiredError) Error() string {
+	return fmt.Sprintf("[%d]transfer requires approval, proposal: %s", ErrApprovalRequired, err.ProposalID)
+}
+
+//Code 错误码
+func (err *ApprovalRequiredError) Code() uint64 {
+	return ErrApprovalRequired
+}
+
+//Approver 审批人
+type Approver struct {
+	Name      string `storm:"id"`
+	PublicKey string //Ed25519公钥，hex编码
+}
+
+//ProposalVote 审批人的签名意见
+type ProposalVote struct {
+	Approver  string
+	Signature string //hex编码
+	Reason    string
+	Time      int64
+}
+
+//Proposal 大额转账提案
+type Proposal struct {
+	ID         string `storm:"id"` // primary key
+	Sid        string `storm:"index"`
+	Requester  string
+	From       string `storm:"index"`
+	To         string
+	Amount     string
+	ExtParam   string
+	Required   int    //需要的审批数
+	Status     string `storm:"index"`
+	Approvals  []*ProposalVote
+	Rejections []*ProposalVote
+	CreateAt   int64
+	ExpireAt   int64
+	ExecuteAt  int64  //最后一次开始执行的时间
+	TxID       string //节点接受转账后立即记录，用于恢复中断的执行
+	Error      string //最后一次执行失败的原因
+}
+
+//Message 审批人对提案签名的消息
+func (p *Proposal) Message(action string) []byte {
+	msg := fmt.Sprintf("%s|%s|%s|%s|%s|%s|%d", action, p.ID, p.From, p.To, p.Amount, p.ExtParam, p.ExpireAt)
+	return crypto.SHA256([]byte(msg))
+}
+
+//hasVoted 审批人是否已签署意见
+func (p *Proposal) hasVoted(approver string) bool {
+	for _, votes := range [][]*ProposalVote{p.Approvals, p.Rejections} {
+		for _, v := range votes {
+			if v.Approver == approver {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//AddApprover 添加审批人
+func (wm *WalletManager) AddApprover(name string, publicKey []byte) error {
+	if len(name) == 0 {
+		return fmt.Errorf("approver name is empty")
+	}
+	if len(publicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("approver: %s public key must be %d bytes", name, ed25519.PublicKeySize)
+	}
+	return wm.blockChainDB.Save(&Approver{Name: name, PublicKey: hex.EncodeToString(publicKey)})
+}
+
+//RemoveApprover 移除审批人，已签署的意见不再计入
+func (wm *WalletManager) RemoveApprover(name string) error {
+	return wm.blockChainDB.DeleteStruct(&Approver{Name: name})
+}
+
+//GetApprovers 获取所有审批人
+func (wm *WalletManager) GetApprovers() ([]*Approver, error) {
+	var list []*Approver
+	err := wm.blockChainDB.All(&list)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+//requiresApproval 金额是否超过审批阈值
+func (wm *WalletManager) requiresApproval(amount decimal.Decimal) bool {
+	threshold := wm.Config.ApprovalThreshold
+	return threshold.IsPositive() && amount.GreaterThan(threshold)
+}
+
+//createProposal 创建待审批提案，同一业务订单号只创建一次
+func (wm *WalletManager) createProposal(plan *transferPlan, rawTx *openwallet.RawTransaction) (*Proposal, error) {
+
+	wm.approvalMu.Lock()
+	defer wm.approvalMu.Unlock()
+
+	if len(rawTx.Sid) > 0 {
+		var exist Proposal
+		err := wm.blockChainDB.One("Sid", rawTx.Sid, &exist)
+		if err == nil {
+			//同一业务订单号只能对应同一笔转账
+			if exist.From != plan.from || exist.To != plan.to || exist.Amount != plan.amount.String() {
+				return nil, openwallet.Errorf(ErrApprovalInvalid, "sid: %s is used by proposal: %s with a different transfer", rawTx.Sid, exist.ID)
+			}
+			return &exist, nil
+		}
+		if err != storm.ErrNotFound {
+			return nil, err
+		}
+	}
+
+	approvers, err := wm.GetApprovers()
+	if err != nil {
+		return nil, err
+	}
+
+	required := wm.Config.ApprovalRequired
+	if required <= 0 || required > len(approvers) {
+		return nil, openwallet.Errorf(ErrApprovalInvalid, "%d approvals are required, but %d approvers are registered", required, len(approvers))
+	}
+
+	now := time.Now()
+	p := &Proposal{
+		Sid:        rawTx.Sid,
+		Requester:  rawTx.GetExtParam().Get(ExtParamRequester).String(),
+		From:       plan.from,
+		To:         plan.to,
+		Amount:     plan.amount.String(),
+		ExtParam:   rawTx.ExtParam,
+		Required:   required,
+		Status:     ProposalStatusPending,
+		Approvals:  make([]*ProposalVote, 0),
+		Rejections: make([]*ProposalVote, 0),
+		CreateAt:   now.Unix(),
+		ExpireAt:   now.Add(wm.Config.ApprovalExpiry).Unix(),
+	}
+	p.ID = common.Bytes2Hex(crypto.SHA256([]byte(fmt.Sprintf("%s_%s_%s_%d_%s", p.From, p.To, p.Amount, now.UnixNano(), randSeq(8)))))
+
+	err = wm.blockChainDB.Save(p)
+	if err != nil {
+		return nil, err
+	}
+
+	wm.Log.Std.Info("transfer from: %s to: %s amount: %s requires approval, proposal: %s", p.From, p.To, p.Amount, p.ID)
+
+	return p, nil
+}
+
+//GetProposal 查询提案，过期的提案更新为过期状态
+func (wm *WalletManager) GetProposal(id string) (*Proposal, error) {
+	wm.approvalMu.Lock()
+	defer wm.approvalMu.Unlock()
+	return wm.getProposal(id)
+}
+
+func (wm *WalletManager) getProposal(id string) (*Proposal, error) {
+
+	var p Proposal
+	err := wm.blockChainDB.One("ID", id, &p)
+	if err != nil {
+		return nil, err
+	}
+
+	if (p.Status == ProposalStatusPending || p.Status == ProposalStatusApproved) && time.Now().Unix() > p.ExpireAt {
+		p.Status = ProposalStatusExpired
+		err = wm.blockChainDB.Save(&p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.Status == ProposalStatusExecuting && time.Now().Unix() > p.ExecuteAt+int64(wm.Config.ApprovalExecutingTimeout/time.Second) {
+		wm.recoverProposal(&p)
+		err = wm.blockChainDB.Save(&p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &p, nil
+}
+
+//recoverProposal 恢复执行中断的提案，已记录交易单号的为已执行，否则恢复为审批通过
+//没有交易单号时节点可能已接受转账，再次执行前需要核对发送地址的转账记录
+func (wm *WalletManager) recoverProposal(p *Proposal) {
+	if len(p.TxID) > 0 {
+		wm.Log.Std.Warning("proposal: %s execution was interrupted after sent with txid: %s, mark it executed", p.ID, p.TxID)
+		p.Status = ProposalStatusExecuted
+		p.Error = ""
+		return
+	}
+	wm.Log.Std.Warning("proposal: %s execution was interrupted before any txid was recorded, restore it to approved", p.ID)
+	p.Status = ProposalStatusApproved
+	p.Error = "execution timed out without a txid, check the transfers of the address before executing again"
+}
+
+//recordProposalTxID 节点接受转账后立即记录提案的交易单号
+func (wm *WalletManager) recordProposalTxID(id, txid string) {
+
+	wm.approvalMu.Lock()
+	defer wm.approvalMu.Unlock()
+
+	var p Proposal
+	err := wm.blockChainDB.One("ID", id, &p)
+	if err == nil {
+		p.TxID = txid
+		err = wm.blockChainDB.Save(&p)
+	}
+	if err != nil {
+		wm.Log.Std.Error("proposal: %s was sent with txid: %s, but it can not be recorded; unexpected error: %v", id, txid, err)
+	}
+}
+
+//ListProposals 按状态查询提案，状态为空时返回全部
+func (wm *WalletManager) ListProposals(status string) ([]*Proposal, error) {
+
+	var list []*Proposal
+	var err error
+	if len(status) > 0 {
+		err = wm.blockChainDB.Find("Status", status, &list)
+	} else {
+		err = wm.blockChainDB.All(&list)
+	}
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return list, nil
+}
+
+//ApproveProposal 审批人签署同意，签名消息为Proposal.Message(ProposalActionApprove)
+func (wm *WalletManager) ApproveProposal(id, approver string, signature []byte) (*Proposal, error) {
+	return wm.voteProposal(id, approver, ProposalActionApprove, "", signature)
+}
+
+//RejectProposal 审批人签署拒绝，签名消息为Proposal.Message(ProposalActionReject)
+func (wm *WalletManager) RejectProposal(id, approver, reason string, signature []byte) (*Proposal, error) {
+	return wm.voteProposal(id, approver, ProposalActionReject, reason, signature)
+}
+
+//voteProposal 校验审批人签名并记录意见
+func (wm *WalletManager) voteProposal(id, approver, action, reason string, signature []byte) (*Proposal, error) {
+
+	wm.approvalMu.Lock()
+	defer wm.approvalMu.Unlock()
+
+	p, err := wm.getProposal(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Status != ProposalStatusPending {
+		return nil, openwallet.Errorf(ErrApprovalInvalid, "proposal: %s is %s", id, p.Status)
+	}
+
+	var a Approver
+	err = wm.blockChainDB.One("Name", approver, &a)
+	if err != nil {
+		return nil, openwallet.Errorf(ErrApprovalInvalid, "approver: %s is not registered", approver)
+	}
+
+	pub, err := hex.DecodeString(a.PublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, openwallet.Errorf(ErrApprovalInvalid, "approver: %s public key is invalid", approver)
+	}
+
+	if !ed25519.Verify(ed25519.PublicKey(pub), p.Message(action), signature) {
+		return nil, openwallet.Errorf(ErrApprovalInvalid, "approver: %s signature is invalid", approver)
+	}
+
+	if p.hasVoted(approver) {
+		return nil, openwallet.Errorf(ErrApprovalInvalid, "approver: %s has already voted", approver)
+	}
+
+	vote := &ProposalVote{
+		Approver:  approver,
+		Signature: hex.EncodeToString(signature),
+		Reason:    reason,
+		Time:      time.Now().Unix(),
+	}
+
+	approvers, err := wm.GetApprovers()
+	if err != nil {
+		return nil, err
+	}
+
+	if action == ProposalActionApprove {
+		p.Approvals = append(p.Approvals, vote)
+		if countVotes(p.Approvals, approvers) >= p.Required {
+			p.Status = ProposalStatusApproved
+		}
+	} else {
+		p.Rejections = append(p.Rejections, vote)
+		//剩余审批人不足以通过，已被移除的审批人的意见不计入
+		if len(approvers)-countVotes(p.Rejections, approvers) < p.Required {
+			p.Status = ProposalStatusRejected
+		}
+	}
+
+	err = wm.blockChainDB.Save(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+//countVotes 统计仍在册审批人的意见数
+func countVotes(votes []*ProposalVote, approvers []*Approver) int {
+	registered := make(map[string]bool)
+	for _, a := range approvers {
+		registered[a.Name] = true
+	}
+	count := 0
+	for _, v := range votes {
+		if registered[v.Approver] {
+			count++
+		}
+	}
+	return count
+}
+
+//ExecuteProposal 执行审批通过的提案，经过正常的发送流程提交AssetTransferMN2
+//发送期间提案为执行中状态，不持有审批锁
+func (wm *WalletManager) ExecuteProposal(id string, wallet *MACWallet, password string) (*openwallet.Transaction, error) {
+
+	p, err := wm.beginProposal(id, wallet)
+	if err != nil {
+		return nil, err
+	}
+
+	rawTx := &openwallet.RawTransaction{
+		Coin: openwallet.Coin{
+			Symbol:     wm.Symbol(),
+			IsContract: false,
+		},
+		Sid:      p.Sid,
+		To:       map[string]string{p.To: p.Amount},
+		ExtParam: p.ExtParam,
+	}
+
+	tx, sendErr := wm.sendTransaction(wallet, password, rawTx, p.ID)
+
+	wm.approvalMu.Lock()
+	defer wm.approvalMu.Unlock()
+
+	if sendErr != nil {
+		//发送失败，恢复为审批通过，可以再次执行
+		p.Status = ProposalStatusApproved
+		p.Error = sendErr.Error()
+		wm.blockChainDB.Save(p)
+		return nil, sendErr
+	}
+
+	p.Status = ProposalStatusExecuted
+	p.TxID = tx.TxID
+	p.Error = ""
+	err = wm.blockChainDB.Save(p)
+	if err != nil {
+		wm.Log.Std.Error("proposal: %s executed with txid: %s, but can not be saved; unexpected error: %v", p.ID, tx.TxID, err)
+	}
+
+	return tx, nil
+}
+
+//beginProposal 校验提案可以执行，并标记为执行中
+func (wm *WalletManager) beginProposal(id string, wallet *MACWallet) (*Proposal, error) {
+
+	wm.approvalMu.Lock()
+	defer wm.approvalMu.Unlock()
+
+	p, err := wm.getProposal(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Status != ProposalStatusApproved {
+		return nil, openwallet.Errorf(ErrApprovalInvalid, "proposal: %s is %s", id, p.Status)
+	}
+
+	//执行时重新校验，审批人被移除后可能不再满足
+	approvers, err := wm.GetApprovers()
+	if err != nil {
+		return nil, err
+	}
+	if countVotes(p.Approvals, approvers) < p.Required {
+		return nil, openwallet.Errorf(ErrApprovalInvalid, "proposal: %s does not have %d valid approvals", id, p.Required)
+	}
+
+	if wallet.Address != p.From {
+		return nil, openwallet.Errorf(ErrApprovalInvalid, "proposal: %s must be sent from: %s", id, p.From)
+	}
+
+	p.Status = ProposalStatusExecuting
+	p.ExecuteAt = time.Now().Unix()
+	err = wm.blockChainDB.Save(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
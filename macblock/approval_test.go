@@ -0,0 +1,196 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"github.com/blocktree/openwallet/openwallet"
+	"github.com/shopspring/decimal"
+	"golang.org/x/crypto/ed25519"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestWalletManager_ApprovalWorkflow(t *testing.T) {
+
+	sent := 0
+	wm, cleanup := testNewOfflineWalletManager(t, map[string]testNodeAction{
+		"GetAssetBalanceAds": func(form url.Values) string {
+			return `{"errCode": 0, "AssetBalance": "1000"}`
+		},
+		"AssetTransferMN2": func(form url.Values) string {
+			sent++
+			return `{"errCode": 0, "TranHash": "0xabc"}`
+		},
+	})
+	defer cleanup()
+
+	wm.Config.ApprovalThreshold = decimal.New(100, 0)
+	wm.Config.ApprovalRequired = 2
+
+	keys := make(map[string]ed25519.PrivateKey)
+	for _, name := range []string{"alice", "bob", "carol"} {
+		pub, priv, _ := ed25519.GenerateKey(nil)
+		keys[name] = priv
+		if err := wm.AddApprover(name, pub); err != nil {
+			t.Fatalf("AddApprover unexpected error: %v", err)
+		}
+	}
+
+	wallet := &MACWallet{Address: "MACsender000000000000000000000"}
+	newRawTx := func(amount string) *openwallet.RawTransaction {
+		return &openwallet.RawTransaction{To: map[string]string{"MACuser00000000000000000000000": amount}}
+	}
+
+	//阈值以下直接发送
+	if _, err := wm.SendTransaction(wallet, "1234qwer", newRawTx("100")); err != nil {
+		t.Fatalf("SendTransaction unexpected error: %v", err)
+	}
+
+	_, err := wm.SendTransaction(wallet, "1234qwer", newRawTx("150"))
+	required, ok := err.(*ApprovalRequiredError)
+	if !ok {
+		t.Fatalf("SendTransaction error = %v, want ApprovalRequiredError", err)
+	}
+	if sent != 1 {
+		t.Fatalf("transfer above threshold was sent before approval")
+	}
+
+	p, _ := wm.GetProposal(required.ProposalID)
+	sign := func(name, action string) []byte {
+		return ed25519.Sign(keys[name], p.Message(action))
+	}
+
+	if _, err := wm.ApproveProposal(p.ID, "alice", sign("bob", ProposalActionApprove)); ErrorCode(err) != ErrApprovalInvalid {
+		t.Errorf("ApproveProposal with wrong key error = %v", err)
+	}
+	if _, err := wm.ApproveProposal(p.ID, "alice", sign("alice", ProposalActionApprove)); err != nil {
+		t.Fatalf("ApproveProposal unexpected error: %v", err)
+	}
+	if _, err := wm.ApproveProposal(p.ID, "alice", sign("alice", ProposalActionApprove)); ErrorCode(err) != ErrApprovalInvalid {
+		t.Errorf("ApproveProposal twice error = %v", err)
+	}
+	if _, err := wm.ExecuteProposal(p.ID, wallet, "1234qwer"); ErrorCode(err) != ErrApprovalInvalid {
+		t.Errorf("ExecuteProposal before approval error = %v", err)
+	}
+
+	p, err = wm.ApproveProposal(p.ID, "carol", sign("carol", ProposalActionApprove))
+	if err != nil || p.Status != ProposalStatusApproved {
+		t.Fatalf("ApproveProposal = %+v, error = %v", p, err)
+	}
+
+	tx, err := wm.ExecuteProposal(p.ID, wallet, "1234qwer")
+	if err != nil || tx.TxID != "0xabc" || sent != 2 {
+		t.Fatalf("ExecuteProposal unexpected error: %v", err)
+	}
+	if _, err := wm.ExecuteProposal(p.ID, wallet, "1234qwer"); err == nil {
+		t.Errorf("ExecuteProposal should not execute a proposal twice")
+	}
+
+	//拒绝后剩余审批人不足
+	_, err = wm.SendTransaction(wallet, "1234qwer", newRawTx("200"))
+	p, _ = wm.GetProposal(err.(*ApprovalRequiredError).ProposalID)
+	wm.RejectProposal(p.ID, "alice", "unknown partner", sign("alice", ProposalActionReject))
+	p, _ = wm.RejectProposal(p.ID, "bob", "unknown partner", sign("bob", ProposalActionReject))
+	if p.Status != ProposalStatusRejected || len(p.Rejections) != 2 {
+		t.Errorf("RejectProposal = %+v", p)
+	}
+
+	//被移除的审批人的拒绝不计入
+	_, err = wm.SendTransaction(wallet, "1234qwer", newRawTx("250"))
+	p, _ = wm.GetProposal(err.(*ApprovalRequiredError).ProposalID)
+	wm.RejectProposal(p.ID, "alice", "unknown partner", sign("alice", ProposalActionReject))
+	wm.RemoveApprover("alice")
+	pub, _, _ := ed25519.GenerateKey(nil)
+	wm.AddApprover("dave", pub)
+	p, _ = wm.RejectProposal(p.ID, "bob", "unknown partner", sign("bob", ProposalActionReject))
+	if p.Status != ProposalStatusPending {
+		t.Errorf("proposal status = %s, want pending", p.Status)
+	}
+
+	//AssetTransferMN2同样需要审批
+	if _, err := wm.AssetTransferMN2(wallet.Address, "MACuser00000000000000000000000", "400", "", "", "1234qwer"); ErrorCode(err) != ErrApprovalRequired {
+		t.Errorf("AssetTransferMN2 error = %v, want code %d", err, ErrApprovalRequired)
+	}
+	if sent != 2 {
+		t.Errorf("AssetTransferMN2 sent a transfer above threshold")
+	}
+
+	//过期
+	wm.Config.ApprovalExpiry = -time.Second
+	_, err = wm.SendTransaction(wallet, "1234qwer", newRawTx("300"))
+	p, _ = wm.GetProposal(err.(*ApprovalRequiredError).ProposalID)
+	if p.Status != ProposalStatusExpired {
+		t.Errorf("proposal status = %s, want expired", p.Status)
+	}
+}
+
+func TestWalletManager_ApprovalRecovery(t *testing.T) {
+
+	wm, cleanup := testNewOfflineWalletManager(t, map[string]testNodeAction{
+		"GetAssetBalanceAds": func(form url.Values) string {
+			return `{"errCode": 0, "AssetBalance": "1000"}`
+		},
+	})
+	defer cleanup()
+
+	wm.Config.ApprovalThreshold = decimal.New(100, 0)
+	wm.Config.ApprovalRequired = 1
+	pub, _, _ := ed25519.GenerateKey(nil)
+	wm.AddApprover("alice", pub)
+
+	wallet := &MACWallet{Address: "MACsender000000000000000000000"}
+	newRawTx := func(amount string) *openwallet.RawTransaction {
+		return &openwallet.RawTransaction{Sid: "order1", To: map[string]string{"MACuser00000000000000000000000": amount}}
+	}
+
+	//同一业务订单号返回同一提案，转账不同时拒绝
+	_, err := wm.SendTransaction(wallet, "1234qwer", newRawTx("150"))
+	required, ok := err.(*ApprovalRequiredError)
+	if !ok {
+		t.Fatalf("SendTransaction error = %v, want ApprovalRequiredError", err)
+	}
+	if _, err := wm.SendTransaction(wallet, "1234qwer", newRawTx("150")); err == nil || err.(*ApprovalRequiredError).ProposalID != required.ProposalID {
+		t.Errorf("SendTransaction with the same sid error = %v, want proposal: %s", err, required.ProposalID)
+	}
+	if _, err := wm.SendTransaction(wallet, "1234qwer", newRawTx("500")); ErrorCode(err) != ErrApprovalInvalid {
+		t.Errorf("SendTransaction with a reused sid error = %v, want code %d", err, ErrApprovalInvalid)
+	}
+
+	//执行中断的提案超时后恢复
+	stale := time.Now().Add(-wm.Config.ApprovalExecutingTimeout - time.Minute).Unix()
+	for _, p := range []*Proposal{
+		{ID: "sent", Status: ProposalStatusExecuting, ExecuteAt: stale, ExpireAt: time.Now().Add(time.Hour).Unix(), TxID: "0xabc"},
+		{ID: "unsent", Status: ProposalStatusExecuting, ExecuteAt: stale, ExpireAt: time.Now().Add(time.Hour).Unix()},
+		{ID: "running", Status: ProposalStatusExecuting, ExecuteAt: time.Now().Unix(), ExpireAt: time.Now().Add(time.Hour).Unix()},
+	} {
+		if err := wm.blockChainDB.Save(p); err != nil {
+			t.Fatalf("Save unexpected error: %v", err)
+		}
+	}
+
+	want := map[string]string{
+		"sent":    ProposalStatusExecuted,
+		"unsent":  ProposalStatusApproved,
+		"running": ProposalStatusExecuting,
+	}
+	for id, status := range want {
+		p, err := wm.GetProposal(id)
+		if err != nil || p.Status != status {
+			t.Errorf("proposal: %s = %+v, error: %v; want %s", id, p, err, status)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/openwallet/common"
+	"github.com/blocktree/openwallet/crypto"
+	"github.com/blocktree/openwallet/openwallet"
+	"time"
+)
+
+const (
+	auditBucket  = "audit" // audit log head
+	auditHeadKey = "head"
+
+	//ExtParamRequester 交易单扩展参数中的请求方标识，记录到审计日志
+	ExtParamRequester = "requester"
+)
+
+//审计日志的策略结果
+const (
+	AuditDecisionAllowed         = "allowed"         //通过检查，提交节点前记录，记录失败时不发送
+	AuditDecisionRejected        = "rejected"        //提交节点前被拒绝
+	AuditDecisionPendingApproval = "pendingApproval" //超过审批阈值，已创建提案
+	AuditDecisionSent            = "sent"            //节点已接受转账
+	AuditDecisionFailed          = "failed"          //节点返回错误
+)
+
+//AuditEntry 转账审计日志，每条记录包含上一条记录的hash
+type AuditEntry struct {
+	Seq        uint64 `storm:"id"` //从1开始连续递增
+	Time       int64  `storm:"index"`
+	Action     string
+	Requester  string
+	From       string
+	To         string
+	Amount     string
+	Memo       string
+	Decision   string
+	PolicyRule string //被策略拒绝时的规则
+	Response   string //节点返回内容
+	TxID       string
+	Error      string
+	PrevHash   string
+	Hash       string
+}
+
+//auditHead 最新一条审计日志
+type auditHead struct {
+	Seq  uint64
+	Hash string
+}
+
+//computeHash 计算记录hash，不包含Hash字段本身
+func (e *AuditEntry) computeHash() string {
+	obj := *e
+	obj.Hash = ""
+	b, _ := json.Marshal(&obj)
+	return common.Bytes2Hex(crypto.SHA256(b))
+}
+
+//newAuditEntry 由交易单创建审计记录
+func newAuditEntry(action string, wallet *MACWallet, rawTx *openwallet.RawTransaction) *AuditEntry {
+	entry := &AuditEntry{
+		Action:    action,
+		Requester: rawTx.GetExtParam().Get(ExtParamRequester).String(),
+		From:      wallet.Address,
+		Memo:      rawTx.GetExtParam().Get("memo").String(),
+	}
+	for to, amount := range rawTx.To {
+		entry.To = to
+		entry.Amount = amount
+	}
+	return entry
+}
+
+//appendAudit 追加审计日志，返回写入错误，提交节点前的记录写入失败时调用方不能发送
+func (wm *WalletManager) appendAudit(entry *AuditEntry, err error) error {
+
+	if err != nil {
+		entry.Error = err.Error()
+		if policyErr, ok := err.(*PolicyError); ok {
+			entry.PolicyRule = policyErr.Rule
+		}
+	}
+
+	saveErr := wm.AppendAuditEntry(entry)
+	if saveErr != nil {
+		wm.Log.Std.Error("audit log can not append entry; unexpected error: %v", saveErr)
+	}
+	return saveErr
+}
+
+//auditBeforeSend 提交节点前写入审计记录，写入失败返回ErrAuditUnavailable
+func (wm *WalletManager) auditBeforeSend(entry *AuditEntry, decision string) error {
+	before := *entry
+	before.Decision = decision
+	if err := wm.appendAudit(&before, nil); err != nil {
+		return openwallet.Errorf(ErrAuditUnavailable, "audit log can not be written, transfer is not sent; %v", err)
+	}
+	return nil
+}
+
+//AppendAuditEntry 追加一条审计日志，自动设置序号、时间和hash
+func (wm *WalletManager) AppendAuditEntry(entry *AuditEntry) error {
+
+	wm.auditMu.Lock()
+	defer wm.auditMu.Unlock()
+
+	tx, err := wm.blockChainDB.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var head auditHead
+	err = tx.Get(auditBucket, auditHeadKey, &head)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+
+	entry.Seq = head.Seq + 1
+	if entry.Time == 0 {
+		entry.Time = time.Now().Unix()
+	}
+	entry.PrevHash = head.Hash
+	entry.Hash = entry.computeHash()
+
+	err = tx.Save(entry)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Set(auditBucket, auditHeadKey, &auditHead{Seq: entry.Seq, Hash: entry.Hash})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+//VerifyAuditLog 校验整条审计日志链，返回记录数
+//序号不连续、hash不匹配或与最新记录不一致时返回出错的序号
+func (wm *WalletManager) VerifyAuditLog() (uint64, error) {
+
+	wm.auditMu.Lock()
+	defer wm.auditMu.Unlock()
+
+	var (
+		count    uint64
+		prevHash string
+	)
+
+	err := wm.blockChainDB.Select().OrderBy("Seq").Each(new(AuditEntry), func(record interface{}) error {
+		entry := record.(*AuditEntry)
+		if entry.Seq != count+1 {
+			return fmt.Errorf("audit log entry: %d is missing", count+1)
+		}
+		if entry.PrevHash != prevHash {
+			return fmt.Errorf("audit log entry: %d previous hash does not match", entry.Seq)
+		}
+		if entry.computeHash() != entry.Hash {
+			return fmt.Errorf("audit log entry: %d has been modified", entry.Seq)
+		}
+		count = entry.Seq
+		prevHash = entry.Hash
+		return nil
+	})
+	if err != nil && err != storm.ErrNotFound {
+		return count, err
+	}
+
+	var head auditHead
+	err = wm.blockChainDB.Get(auditBucket, auditHeadKey, &head)
+	if err != nil && err != storm.ErrNotFound {
+		return count, err
+	}
+	if head.Seq != count || head.Hash != prevHash {
+		return count, fmt.Errorf("audit log ends at entry: %d, but the head is entry: %d", count, head.Seq)
+	}
+
+	return count, nil
+}
+
+//ExportAuditLog 导出时间范围内的审计日志，包含start和end
+func (wm *WalletManager) ExportAuditLog(start, end time.Time) ([]*AuditEntry, error) {
+
+	var list []*AuditEntry
+	err := wm.blockChainDB.Select(
+		q.Gte("Time", start.Unix()),
+		q.Lte("Time", end.Unix()),
+	).OrderBy("Seq").Find(&list)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	if list == nil {
+		list = make([]*AuditEntry, 0)
+	}
+	return list, nil
+}
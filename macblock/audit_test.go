@@ -0,0 +1,122 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"github.com/blocktree/openwallet/openwallet"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestWalletManager_AuditLog(t *testing.T) {
+
+	wm, cleanup := testNewOfflineWalletManager(t, map[string]testNodeAction{
+		"GetAssetBalanceAds": func(form url.Values) string {
+			return `{"errCode": 0, "AssetBalance": "10"}`
+		},
+		"AssetTransferMN2": func(form url.Values) string {
+			return `{"errCode": 0, "TranHash": "0xabc"}`
+		},
+	})
+	defer cleanup()
+
+	wallet := &MACWallet{Address: "MACsender000000000000000000000"}
+
+	rawTx := &openwallet.RawTransaction{To: map[string]string{"MACuser00000000000000000000000": "1"}}
+	rawTx.SetExtParam("memo", "john")
+	rawTx.SetExtParam(ExtParamRequester, "payout-service")
+	if _, err := wm.SendTransaction(wallet, "1234qwer", rawTx); err != nil {
+		t.Fatalf("SendTransaction unexpected error: %v", err)
+	}
+
+	rejected := &openwallet.RawTransaction{To: map[string]string{"MACuser00000000000000000000000": "100"}}
+	if _, err := wm.SendTransaction(wallet, "1234qwer", rejected); err == nil {
+		t.Fatalf("SendTransaction should reject insufficient balance")
+	}
+
+	if _, err := wm.AssetTransferMN2("MACsender000000000000000000000", "MACuser00000000000000000000000", "1", "", "", "1234qwer"); err != nil {
+		t.Fatalf("AssetTransferMN2 unexpected error: %v", err)
+	}
+
+	//每次发送在提交节点前后各记录一条
+	count, err := wm.VerifyAuditLog()
+	if err != nil || count != 5 {
+		t.Fatalf("VerifyAuditLog = %d, error = %v", count, err)
+	}
+
+	entries, err := wm.ExportAuditLog(time.Now().Add(-time.Minute), time.Now().Add(time.Minute))
+	if err != nil || len(entries) != 5 {
+		t.Fatalf("ExportAuditLog = %d entries, error = %v", len(entries), err)
+	}
+
+	if entries[0].Decision != AuditDecisionAllowed || len(entries[0].TxID) != 0 {
+		t.Errorf("audit entry = %+v", entries[0])
+	}
+	sent := entries[1]
+	if sent.Requester != "payout-service" || sent.Decision != AuditDecisionSent || sent.TxID != "0xabc" || sent.Memo != "john" {
+		t.Errorf("audit entry = %+v", sent)
+	}
+	if entries[2].Decision != AuditDecisionRejected || len(entries[2].Error) == 0 {
+		t.Errorf("audit entry = %+v", entries[2])
+	}
+	//AssetTransferMN2与SendTransaction经过相同的检查
+	if entries[3].Decision != AuditDecisionAllowed || entries[3].PrevHash != entries[2].Hash {
+		t.Errorf("audit entry = %+v", entries[3])
+	}
+	if entries[4].Decision != AuditDecisionSent {
+		t.Errorf("audit entry = %+v", entries[4])
+	}
+
+	//篡改记录后校验失败
+	sent.Amount = "1000"
+	wm.blockChainDB.Save(sent)
+	if _, err := wm.VerifyAuditLog(); err == nil {
+		t.Errorf("VerifyAuditLog should detect a modified entry")
+	}
+}
+
+func TestWalletManager_AuditLog_Unavailable(t *testing.T) {
+
+	sent := 0
+	wm, cleanup := testNewOfflineWalletManager(t, map[string]testNodeAction{
+		"GetAssetBalanceAds": func(form url.Values) string {
+			return `{"errCode": 0, "AssetBalance": "10"}`
+		},
+		"AssetTransferMN2": func(form url.Values) string {
+			sent++
+			return `{"errCode": 0, "TranHash": "0xabc"}`
+		},
+	})
+	defer cleanup()
+
+	//审计日志头损坏，无法追加记录
+	wm.blockChainDB.Set(auditBucket, auditHeadKey, "broken")
+
+	wallet := &MACWallet{Address: "MACsender000000000000000000000"}
+	rawTx := &openwallet.RawTransaction{To: map[string]string{"MACuser00000000000000000000000": "1"}}
+	if _, err := wm.SendTransaction(wallet, "1234qwer", rawTx); ErrorCode(err) != ErrAuditUnavailable {
+		t.Errorf("SendTransaction error = %v, want code %d", err, ErrAuditUnavailable)
+	}
+
+	if _, err := wm.AssetTransferMN2("MACsender000000000000000000000", "MACuser00000000000000000000000", "1", "", "", "1234qwer"); ErrorCode(err) != ErrAuditUnavailable {
+		t.Errorf("AssetTransferMN2 error = %v, want code %d", err, ErrAuditUnavailable)
+	}
+
+	if sent > 0 {
+		t.Errorf("%d transfers were sent without an audit record", sent)
+	}
+}
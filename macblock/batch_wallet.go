@@ -0,0 +1,292 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+//manifestHeader 清单文件表头
+var manifestHeader = []string{"alias", "address", "keyFile"}
+
+//ManifestEntry 批量创建清单的一条记录
+type ManifestEntry struct {
+	Alias   string
+	Address string
+	KeyFile string
+}
+
+//BatchProgress 批量创建进度
+type BatchProgress struct {
+	Total   int    //需要创建的总数
+	Done    int    //已处理数，包含跳过和失败
+	Skipped int    //清单中已存在，跳过
+	Failed  int    //创建失败
+	Alias   string //当前处理的钱包别名
+	Address string //当前创建的地址，失败时为空
+	Err     error  //当前钱包的错误
+}
+
+//BatchCreateOptions 批量创建参数
+type BatchCreateOptions struct {
+	Count       int                  //创建数量
+	AliasPrefix string               //别名前缀，别名为前缀加6位序号，如：partner000001
+	Concurrency int                  //并发数，默认1
+	Manifest    string               //清单文件路径，已存在时跳过清单中的别名
+	MaxFailures int                  //失败达到该数量时停止创建，默认10
+	Progress    func(*BatchProgress) //进度回调，逐个调用，并发时按完成顺序而不是序号顺序
+}
+
+const (
+	defaultBatchMaxFailures = 10 //默认失败上限
+)
+
+//BatchCreateWallets 批量创建钱包，每创建一个立即追加到清单文件，返回已创建的钱包
+//中断后使用相同参数再次调用可继续创建，失败的钱包不写入清单，下次调用时重试
+//节点限速通过requestsPerSecond配置
+func (wm *WalletManager) BatchCreateWallets(keydir, password string, opts *BatchCreateOptions) ([]*ManifestEntry, error) {
+
+	if opts.Count <= 0 {
+		return nil, fmt.Errorf("batch count must be greater than 0")
+	}
+
+	if len(opts.Manifest) == 0 {
+		return nil, fmt.Errorf("batch manifest path is empty")
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	maxFailures := opts.MaxFailures
+	if maxFailures <= 0 {
+		maxFailures = defaultBatchMaxFailures
+	}
+
+	entries, err := ReadManifest(opts.Manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	created := make(map[string]*ManifestEntry)
+	for _, e := range entries {
+		created[e.Alias] = e
+	}
+
+	manifest, err := openManifest(opts.Manifest)
+	if err != nil {
+		return nil, err
+	}
+	defer manifest.Close()
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		writeErr error
+		result   = make([]*ManifestEntry, opts.Count)
+		progress = &BatchProgress{Total: opts.Count}
+		jobs     = make(chan int)
+	)
+
+	//report 更新进度并回调，调用时持有mu
+	report := func(alias, address string, err error) {
+		progress.Done++
+		progress.Alias = alias
+		progress.Address = address
+		progress.Err = err
+		if opts.Progress != nil {
+			p := *progress
+			opts.Progress(&p)
+		}
+	}
+
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				alias := fmt.Sprintf("%s%06d", opts.AliasPrefix, i+1)
+
+				wallet, keyFile, err := wm.CreateNewWallet(keydir, alias, password)
+
+				mu.Lock()
+				if err == nil && writeErr == nil {
+					entry := &ManifestEntry{Alias: alias, Address: wallet.Address, KeyFile: keyFile}
+					err = manifest.Write([]string{entry.Alias, entry.Address, entry.KeyFile})
+					if err == nil {
+						manifest.Flush()
+						err = manifest.Error()
+					}
+					if err != nil {
+						writeErr = err
+					} else {
+						result[i] = entry
+					}
+				}
+				if err != nil {
+					wm.Log.Std.Error("batch create wallet: %s failed; unexpected error: %v", alias, err)
+					progress.Failed++
+					report(alias, "", err)
+				} else {
+					report(alias, wallet.Address, nil)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for i := 0; i < opts.Count; i++ {
+		alias := fmt.Sprintf("%s%06d", opts.AliasPrefix, i+1)
+		if e, ok := created[alias]; ok {
+			mu.Lock()
+			result[i] = e
+			progress.Skipped++
+			report(alias, e.Address, nil)
+			mu.Unlock()
+			continue
+		}
+		//清单无法写入或失败过多时不再派发，已派发的钱包继续完成
+		mu.Lock()
+		stop := writeErr != nil || progress.Failed >= maxFailures
+		mu.Unlock()
+		if stop {
+			break
+		}
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	if writeErr != nil {
+		return nil, fmt.Errorf("batch manifest can not be written: %v", writeErr)
+	}
+
+	list := make([]*ManifestEntry, 0, len(result))
+	for _, e := range result {
+		if e != nil {
+			list = append(list, e)
+		}
+	}
+
+	if progress.Failed >= maxFailures {
+		return list, fmt.Errorf("batch create aborted after %d failures, call again to resume", progress.Failed)
+	}
+
+	if progress.Failed > 0 {
+		return list, fmt.Errorf("batch create failed for %d of %d wallets, call again to resume", progress.Failed, opts.Count)
+	}
+
+	return list, nil
+}
+
+//ReadManifest 读取批量创建清单，文件不存在时返回空列表
+//中断时写了一半的记录会被忽略
+func ReadManifest(path string) ([]*ManifestEntry, error) {
+
+	entries := make([]*ManifestEntry, 0)
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); ok {
+				continue
+			}
+			return nil, err
+		}
+		if len(record) != len(manifestHeader) || record[0] == manifestHeader[0] {
+			continue
+		}
+		if CheckAddress(record[1]) != nil {
+			continue
+		}
+		entries = append(entries, &ManifestEntry{Alias: record[0], Address: record[1], KeyFile: record[2]})
+	}
+
+	return entries, nil
+}
+
+//manifestWriter 追加写入清单文件
+type manifestWriter struct {
+	*csv.Writer
+	f *os.File
+}
+
+func (w *manifestWriter) Close() error {
+	w.Flush()
+	return w.f.Close()
+}
+
+//openManifest 打开清单文件用于追加，新文件写入表头
+func openManifest(path string) (*manifestWriter, error) {
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &manifestWriter{Writer: csv.NewWriter(f), f: f}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.Size() == 0 {
+		w.Write(manifestHeader)
+		w.Flush()
+		return w, nil
+	}
+
+	//上次中断时最后一行可能不完整，没有以换行结尾时先换行
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, info.Size()-1); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if last[0] != '\n' {
+		if _, err := f.WriteString("\n"); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	return w, nil
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWalletManager_BatchCreateWallets(t *testing.T) {
+
+	var (
+		mu    sync.Mutex
+		calls = 0
+	)
+
+	wm, cleanup := testNewOfflineWalletManager(t, map[string]testNodeAction{
+		"IncreaseTokenAddress2": func(form url.Values) string {
+			mu.Lock()
+			defer mu.Unlock()
+			calls++
+			if calls == 4 {
+				return `{"errCode": 1, "Msg": "node busy"}`
+			}
+			return fmt.Sprintf(`{"errCode": 0, "NewTokenAddress": "MACbatch%022d"}`, calls)
+		},
+		"GetmyWalletKey2": func(form url.Values) string {
+			return `{"errCode": 0, "WalletKey": "key"}`
+		},
+		"GetMnemonicWords2": func(form url.Values) string {
+			return `{"errCode": 0, "MnemonicWords": "words"}`
+		},
+		"GetMtsign2": func(form url.Values) string {
+			return `{"errCode": 0, "Mtsign": "sign"}`
+		},
+	})
+	defer cleanup()
+
+	wm.client.SetRateLimit(1000)
+
+	keydir := filepath.Join(wm.Config.DataDir, "key")
+	done := make([]int, 0)
+	opts := &BatchCreateOptions{
+		Count:       10,
+		AliasPrefix: "partner",
+		Concurrency: 3,
+		Manifest:    filepath.Join(wm.Config.DataDir, "manifest.csv"),
+		Progress: func(p *BatchProgress) {
+			done = append(done, p.Done)
+		},
+	}
+
+	list, err := wm.BatchCreateWallets(keydir, "1234qwer", opts)
+	if err == nil || len(list) != 9 {
+		t.Fatalf("BatchCreateWallets = %d wallets, error: %v", len(list), err)
+	}
+	for i, d := range done {
+		if d != i+1 {
+			t.Fatalf("progress is out of order: %v", done)
+		}
+	}
+
+	//继续创建失败的钱包
+	done = done[:0]
+	list, err = wm.BatchCreateWallets(keydir, "1234qwer", opts)
+	if err != nil || len(list) != 10 {
+		t.Fatalf("BatchCreateWallets = %d wallets, error: %v", len(list), err)
+	}
+	if calls != 11 || len(done) != 10 {
+		t.Errorf("resume called node %d times, reported %d", calls, len(done))
+	}
+
+	entries, err := ReadManifest(opts.Manifest)
+	if err != nil || len(entries) != 10 {
+		t.Fatalf("ReadManifest = %d entries, error: %v", len(entries), err)
+	}
+
+	//再次打开清单不追加空行
+	wm.BatchCreateWallets(keydir, "1234qwer", opts)
+	content, _ := ioutil.ReadFile(opts.Manifest)
+	if strings.Contains(string(content), "\n\n") {
+		t.Errorf("manifest contains blank lines: %q", content)
+	}
+
+	aliases := make(map[string]bool)
+	for _, e := range entries {
+		aliases[e.Alias] = true
+		wallet, err := wm.GetWalletInfo(e.KeyFile, "1234qwer")
+		if err != nil || wallet.Address != e.Address {
+			t.Errorf("GetWalletInfo(%s) = %+v, error: %v", e.KeyFile, wallet, err)
+		}
+	}
+	if len(aliases) != 10 || !aliases["partner000010"] {
+		t.Errorf("manifest aliases = %v", aliases)
+	}
+}
+
+func TestWalletManager_BatchCreateWallets_MaxFailures(t *testing.T) {
+
+	var (
+		mu    sync.Mutex
+		calls = 0
+	)
+
+	wm, cleanup := testNewOfflineWalletManager(t, map[string]testNodeAction{
+		"IncreaseTokenAddress2": func(form url.Values) string {
+			mu.Lock()
+			defer mu.Unlock()
+			calls++
+			return `{"errCode": 1, "Msg": "node busy"}`
+		},
+	})
+	defer cleanup()
+
+	opts := &BatchCreateOptions{
+		Count:       100,
+		AliasPrefix: "partner",
+		Concurrency: 2,
+		Manifest:    filepath.Join(wm.Config.DataDir, "manifest.csv"),
+		MaxFailures: 3,
+	}
+
+	list, err := wm.BatchCreateWallets(filepath.Join(wm.Config.DataDir, "key"), "1234qwer", opts)
+	if err == nil || len(list) != 0 {
+		t.Fatalf("BatchCreateWallets = %d wallets, error: %v", len(list), err)
+	}
+
+	//停止派发后最多完成并发数的在途创建
+	if calls > opts.MaxFailures+opts.Concurrency {
+		t.Errorf("BatchCreateWallets called the node %d times after %d failures", calls, opts.MaxFailures)
+	}
+}
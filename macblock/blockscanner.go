@@ -18,6 +18,8 @@ package macblock
 import (
 	"fmt"
 	"github.com/blocktree/openwallet/openwallet"
+	"sync"
+	"time"
 )
 
 const (
@@ -28,18 +30,26 @@ const (
 type MACBlockScanner struct {
 	*openwallet.BlockScannerBase
 
-	CurrentBlockHeight   uint64         //当前区块高度
-	extractingCH         chan struct{}  //扫描工作令牌
-	wm                   *WalletManager //钱包管理者
-	RescanLastBlockCount uint64         //重扫上N个区块数量
+	CurrentBlockHeight   uint64                    //当前区块高度
+	extractingCH         chan struct{}             //扫描工作令牌
+	wm                   *WalletManager            //钱包管理者
+	RescanLastBlockCount uint64                    //重扫上N个区块数量
+	memoScanTargetFunc   MemoScanTargetFunc        //固定充值地址通过备注查找用户
+	heightCache          blockHeightCache          //节点最新高度缓存
+	unscanMu             sync.Mutex                //未扫记录锁
+	outboxMu             sync.Mutex                //事件写入锁
+	queuesMu             sync.Mutex                //投递队列锁
+	queues               map[string]*observerQueue //每个观察者的投递队列
+	outboxPublished      int                       //上次清理事件箱之后保存事件的次数
 }
 
 //ExtractResult 扫描完成的提取结果
 type ExtractResult struct {
-	extractData map[string]*openwallet.TxExtractData
-	TxID        string
-	BlockHeight uint64
-	Success     bool
+	extractData  map[string]*openwallet.TxExtractData
+	unattributed *UnattributedDeposit //固定充值地址无法归属的充值
+	TxID         string
+	BlockHeight  uint64
+	Success      bool
 }
 
 //SaveResult 保存结果
@@ -95,6 +105,12 @@ func (bs *MACBlockScanner) ScanBlockTask() {
 	currentHeight := blockHeader.Height
 	currentHash := blockHeader.Hash
 
+	//继续投递上次未完成的事件
+	bs.dispatchOutbox()
+
+	//并发预取后续区块，按顺序处理
+	prefetcher := newBlockPrefetcher(bs.wm, bs.wm.Config.PrefetchWindow)
+
 	for {
 
 		if !bs.Scanning {
@@ -103,7 +119,7 @@ func (bs *MACBlockScanner) ScanBlockTask() {
 		}
 
 		//获取最大高度
-		maxHeight, err := bs.wm.GetBlockHeight()
+		maxHeight, err := bs.getBlockHeight()
 		if err != nil {
 			//下一个高度找不到会报异常
 			bs.wm.Log.Std.Info("block scanner can not get rpc-server block height; unexpected error: %v", err)
@@ -116,22 +132,18 @@ func (bs *MACBlockScanner) ScanBlockTask() {
 			break
 		}
 
-		//继续扫描下一个区块
-		currentHeight = currentHeight + 1
-
-		bs.wm.Log.Std.Info("block scanner scanning height: %d ...", currentHeight)
+		bs.wm.Log.Std.Info("block scanner scanning height: %d ...", currentHeight+1)
 
-		block, err := bs.wm.GetTransactionRecordHight(currentHeight)
+		block, err := prefetcher.Get(currentHeight+1, maxHeight)
 		if err != nil {
-			bs.wm.Log.Std.Info("block scanner can not get new block data; unexpected error: %v", err)
-
-			//记录未扫区块
-			unscanRecord := NewUnscanRecord(currentHeight, "", err.Error())
-			bs.SaveUnscanRecord(unscanRecord)
-			bs.wm.Log.Std.Info("block height: %d extract failed.", currentHeight)
-			continue
+			//不能跳过区块，否则下一区块只能和其他高度的hash对比，下次扫描从该高度重试
+			bs.wm.Log.Std.Info("block scanner can not get block height: %d; unexpected error: %v", currentHeight+1, err)
+			break
 		}
 
+		//继续扫描下一个区块
+		currentHeight = currentHeight + 1
+
 		isFork := false
 
 		//判断hash是否上一区块的hash
@@ -141,51 +153,19 @@ func (bs *MACBlockScanner) ScanBlockTask() {
 			bs.wm.Log.Std.Info("block height: %d local hash = %s ", currentHeight-1, currentHash)
 			bs.wm.Log.Std.Info("block height: %d mainnet hash = %s ", currentHeight-1, block.Previousblockhash)
 
-			bs.wm.Log.Std.Info("delete recharge records on block height: %d.", currentHeight-1)
-
-			//查询本地分叉的区块
-			forkBlock, _ := bs.GetLocalBlock(currentHeight - 1)
-
-			//删除上一区块链的所有充值记录
-			//bs.DeleteRechargesByHeight(currentHeight - 1)
-			//删除上一区块链的未扫记录
-			bs.DeleteUnscanRecord(currentHeight - 1)
-			currentHeight = currentHeight - 2 //倒退2个区块重新扫描
-			if currentHeight <= 0 {
-				currentHeight = 1
-			}
-
-			localBlock, err := bs.GetLocalBlock(currentHeight)
+			//回溯到共同祖先，从祖先重新扫描
+			ancestor, err := bs.handleReorg(currentHeight-1, currentHash)
 			if err != nil {
-				bs.wm.Log.Std.Error("block scanner can not get local block; unexpected error: %v", err)
-
-				//查找core钱包的RPC
-				bs.wm.Log.Info("block scanner prev block height:", currentHeight)
-
-				localBlock, err = bs.wm.GetTransactionRecordHight(currentHeight)
-				if err != nil {
-					bs.wm.Log.Std.Error("block scanner can not get prev block; unexpected error: %v", err)
-					break
-				}
-
+				bs.wm.Log.Std.Error("block scanner can not handle reorg; unexpected error: %v", err)
+				break
 			}
 
-			//重置当前区块的hash
-			currentHash = localBlock.Hash
+			currentHeight = ancestor.Height
+			currentHash = ancestor.Hash
+			prefetcher.Reset()
 
 			bs.wm.Log.Std.Info("rescan block on height: %d, hash: %s .", currentHeight, currentHash)
 
-			//重新记录一个新扫描起点
-			bs.SaveLocalNewBlock(localBlock.Height, localBlock.Hash)
-
-			isFork = true
-
-			if forkBlock != nil {
-
-				//通知分叉区块给观测者，异步处理
-				bs.newBlockNotify(forkBlock, isFork)
-			}
-
 		} else {
 
 			err = bs.BatchExtractTransaction(block.Height, block.Hash, block.txDetails)
@@ -200,6 +180,18 @@ func (bs *MACBlockScanner) ScanBlockTask() {
 			bs.SaveLocalNewBlock(currentHeight, currentHash)
 			bs.SaveLocalBlock(block)
 
+			//定期清理保留范围之外的本地区块
+			if currentHeight%pruneInterval == 0 {
+				if _, err := bs.PruneLocalBlocks(currentHeight, bs.wm.Config.HeaderRetention); err != nil {
+					bs.wm.Log.Std.Error("block scanner can not prune local blocks; unexpected error: %v", err)
+				}
+			}
+
+			//通知达到确认数的交易
+			if err := bs.ReleasePendingExtractData(currentHeight); err != nil {
+				bs.wm.Log.Std.Error("block scanner can not release pending transactions; unexpected error: %v", err)
+			}
+
 			isFork = false
 
 			//通知新区块给观测者，异步处理
@@ -258,34 +250,40 @@ func (bs *MACBlockScanner) scanBlock(height uint64) (*Block, error) {
 	return block, nil
 }
 
-//rescanFailedRecord 重扫失败记录
+//rescanFailedRecord 重扫到达重试时间的失败记录，失败时按指数退避，超过最大次数移入死信
 func (bs *MACBlockScanner) RescanFailedRecord() {
 
 	var (
-		blockMap = make(map[uint64][]string)
+		blockMap   = make(map[uint64]map[string][]string)
+		wholeBlock = make(map[uint64]bool)
 	)
 
-	list, err := bs.GetUnscanRecords()
+	list, err := bs.dueUnscanRecords(time.Now())
 	if err != nil {
 		bs.wm.Log.Std.Info("block scanner can not get rescan data; unexpected error: %v", err)
 	}
 
-	//组合成批处理
+	//按高度组合成批处理，没有TxID的旧记录需要重扫整个区块
 	for _, r := range list {
 
-		if _, exist := blockMap[r.BlockHeight]; !exist {
-			blockMap[r.BlockHeight] = make([]string, 0)
+		if len(r.TxID) == 0 {
+			wholeBlock[r.BlockHeight] = true
+			continue
 		}
 
-		if len(r.TxID) > 0 {
-			arr := blockMap[r.BlockHeight]
-			arr = append(arr, r.TxID)
-
-			blockMap[r.BlockHeight] = arr
+		targets, exist := blockMap[r.BlockHeight]
+		if !exist {
+			targets = make(map[string][]string)
+			blockMap[r.BlockHeight] = targets
 		}
+		targets[r.TxID] = addUnscanObserver(targets[r.TxID], r.Observer)
+	}
+
+	for height := range wholeBlock {
+		blockMap[height] = nil
 	}
 
-	for height, _ := range blockMap {
+	for height, targets := range blockMap {
 
 		if height == 0 {
 			continue
@@ -293,22 +291,36 @@ func (bs *MACBlockScanner) RescanFailedRecord() {
 
 		bs.wm.Log.Std.Info("block scanner rescanning height: %d ...", height)
 
-		block, err := bs.wm.GetTransactionRecordHight(height)
+		err := bs.rescanHeight(height, targets)
 		if err != nil {
-			bs.wm.Log.Std.Info("block scanner can not get new block data; unexpected error: %v", err)
+			bs.wm.Log.Std.Info("block scanner rescan height: %d failed; unexpected error: %v", height, err)
 			continue
 		}
+	}
 
-		err = bs.BatchExtractTransaction(height, block.Hash, block.txDetails)
-		if err != nil {
-			bs.wm.Log.Std.Info("block scanner can not extractRechargeRecords; unexpected error: %v", err)
-			continue
-		}
+}
+
+//replayObservers 重新通知失败的观察者，已确认和未确认的通知分别重放
+func (bs *MACBlockScanner) replayObservers(height uint64, txID string, extractData map[string]*openwallet.TxExtractData, observers []string) error {
 
-		//删除未扫记录
-		bs.DeleteUnscanRecord(height)
+	var confirmed, unconfirmed []string
+	for _, o := range observers {
+		if bs.unscanConfirmed(height, txID, o) {
+			confirmed = append(confirmed, o)
+		} else {
+			unconfirmed = append(unconfirmed, o)
+		}
 	}
 
+	if len(unconfirmed) > 0 {
+		if err := bs.replayExtractData(height, extractData, unconfirmed, false); err != nil {
+			return err
+		}
+	}
+	if len(confirmed) > 0 {
+		return bs.replayExtractData(height, extractData, confirmed, true)
+	}
+	return nil
 }
 
 //newBlockNotify 获得新区块后，通知给观测者
@@ -321,6 +333,12 @@ func (bs *MACBlockScanner) newBlockNotify(block *Block, isFork bool) {
 //BatchExtractTransaction 批量提取交易单
 //bitcoin 1M的区块链可以容纳3000笔交易，批量多线程处理，速度更快
 func (bs *MACBlockScanner) BatchExtractTransaction(blockHeight uint64, blockHash string, txs []*Transaction) error {
+	return bs.batchExtractTransaction(blockHeight, blockHash, txs, nil)
+}
+
+//batchExtractTransaction 批量提取交易单，replay不为空时是重放失败记录
+//replay的值是需要重新通知的观察者，为空时交易按正常流程通知全部观察者
+func (bs *MACBlockScanner) batchExtractTransaction(blockHeight uint64, blockHash string, txs []*Transaction, replay map[string][]string) error {
 
 	var (
 		quit       = make(chan struct{})
@@ -346,20 +364,33 @@ func (bs *MACBlockScanner) BatchExtractTransaction(blockHeight uint64, blockHash
 		//回收创建的地址
 		for gets := range result {
 
+			observers, replaying := replay[gets.TxID]
+
 			if gets.Success {
 
-				notifyErr := bs.newExtractDataNotify(height, gets.extractData)
+				var notifyErr error
+				if len(observers) > 0 {
+					//只重新通知失败的观察者，按失败时的确认状态分组
+					notifyErr = bs.replayObservers(height, gets.TxID, gets.extractData, observers)
+				} else {
+					notifyErr = bs.deliverExtractData(height, blockHash, gets.extractData, replaying)
+					if notifyErr == nil && gets.unattributed != nil {
+						notifyErr = bs.deliverUnattributedDeposit(height, blockHash, gets.unattributed)
+					}
+				}
 				//saveErr := bs.SaveRechargeToWalletDB(height, gets.Recharges)
 				if notifyErr != nil {
 					failed++ //标记保存失败数
 					bs.wm.Log.Std.Info("newExtractDataNotify unexpected error: %v", notifyErr)
+					bs.recordUnscanFailure(NewUnscanRecord(height, gets.TxID, notifyErr.Error()), replaying)
+				} else if replaying && len(observers) == 0 {
+					bs.deleteUnscanRecord(NewUnscanRecord(height, gets.TxID, "").ID)
 				}
 
 			} else {
-				//记录未扫区块
-				unscanRecord := NewUnscanRecord(height, "", "")
-				bs.SaveUnscanRecord(unscanRecord)
-				bs.wm.Log.Std.Info("block height: %d extract failed.", height)
+				//记录提取失败的交易
+				bs.recordUnscanFailure(NewUnscanRecord(height, gets.TxID, "extract transaction failed"), replaying)
+				bs.wm.Log.Std.Info("block height: %d transaction: %s extract failed.", height, gets.TxID)
 				failed++ //标记保存失败数
 			}
 			//累计完成的线程数
@@ -464,6 +495,13 @@ func (bs *MACBlockScanner) ExtractTransaction(blockHeight uint64, blockHash stri
 //ExtractTransactionData 提取交易单
 func (bs *MACBlockScanner) extractTransaction(trx *Transaction, result *ExtractResult, scanTargetFunc openwallet.BlockScanTargetFunc) {
 
+	//金额不合法的交易不提取，记录为未扫
+	if trx.amountErr != nil {
+		bs.wm.Log.Std.Error("transaction: %s amount is invalid; unexpected error: %v", trx.TxID, trx.amountErr)
+		result.Success = false
+		return
+	}
+
 	amount := trx.Amount
 	fees := "0"
 	from := trx.FromToken
@@ -498,11 +536,25 @@ func (bs *MACBlockScanner) extractTransaction(trx *Transaction, result *ExtractR
 
 	}
 
-	sourceKey2, ok2 := scanTargetFunc(
-		openwallet.ScanTarget{
-			Address:          to,
-			BalanceModelType: openwallet.BalanceModelTypeAddress,
-		})
+	var (
+		sourceKey2 string
+		ok2        bool
+	)
+	if bs.isMemoDeposit(to) {
+		//固定充值地址通过备注归属用户
+		var reason string
+		sourceKey2, reason = bs.lookupDepositMemo(trx.Note, scanTargetFunc)
+		ok2 = len(reason) == 0
+		if !ok2 {
+			result.unattributed = newUnattributedDeposit(trx, reason)
+		}
+	} else {
+		sourceKey2, ok2 = scanTargetFunc(
+			openwallet.ScanTarget{
+				Address:          to,
+				BalanceModelType: openwallet.BalanceModelTypeAddress,
+			})
+	}
 	if ok2 {
 		output := openwallet.TxOutPut{}
 		output.TxID = trx.TxID
@@ -550,32 +602,32 @@ func (bs *MACBlockScanner) extractTransaction(trx *Transaction, result *ExtractR
 		wxID := openwallet.GenTransactionWxID(tx)
 		tx.WxID = wxID
 		tx.SetExtParam("memo", trx.Note)
+		//结构化备注解析为扩展参数，格式不正确时保留原始备注
+		if bs.wm.Config.StructuredMemo && len(trx.Note) > 0 {
+			if memo, err := ParseMemo(trx.Note); err == nil {
+				for k, v := range memoExtParam(memo) {
+					tx.SetExtParam(k, v)
+				}
+			}
+		}
+		//地址标签
+		if label := bs.wm.lookupAddressLabel(from); label != nil {
+			tx.SetExtParam("fromLabel", labelExtParam(label))
+		}
+		if label := bs.wm.lookupAddressLabel(to); label != nil {
+			tx.SetExtParam("toLabel", labelExtParam(label))
+		}
 		extractData.Transaction = tx
 	}
 
 	result.Success = true
 }
 
-//newExtractDataNotify 发送通知
-func (bs *MACBlockScanner) newExtractDataNotify(height uint64, extractData map[string]*openwallet.TxExtractData) error {
-
-	for o, _ := range bs.Observers {
-		for key, data := range extractData {
-			err := o.BlockExtractDataNotify(key, data)
-			if err != nil {
-				bs.wm.Log.Error("BlockExtractDataNotify unexpected error:", err)
-				//记录未扫区块
-				unscanRecord := NewUnscanRecord(height, "", "ExtractData Notify failed.")
-				err = bs.SaveUnscanRecord(unscanRecord)
-				if err != nil {
-					bs.wm.Log.Std.Error("block height: %d, save unscan record failed. unexpected error: %v", height, err.Error())
-				}
-
-			}
-		}
-	}
+//newExtractDataNotify 发送通知，先保存到事件箱，再由每个观察者的投递队列异步投递
+//observers不为空时只通知指定的观察者，replay为true时是重放失败记录
+func (bs *MACBlockScanner) newExtractDataNotify(height uint64, extractData map[string]*openwallet.TxExtractData, observers []string, replay bool) error {
 
-	return nil
+	return bs.publishOutbox(height, extractData, observers, replay)
 }
 
 //GetScannedBlockHeader 获取当前扫描的区块头
@@ -682,19 +734,21 @@ func (bs *MACBlockScanner) GetBalanceByAddress(address ...string) ([]*openwallet
 	addrBalanceArr := make([]*openwallet.Balance, 0)
 	for _, a := range address {
 		acc, err := bs.wm.GetAssetBalanceAds(a)
-		if err == nil {
-			obj := &openwallet.Balance{
-				Symbol:           bs.wm.Symbol(),
-				Address:          a,
-				Balance:          acc.String(),
-				UnconfirmBalance: "0",
-				ConfirmBalance:   acc.String(),
-			}
+		if err != nil {
+			return nil, err
+		}
 
-			addrBalanceArr = append(addrBalanceArr, obj)
-			//return nil, err
+		//可用余额为已确认，总资产为余额，节点没有未确认余额
+		//锁定余额不是未确认的资金，通过GetAssetBalanceAds的LockedBalance获取
+		obj := &openwallet.Balance{
+			Symbol:           bs.wm.Symbol(),
+			Address:          a,
+			Balance:          acc.AllAsset.String(),
+			UnconfirmBalance: "0",
+			ConfirmBalance:   acc.AssetBalance.String(),
 		}
 
+		addrBalanceArr = append(addrBalanceArr, obj)
 	}
 
 	return addrBalanceArr, nil
@@ -17,10 +17,15 @@ package macblock
 
 import (
 	"errors"
+	"fmt"
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"time"
 )
 
 const (
 	blockchainBucket  = "blockchain" // blockchain dataset
+	pruneInterval     = 100          // prune local blocks every N heights
 )
 
 //SaveLocalBlockHead 记录区块高度和hash到本地
@@ -52,21 +57,37 @@ func (bs *MACBlockScanner) GetLocalNewBlock() (uint64, string) {
 
 //SaveLocalBlock 记录本地新区块
 func (bs *MACBlockScanner) SaveLocalBlock(blockHeader *Block) error {
+	return bs.wm.blockChainDB.Save(blockHeader)
+}
+
+//GetLocalBlock 获取本地区块数据
+func (bs *MACBlockScanner) GetLocalBlock(height uint64) (*Block, error) {
 
+	var (
+		blockHeader Block
+	)
 
-	bs.wm.blockChainDB.Save(blockHeader)
+	err := bs.wm.blockChainDB.One("Height", height, &blockHeader)
+	if err != nil {
+		return nil, err
+	}
 
-	return nil
+	return &blockHeader, nil
 }
 
-//GetLocalBlock 获取本地区块数据
-func (bs *MACBlockScanner) GetLocalBlock(height uint64) (*Block, error) {
+//DeleteLocalBlock 删除本地区块数据
+func (bs *MACBlockScanner) DeleteLocalBlock(height uint64) error {
+	return bs.wm.blockChainDB.DeleteStruct(&Block{Height: height})
+}
+
+//GetLocalBlockByHash 通过hash获取本地区块数据
+func (bs *MACBlockScanner) GetLocalBlockByHash(hash string) (*Block, error) {
 
 	var (
 		blockHeader Block
 	)
 
-	err := bs.wm.blockChainDB.One("BlockNumber", height, &blockHeader)
+	err := bs.wm.blockChainDB.One("Hash", hash, &blockHeader)
 	if err != nil {
 		return nil, err
 	}
@@ -74,6 +95,79 @@ func (bs *MACBlockScanner) GetLocalBlock(height uint64) (*Block, error) {
 	return &blockHeader, nil
 }
 
+//GetLocalBlocks 获取高度范围内的本地区块数据，包含start和end，按高度排列
+func (bs *MACBlockScanner) GetLocalBlocks(start, end uint64) ([]*Block, error) {
+
+	var list []*Block
+	err := bs.wm.blockChainDB.Select(q.Gte("Height", start), q.Lte("Height", end)).OrderBy("Height").Find(&list)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	if list == nil {
+		list = make([]*Block, 0)
+	}
+	return list, nil
+}
+
+//PruneLocalBlocks 只保留最近retention个高度的本地区块，返回删除数量
+func (bs *MACBlockScanner) PruneLocalBlocks(currentHeight, retention uint64) (int, error) {
+
+	if retention == 0 || currentHeight < retention {
+		return 0, nil
+	}
+
+	//超出保留范围的区块不会再回滚，提取记录一起清理
+	if err := bs.pruneExtractedTransactions(currentHeight - retention); err != nil {
+		return 0, err
+	}
+
+	var list []*Block
+	err := bs.wm.blockChainDB.Select(q.Lte("Height", currentHeight-retention)).Find(&list)
+	if err != nil {
+		if err == storm.ErrNotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	for _, b := range list {
+		if err := bs.wm.blockChainDB.DeleteStruct(b); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(list), nil
+}
+
+//VerifyLocalBlocks 校验本地区块是否连续并组成hash链，返回区块数
+func (bs *MACBlockScanner) VerifyLocalBlocks() (int, error) {
+
+	var (
+		count int
+		prev  *Block
+	)
+
+	err := bs.wm.blockChainDB.Select().OrderBy("Height").Each(new(Block), func(record interface{}) error {
+		b := record.(*Block)
+		if prev != nil {
+			if b.Height != prev.Height+1 {
+				return fmt.Errorf("local block height: %d is missing", prev.Height+1)
+			}
+			if b.Previousblockhash != prev.Hash {
+				return fmt.Errorf("local block height: %d previous hash: %s does not match block height: %d hash: %s", b.Height, b.Previousblockhash, prev.Height, prev.Hash)
+			}
+		}
+		count++
+		prev = b
+		return nil
+	})
+	if err != nil && err != storm.ErrNotFound {
+		return count, err
+	}
+
+	return count, nil
+}
+
 
 //获取未扫记录
 func (bs *MACBlockScanner) GetUnscanRecords() ([]*UnscanRecord, error) {
@@ -93,7 +187,23 @@ func (bs *MACBlockScanner) SaveUnscanRecord(record *UnscanRecord) error {
 		return errors.New("the unscan record to save is nil")
 	}
 
-	////获取本地区块高度
+	bs.unscanMu.Lock()
+	defer bs.unscanMu.Unlock()
+
+	//已有记录只更新失败原因，失败次数由重扫累计
+	var exist UnscanRecord
+	now := time.Now().Unix()
+	if err := bs.wm.blockChainDB.One("ID", record.ID, &exist); err == nil {
+		exist.Reason = record.Reason
+		exist.Confirmed = exist.Confirmed || record.Confirmed
+		exist.LastFailAt = now
+		return bs.wm.blockChainDB.Save(&exist)
+	}
+
+	record.Attempts = 1
+	record.FirstFailAt = now
+	record.LastFailAt = now
+	record.NextRetryAt = now + int64(bs.rescanBackoff(record.Attempts)/time.Second)
 
 	return bs.wm.blockChainDB.Save(record)
 }
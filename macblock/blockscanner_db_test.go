@@ -0,0 +1,110 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"fmt"
+	"github.com/blocktree/openwallet/openwallet"
+	"testing"
+)
+
+func TestMACBlockScanner_LocalBlocks(t *testing.T) {
+
+	wm, cleanup := testNewOfflineWalletManager(t, nil)
+	defer cleanup()
+
+	bs := wm.Blockscanner.(*MACBlockScanner)
+
+	for height := uint64(1); height <= 10; height++ {
+		err := bs.SaveLocalBlock(&Block{Height: height, Hash: fmt.Sprintf("a%d", height), Previousblockhash: fmt.Sprintf("a%d", height-1)})
+		if err != nil {
+			t.Fatalf("SaveLocalBlock unexpected error: %v", err)
+		}
+	}
+
+	block, err := bs.GetLocalBlockByHash("a6")
+	if err != nil {
+		t.Fatalf("GetLocalBlockByHash unexpected error: %v", err)
+	}
+	if block.Height != 6 {
+		t.Errorf("block height = %d, want 6", block.Height)
+	}
+	if _, err := bs.GetLocalBlockByHash("b6"); err == nil {
+		t.Errorf("GetLocalBlockByHash unknown hash should fail")
+	}
+
+	blocks, err := bs.GetLocalBlocks(3, 5)
+	if err != nil {
+		t.Fatalf("GetLocalBlocks unexpected error: %v", err)
+	}
+	heights := make([]uint64, 0)
+	for _, b := range blocks {
+		heights = append(heights, b.Height)
+	}
+	if fmt.Sprint(heights) != "[3 4 5]" {
+		t.Errorf("local blocks = %v, want [3 4 5]", heights)
+	}
+
+	for _, height := range []uint64{6, 7} {
+		bs.publishOutboxWith(extractedRecords(height, fmt.Sprintf("a%d", height), map[string]*openwallet.TxExtractData{
+			"user": {Transaction: &openwallet.Transaction{TxID: fmt.Sprintf("0x%d", height)}},
+		}, false))
+	}
+
+	count, err := bs.VerifyLocalBlocks()
+	if err != nil || count != 10 {
+		t.Errorf("VerifyLocalBlocks = %d, %v; want 10, nil", count, err)
+	}
+
+	//只保留最近4个高度
+	pruned, err := bs.PruneLocalBlocks(10, 4)
+	if err != nil {
+		t.Fatalf("PruneLocalBlocks unexpected error: %v", err)
+	}
+	if pruned != 6 {
+		t.Errorf("pruned = %d, want 6", pruned)
+	}
+	if _, err := bs.GetLocalBlock(6); err == nil {
+		t.Errorf("pruned block 6 still exists")
+	}
+	if _, err := bs.GetLocalBlockByHash("a7"); err != nil {
+		t.Errorf("block 7 should be kept: %v", err)
+	}
+	if list, _ := bs.GetExtractedTransactions(&ExtractedTransactionQuery{SourceKey: "user"}); len(list) != 1 || list[0].BlockHeight != 7 {
+		t.Errorf("extracted transactions after prune = %+v, want height 7 only", list)
+	}
+	if pruned, _ := bs.PruneLocalBlocks(10, 0); pruned != 0 {
+		t.Errorf("retention 0 pruned = %d, want 0", pruned)
+	}
+
+	count, err = bs.VerifyLocalBlocks()
+	if err != nil || count != 4 {
+		t.Errorf("VerifyLocalBlocks after prune = %d, %v; want 4, nil", count, err)
+	}
+
+	//hash链断开
+	bs.SaveLocalBlock(&Block{Height: 9, Hash: "b9", Previousblockhash: "b8"})
+	if _, err := bs.VerifyLocalBlocks(); err == nil {
+		t.Errorf("VerifyLocalBlocks with broken hash chain should fail")
+	}
+
+	//高度不连续
+	bs.SaveLocalBlock(&Block{Height: 9, Hash: "a9", Previousblockhash: "a8"})
+	bs.DeleteLocalBlock(8)
+	if _, err := bs.VerifyLocalBlocks(); err == nil {
+		t.Errorf("VerifyLocalBlocks with missing height should fail")
+	}
+}
@@ -17,6 +17,7 @@ package macblock
 
 import (
 	"github.com/blocktree/openwallet/log"
+	"net/url"
 	"testing"
 )
 
@@ -37,3 +38,36 @@ func TestMACBlockScanner_GetBalanceByAddress(t *testing.T) {
 		log.Infof("ConfirmBalance[%s] = %s", b.Address, b.ConfirmBalance)
 	}
 }
+
+func TestMACBlockScanner_GetBalanceByAddress_Offline(t *testing.T) {
+
+	wm, cleanup := testNewOfflineWalletManager(t, map[string]testNodeAction{
+		"GetAssetBalanceAds": func(form url.Values) string {
+			if form.Get("tokenaddress") == "MACbad" {
+				return `{"errCode": 1, "Msg": "address error", "AllAsset": "", "AssetBalance": "", "LockedBalance": "", "Assetpaifa": null}`
+			}
+			return `{"errCode": 0, "AllAsset": "12.5", "AssetBalance": "10", "LockedBalance": "2.5", "Assetpaifa": "1"}`
+		},
+	})
+	defer cleanup()
+
+	balances, err := wm.Blockscanner.GetBalanceByAddress("MACgood")
+	if err != nil {
+		t.Fatalf("GetBalanceByAddress unexpected error: %v", err)
+	}
+	b := balances[0]
+	if b.Balance != "12.5" || b.ConfirmBalance != "10" || b.UnconfirmBalance != "0" {
+		t.Errorf("GetBalanceByAddress = %+v", b)
+	}
+
+	//锁定余额单独返回
+	acc, err := wm.GetAssetBalanceAds("MACgood")
+	if err != nil || acc.LockedBalance.String() != "2.5" {
+		t.Errorf("GetAssetBalanceAds = %+v, %v; want locked 2.5", acc, err)
+	}
+
+	_, err = wm.Blockscanner.GetBalanceByAddress("MACgood", "MACbad")
+	if err == nil {
+		t.Errorf("GetBalanceByAddress should return the node error")
+	}
+}
@@ -6,12 +6,18 @@ import (
 	"github.com/blocktree/openwallet/log"
 	"github.com/imroc/req"
 	"github.com/tidwall/gjson"
+	"sync"
+	"time"
 )
 
 type Client struct {
 	BaseURL string
 	Debug   bool
 	Client  *req.Req
+
+	limitMu  sync.Mutex    //限速锁
+	interval time.Duration //两次请求的最小间隔，为0时不限速
+	next     time.Time     //下次允许请求的时间
 }
 
 func NewClient(url string, debug bool) *Client {
@@ -21,11 +27,42 @@ func NewClient(url string, debug bool) *Client {
 	}
 
 	api := req.New()
+	//提前创建http.Client，req首次请求时才创建，并发调用会产生竞争
+	api.Client()
 	c.Client = api
 
 	return &c
 }
 
+//SetRateLimit 设置每秒最多请求数，为0时不限速
+func (c *Client) SetRateLimit(requestsPerSecond float64) {
+	c.limitMu.Lock()
+	defer c.limitMu.Unlock()
+	if requestsPerSecond <= 0 {
+		c.interval = 0
+		return
+	}
+	c.interval = time.Duration(float64(time.Second) / requestsPerSecond)
+}
+
+//wait 等待到允许请求的时间
+func (c *Client) wait() {
+	c.limitMu.Lock()
+	if c.interval == 0 {
+		c.limitMu.Unlock()
+		return
+	}
+	now := time.Now()
+	if c.next.Before(now) {
+		c.next = now
+	}
+	delay := c.next.Sub(now)
+	c.next = c.next.Add(c.interval)
+	c.limitMu.Unlock()
+
+	time.Sleep(delay)
+}
+
 // Call calls a remote procedure on another node, specified by the path.
 func (c *Client) Call(param req.Param) (*gjson.Result, error) {
 
@@ -33,6 +70,8 @@ func (c *Client) Call(param req.Param) (*gjson.Result, error) {
 		return nil, errors.New("API url is not setup. ")
 	}
 
+	c.wait()
+
 	if c.Debug {
 		log.Std.Info("Start Request API...")
 	}
@@ -0,0 +1,273 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"fmt"
+	"github.com/astaxie/beego/config"
+	"gopkg.in/urfave/cli.v1"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	//unscanConfFlag 配置文件路径
+	unscanConfFlag = cli.StringFlag{
+		Name:  "conf, c",
+		Usage: "path of the MAT.ini config file",
+		Value: filepath.Join("conf", "MAT.ini"),
+	}
+
+	//unscan查询条件
+	unscanFilterFlags = []cli.Flag{
+		cli.Uint64Flag{Name: "from", Usage: "minimum block height"},
+		cli.Uint64Flag{Name: "to", Usage: "maximum block height"},
+		cli.StringFlag{Name: "txid", Usage: "transaction id"},
+		cli.StringFlag{Name: "observer", Usage: "name of the observer that failed"},
+		cli.StringFlag{Name: "reason", Usage: "keyword of the failure reason"},
+	}
+
+	//CmdUnscan 查看和处理扫描失败的记录
+	CmdUnscan = cli.Command{
+		Name:     "unscan",
+		Usage:    "Inspect and replay failed block scans",
+		Category: "SCANNER COMMANDS",
+		Description: `
+Inspect, retry, replay, purge and export the unscan and dead letter records
+in blockchain.db. The database can only be opened by one process, stop the
+block scanner before running these commands.
+
+`,
+		Subcommands: []cli.Command{
+			{
+				//查询记录
+				Name:   "list",
+				Usage:  "List unscan or dead letter records",
+				Action: unscanList,
+				Flags: append([]cli.Flag{
+					unscanConfFlag,
+					cli.BoolFlag{Name: "dead", Usage: "list dead letter records"},
+				}, unscanFilterFlags...),
+			},
+			{
+				//放回重扫队列
+				Name:      "retry",
+				Usage:     "Requeue a block height or transaction for the next rescan of the running scanner",
+				ArgsUsage: "--height <height> | --txid <txid>",
+				Action:    unscanRetry,
+				Flags: []cli.Flag{
+					unscanConfFlag,
+					cli.Uint64Flag{Name: "height", Usage: "block height to rescan"},
+					cli.StringFlag{Name: "txid", Usage: "transaction id to rescan"},
+				},
+			},
+			{
+				//重放死信
+				Name:   "replay",
+				Usage:  "Move dead letter records back to the rescan queue",
+				Action: unscanReplay,
+				Flags: []cli.Flag{
+					unscanConfFlag,
+					cli.StringFlag{Name: "id", Usage: "record id, replay all when empty"},
+				},
+			},
+			{
+				//删除记录
+				Name:   "purge",
+				Usage:  "Delete unscan or dead letter records",
+				Action: unscanPurge,
+				Flags: append([]cli.Flag{
+					unscanConfFlag,
+					cli.BoolFlag{Name: "dead", Usage: "purge dead letter records"},
+					cli.BoolFlag{Name: "all", Usage: "required to purge without any filter"},
+				}, unscanFilterFlags...),
+			},
+			{
+				//导出记录
+				Name:   "export",
+				Usage:  "Export unscan and dead letter records as JSON",
+				Action: unscanExport,
+				Flags: append([]cli.Flag{
+					unscanConfFlag,
+					cli.StringFlag{Name: "output, o", Usage: "output file, stdout when empty"},
+				}, unscanFilterFlags...),
+			},
+		},
+	}
+)
+
+//unscanScanner 根据配置文件打开区块扫描器
+func unscanScanner(c *cli.Context) (*MACBlockScanner, error) {
+
+	conf, err := config.NewConfig("ini", c.String("conf"))
+	if err != nil {
+		return nil, err
+	}
+
+	wm := NewWalletManager()
+	if err := wm.LoadAssetsConfig(conf); err != nil {
+		return nil, err
+	}
+
+	return wm.Blockscanner.(*MACBlockScanner), nil
+}
+
+//unscanQuery 读取查询条件
+func unscanQuery(c *cli.Context) UnscanRecordQuery {
+	return UnscanRecordQuery{
+		FromHeight: c.Uint64("from"),
+		ToHeight:   c.Uint64("to"),
+		TxID:       c.String("txid"),
+		Observer:   c.String("observer"),
+		Reason:     c.String("reason"),
+	}
+}
+
+func unscanTime(unix int64) string {
+	if unix == 0 {
+		return "-"
+	}
+	return time.Unix(unix, 0).Format("2006-01-02 15:04:05")
+}
+
+func unscanList(c *cli.Context) error {
+
+	bs, err := unscanScanner(c)
+	if err != nil {
+		return err
+	}
+	defer bs.wm.blockChainDB.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	if c.Bool("dead") {
+		list, err := bs.ListDeadUnscanRecords(unscanQuery(c))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "ID\tHEIGHT\tTXID\tOBSERVER\tATTEMPTS\tFIRST FAIL\tDEAD AT\tREASON")
+		for _, r := range list {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%d\t%s\t%s\t%s\n", r.ID, r.BlockHeight, r.TxID, r.Observer, r.Attempts, unscanTime(r.FirstFailAt), unscanTime(r.DeadAt), r.Reason)
+		}
+		return nil
+	}
+
+	list, err := bs.ListUnscanRecords(unscanQuery(c))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "ID\tHEIGHT\tTXID\tOBSERVER\tATTEMPTS\tFIRST FAIL\tNEXT RETRY\tREASON")
+	for _, r := range list {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%d\t%s\t%s\t%s\n", r.ID, r.BlockHeight, r.TxID, r.Observer, r.Attempts, unscanTime(r.FirstFailAt), unscanTime(r.NextRetryAt), r.Reason)
+	}
+	return nil
+}
+
+func unscanRetry(c *cli.Context) error {
+
+	height := c.Uint64("height")
+	txID := c.String("txid")
+	if (height == 0) == (len(txID) == 0) {
+		return fmt.Errorf("one of --height or --txid is required")
+	}
+
+	bs, err := unscanScanner(c)
+	if err != nil {
+		return err
+	}
+	defer bs.wm.blockChainDB.Close()
+
+	//命令行没有注册观察者，只放回重扫队列，由扫描器重扫并通知
+	query := UnscanRecordQuery{FromHeight: height, ToHeight: height, TxID: txID}
+	count, err := bs.RequeueUnscanRecords(query)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("no unscan record matched")
+	}
+
+	fmt.Printf("%d records requeued, they will be rescanned when the scanner runs\n", count)
+	return nil
+}
+
+func unscanReplay(c *cli.Context) error {
+
+	bs, err := unscanScanner(c)
+	if err != nil {
+		return err
+	}
+	defer bs.wm.blockChainDB.Close()
+
+	if id := c.String("id"); len(id) > 0 {
+		if err := bs.ReplayDeadUnscanRecord(id); err != nil {
+			return err
+		}
+		fmt.Println("replayed 1 record")
+		return nil
+	}
+
+	count, err := bs.ReplayDeadUnscanRecords()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("replayed %d records\n", count)
+	return nil
+}
+
+func unscanPurge(c *cli.Context) error {
+
+	query := unscanQuery(c)
+	if query.IsEmpty() && !c.Bool("all") {
+		return fmt.Errorf("no filter given, use --all to purge every record")
+	}
+
+	bs, err := unscanScanner(c)
+	if err != nil {
+		return err
+	}
+	defer bs.wm.blockChainDB.Close()
+
+	count, err := bs.PurgeUnscanRecords(query, c.Bool("dead"))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("purged %d records\n", count)
+	return nil
+}
+
+func unscanExport(c *cli.Context) error {
+
+	bs, err := unscanScanner(c)
+	if err != nil {
+		return err
+	}
+	defer bs.wm.blockChainDB.Close()
+
+	if output := c.String("output"); len(output) > 0 {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return bs.ExportUnscanRecords(f, unscanQuery(c))
+	}
+
+	return bs.ExportUnscanRecords(os.Stdout, unscanQuery(c))
+}
@@ -3,14 +3,18 @@ package macblock
 import (
 	"github.com/blocktree/go-owcrypt"
 	"github.com/blocktree/openwallet/common/file"
+	"github.com/shopspring/decimal"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 const (
 	//币种
 	Symbol    = "MAT"
 	CurveType = owcrypt.ECC_CURVE_SECP256K1
+	//小数位精度
+	Decimals int32 = 8
 )
 
 
@@ -26,10 +30,56 @@ type WalletConfig struct {
 	tokenAddress string
 	// 远程服务
 	serverAPI string
+	//每秒最多请求节点次数，为0时不限速
+	RequestsPerSecond float64
+	//充值通知需要的确认数，为0时扫描到即通知
+	ConfirmationDepth uint64
+	//设置了确认数时，是否提前通知未确认的交易
+	NotifyUnconfirmed bool
+	//分叉回溯的最大区块数，超过时告警并停止扫描，为0时不限制
+	MaxReorgDepth uint64
+	//扫描时并发预取的区块数
+	PrefetchWindow int
+	//节点最新高度的缓存时间，为0时不缓存
+	BlockHeightCacheTTL time.Duration
+	//本地保留的区块头数量，为0时不清理
+	HeaderRetention uint64
+	//失败区块的最大重扫次数，超过后移入死信，为0时不限制
+	RescanMaxAttempts int
+	//失败区块首次重扫的等待时间，之后每次翻倍
+	RescanBackoff time.Duration
+	//失败区块重扫等待时间的上限
+	RescanMaxBackoff time.Duration
+	//事件连续通知观察者失败的最大次数，超过后转为未扫记录并继续投递后续事件，为0时一直重试
+	OutboxMaxAttempts int
+	//每个观察者投递队列的容量
+	ObserverQueueSize int
+	//投递队列满时的处理方式：block、dropOldest、spill
+	ObserverQueuePolicy string
+	//通知观察者失败后首次重试的等待时间，之后每次翻倍，最多1分钟
+	OutboxRetryInterval time.Duration
 	//数据目录
 	DataDir string
 	//本地数据库文件路径
 	DBPath string
+	//单笔转账金额上限，为0时不限制
+	MaxTransferAmount decimal.Decimal
+	//备注规则
+	MemoPolicy *MemoPolicy
+	//是否解析结构化备注
+	StructuredMemo bool
+	//固定地址充值模式，所有用户充值到tokenAddress，通过备注归属用户
+	MemoDeposit bool
+	//结构化备注中用于归属用户的字段，为空时使用整个备注
+	MemoDepositField string
+	//需要审批的转账金额阈值，为0时不需要审批
+	ApprovalThreshold decimal.Decimal
+	//审批通过需要的同意数
+	ApprovalRequired int
+	//审批提案有效期
+	ApprovalExpiry time.Duration
+	//提案执行中超过该时间视为执行中断，查询时恢复
+	ApprovalExecutingTimeout time.Duration
 }
 
 func NewConfig() *WalletConfig {
@@ -43,6 +93,30 @@ func NewConfig() *WalletConfig {
 	c.BlockchainFile = "blockchain.db"
 	//本地数据库文件路径
 	c.dbPath = filepath.Join("data", strings.ToLower(c.Symbol), "db")
+	//单笔转账金额上限
+	c.MaxTransferAmount = decimal.Zero
+	//备注规则，默认不限制
+	c.MemoPolicy, _ = NewMemoPolicy(0, "", nil)
+	//审批，默认不需要审批
+	c.ApprovalThreshold = decimal.Zero
+	c.ApprovalRequired = 2
+	c.ApprovalExpiry = 24 * time.Hour
+	c.ApprovalExecutingTimeout = 10 * time.Minute
+	//分叉回溯上限
+	c.MaxReorgDepth = 100
+	//区块预取
+	c.PrefetchWindow = 10
+	c.BlockHeightCacheTTL = 5 * time.Second
+	//本地区块头保留数量
+	c.HeaderRetention = 10000
+	//失败区块重扫策略
+	c.RescanMaxAttempts = 10
+	c.RescanBackoff = time.Minute
+	c.RescanMaxBackoff = time.Hour
+	//观察者投递队列
+	c.ObserverQueueSize = 1000
+	c.ObserverQueuePolicy = ObserverQueueSpill
+	c.OutboxRetryInterval = time.Second
 
 	//创建目录
 	file.MkdirAll(c.dbPath)
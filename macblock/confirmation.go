@@ -0,0 +1,209 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"fmt"
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+//PendingExtractData 等待确认的提取结果
+type PendingExtractData struct {
+	ID          string `storm:"id"` //高度_交易ID_sourceKey
+	BlockHeight uint64 `storm:"index"`
+	BlockHash   string
+	SourceKey   string
+	Data        *openwallet.TxExtractData
+}
+
+//deliverExtractData 发送提取结果，设置了确认数时先保存到待确认记录
+//已保存过的提取结果已经发送或等待确认，重扫同一区块时跳过，replay为true时是重放失败记录
+func (bs *MACBlockScanner) deliverExtractData(height uint64, blockHash string, extractData map[string]*openwallet.TxExtractData, replay bool) error {
+
+	extractData = bs.unextractedData(blockHash, extractData)
+	if len(extractData) == 0 {
+		return nil
+	}
+
+	//提取结果和通知事件在同一个事务中保存，分叉时用于回滚
+	depth := bs.wm.Config.ConfirmationDepth
+	if depth == 0 {
+		return bs.publishOutboxWith(extractedRecords(height, blockHash, extractData, false), extractEvents(height, extractData, nil, replay)...)
+	}
+
+	//没有提前通知时，确认前分叉的交易不需要通知回滚
+	records := extractedRecords(height, blockHash, extractData, !bs.wm.Config.NotifyUnconfirmed)
+	for key, data := range extractData {
+		if data.Transaction == nil {
+			continue
+		}
+		records = append(records, &PendingExtractData{
+			ID:          fmt.Sprintf("%d_%s_%s", height, data.Transaction.TxID, key),
+			BlockHeight: height,
+			BlockHash:   blockHash,
+			SourceKey:   key,
+			Data:        data,
+		})
+	}
+
+	//提前通知未确认的交易，扩展参数confirmed为false
+	var events []*OutboxEvent
+	if bs.wm.Config.NotifyUnconfirmed {
+		events = extractEvents(height, bs.notifiedExtractData(extractData), nil, replay)
+	}
+
+	return bs.publishOutboxWith(records, events...)
+}
+
+//notifiedExtractData 扫描时直接通知观察者的提取结果，设置了确认数时标记为未确认
+func (bs *MACBlockScanner) notifiedExtractData(extractData map[string]*openwallet.TxExtractData) map[string]*openwallet.TxExtractData {
+
+	if bs.wm.Config.ConfirmationDepth == 0 {
+		return extractData
+	}
+
+	unconfirmed := make(map[string]*openwallet.TxExtractData, len(extractData))
+	for key, data := range extractData {
+		unconfirmed[key] = markConfirmations(data, 1, false)
+	}
+	return unconfirmed
+}
+
+//replayExtractData 重新通知失败的观察者，按失败时的确认状态通知
+func (bs *MACBlockScanner) replayExtractData(height uint64, extractData map[string]*openwallet.TxExtractData, observers []string, confirmed bool) error {
+
+	if bs.wm.Config.ConfirmationDepth == 0 {
+		return bs.newExtractDataNotify(height, extractData, observers, true)
+	}
+
+	if !confirmed {
+		return bs.newExtractDataNotify(height, bs.notifiedExtractData(extractData), observers, true)
+	}
+
+	confirmations := bs.wm.Config.ConfirmationDepth
+	if localHeight, _ := bs.GetLocalNewBlock(); localHeight >= height+confirmations {
+		confirmations = localHeight - height + 1
+	}
+
+	marked := make(map[string]*openwallet.TxExtractData, len(extractData))
+	for key, data := range extractData {
+		marked[key] = markConfirmations(data, confirmations, true)
+	}
+	return bs.newExtractDataNotify(height, marked, observers, true)
+}
+
+//extractDataConfirmed 提取结果是否已确认，没有确认数扩展参数的是直接通知的已确认交易
+func extractDataConfirmed(data *openwallet.TxExtractData) bool {
+	if data == nil || data.Transaction == nil {
+		return true
+	}
+	confirmed := data.Transaction.GetExtParam().Get("confirmed")
+	return !confirmed.Exists() || confirmed.Bool()
+}
+
+//ReleasePendingExtractData 通知已达到确认数的提取结果
+//发送前检查区块hash，区块已被分叉的记录直接删除，达到确认数的记录保存到事件箱后删除
+func (bs *MACBlockScanner) ReleasePendingExtractData(currentHeight uint64) error {
+
+	depth := bs.wm.Config.ConfirmationDepth
+	if depth == 0 || currentHeight+1 < depth {
+		return nil
+	}
+	maxHeight := currentHeight + 1 - depth
+
+	hashes := make(map[uint64]string)
+	blockHash := func(height uint64) (string, error) {
+		if hash, ok := hashes[height]; ok {
+			return hash, nil
+		}
+		block, err := bs.wm.GetTransactionRecordHight(height)
+		if err != nil {
+			return "", err
+		}
+		hashes[height] = block.Hash
+		return block.Hash, nil
+	}
+
+	var list []*PendingExtractData
+	err := bs.wm.blockChainDB.Select(q.Lte("BlockHeight", maxHeight)).OrderBy("BlockHeight").Find(&list)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+
+	for _, pending := range list {
+
+		hash, err := blockHash(pending.BlockHeight)
+		if err != nil {
+			return err
+		}
+
+		if hash != pending.BlockHash {
+			bs.wm.Log.Std.Warning("pending transaction: %s was in forked block: %s on height: %d, dropped", pending.Data.Transaction.TxID, pending.BlockHash, pending.BlockHeight)
+			bs.wm.blockChainDB.DeleteStruct(pending)
+			continue
+		}
+
+		confirmations := currentHeight - pending.BlockHeight + 1
+		data := markConfirmations(pending.Data, confirmations, true)
+		err = bs.publishOutbox(pending.BlockHeight, map[string]*openwallet.TxExtractData{pending.SourceKey: data}, nil, false)
+		if err != nil {
+			bs.wm.Log.Std.Error("pending transaction: %s notify failed; unexpected error: %v", pending.Data.Transaction.TxID, err)
+			continue
+		}
+
+		if err := bs.wm.blockChainDB.DeleteStruct(pending); err != nil {
+			return err
+		}
+
+		//已通知观察者，分叉时需要通知回滚
+		bs.markExtractedNotified(pending.BlockHash, pending.Data.Transaction.TxID, pending.SourceKey)
+	}
+
+	return bs.releasePendingDeposits(maxHeight, blockHash)
+}
+
+//DeletePendingExtractData 删除指定高度及以上的待确认记录，用于分叉回滚
+func (bs *MACBlockScanner) DeletePendingExtractData(height uint64) error {
+	err := bs.wm.blockChainDB.Select(q.Gte("BlockHeight", height)).Delete(new(PendingExtractData))
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+//GetPendingExtractData 查询待确认的提取结果
+func (bs *MACBlockScanner) GetPendingExtractData() ([]*PendingExtractData, error) {
+	var list []*PendingExtractData
+	err := bs.wm.blockChainDB.Select().OrderBy("BlockHeight").Find(&list)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return list, nil
+}
+
+//markConfirmations 复制提取结果，交易单扩展参数记录确认数和是否已确认
+func markConfirmations(data *openwallet.TxExtractData, confirmations uint64, confirmed bool) *openwallet.TxExtractData {
+	marked := *data
+	if data.Transaction != nil {
+		tx := *data.Transaction
+		tx.SetExtParam("confirmations", confirmations)
+		tx.SetExtParam("confirmed", confirmed)
+		marked.Transaction = &tx
+	}
+	return &marked
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"fmt"
+	"github.com/blocktree/openwallet/openwallet"
+	"net/url"
+	"testing"
+)
+
+func TestMACBlockScanner_ConfirmationDepth(t *testing.T) {
+
+	wm, cleanup := testNewOfflineWalletManager(t, map[string]testNodeAction{
+		"GetTransactionRecordHight": func(form url.Values) string {
+			//高度11的区块已被分叉
+			hash := "hash" + form.Get("height")
+			if form.Get("height") == "11" {
+				hash = "hash11b"
+			}
+			return fmt.Sprintf(`{"errCode": 0, "blockhash": "%s", "Content": []}`, hash)
+		},
+	})
+	defer cleanup()
+
+	wm.Config.ConfirmationDepth = 3
+	wm.Config.NotifyUnconfirmed = true
+
+	receiver := "MACja4a7fbe76dBwVUBYFAWZVUWNlA"
+	bs := wm.Blockscanner.(*MACBlockScanner)
+	bs.SetBlockScanTargetFunc(func(target openwallet.ScanTarget) (string, bool) {
+		return "receiver", target.Address == receiver
+	})
+
+	observer := &testDepositObserver{extracted: make(map[string][]*openwallet.TxExtractData)}
+	bs.AddObserver(observer)
+
+	for height := uint64(10); height <= 11; height++ {
+		txs := []*Transaction{
+			{TxID: fmt.Sprintf("0x%d", height), FromToken: "MACx6150b0728bVdQDOAABCYFAUN1U", ToToken: receiver, Amount: "1", BlockHeight: height},
+		}
+		if err := bs.BatchExtractTransaction(height, fmt.Sprintf("hash%d", height), txs); err != nil {
+			t.Fatalf("BatchExtractTransaction unexpected error: %v", err)
+		}
+	}
+	testWaitObserverQueues(t, bs)
+
+	notified := observer.extracted["receiver"]
+	if len(notified) != 2 || notified[0].Transaction.GetExtParam().Get("confirmed").Bool() {
+		t.Fatalf("unconfirmed notifications = %d", len(notified))
+	}
+
+	pending, _ := bs.GetPendingExtractData()
+	if len(pending) != 2 {
+		t.Fatalf("pending = %d, want 2", len(pending))
+	}
+
+	bs.ReleasePendingExtractData(11)
+	testWaitObserverQueues(t, bs)
+	if len(observer.extracted["receiver"]) != 2 {
+		t.Errorf("transaction released before it has 3 confirmations")
+	}
+
+	bs.ReleasePendingExtractData(13)
+	testWaitObserverQueues(t, bs)
+	notified = observer.extracted["receiver"]
+	if len(notified) != 3 {
+		t.Fatalf("notifications = %d, want 3", len(notified))
+	}
+	confirmed := notified[2].Transaction.GetExtParam()
+	if notified[2].Transaction.TxID != "0x10" || !confirmed.Get("confirmed").Bool() || confirmed.Get("confirmations").Uint() != 4 {
+		t.Errorf("confirmed notification = %s %s", notified[2].Transaction.TxID, notified[2].Transaction.ExtParam)
+	}
+
+	pending, _ = bs.GetPendingExtractData()
+	if len(pending) != 0 {
+		t.Errorf("forked pending transaction was not dropped, pending = %d", len(pending))
+	}
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//cronSearchLimit 查找下次执行时间的最大范围，超过则认为表达式不会触发，如：2月30日
+const cronSearchLimit = 5 * 366 * 24 * time.Hour
+
+//cronField 表达式字段的取值范围
+type cronField struct {
+	name string
+	min  int
+	max  int
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 6},
+}
+
+//CronSchedule 标准5段cron表达式：分 时 日 月 周
+//支持 *、数字、列表(1,15)、范围(1-5)和步长(*/10, 0-30/5)，周日为0或7
+type CronSchedule struct {
+	Expr     string
+	minute   uint64
+	hour     uint64
+	dom      uint64
+	month    uint64
+	dow      uint64
+	anyDom   bool //日为*，只按周匹配
+	anyDow   bool //周为*，只按日匹配
+	location *time.Location
+}
+
+//ParseCron 解析cron表达式，按本地时区计算执行时间
+func ParseCron(expr string) (*CronSchedule, error) {
+
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("cron expression: '%s' should have %d fields", expr, len(cronFields))
+	}
+
+	bits := make([]uint64, len(cronFields))
+	for i, f := range cronFields {
+		max := f.max
+		if i == 4 {
+			max = 7 //允许7表示周日
+		}
+		b, err := parseCronField(fields[i], f.min, max)
+		if err != nil {
+			return nil, fmt.Errorf("cron expression: '%s' has invalid %s; %v", expr, f.name, err)
+		}
+		bits[i] = b
+	}
+
+	//7和0都表示周日
+	if bits[4]&(1<<7) != 0 {
+		bits[4] = bits[4]&^(1<<7) | 1
+	}
+
+	cron := &CronSchedule{
+		Expr:     expr,
+		minute:   bits[0],
+		hour:     bits[1],
+		dom:      bits[2],
+		month:    bits[3],
+		dow:      bits[4],
+		anyDom:   fields[2] == "*",
+		anyDow:   fields[4] == "*",
+		location: time.Local,
+	}
+	return cron, nil
+}
+
+//parseCronField 解析一个字段，返回取值的位图
+func parseCronField(field string, min, max int) (uint64, error) {
+
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+
+		var (
+			start = min
+			end   = max
+			step  = 1
+			err   error
+		)
+
+		rangePart := part
+		if i := strings.Index(part, "/"); i >= 0 {
+			rangePart = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step: '%s'", part)
+			}
+		}
+
+		switch {
+		case rangePart == "*":
+		case strings.Contains(rangePart, "-"):
+			bounds := strings.SplitN(rangePart, "-", 2)
+			if start, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid range: '%s'", part)
+			}
+			if end, err = strconv.Atoi(bounds[1]); err != nil {
+				return 0, fmt.Errorf("invalid range: '%s'", part)
+			}
+		default:
+			if start, err = strconv.Atoi(rangePart); err != nil {
+				return 0, fmt.Errorf("invalid value: '%s'", part)
+			}
+			end = start
+			//单个数字带步长，如5/10，表示从5开始到最大值
+			if strings.Contains(part, "/") {
+				end = max
+			}
+		}
+
+		if start < min || end > max || start > end {
+			return 0, fmt.Errorf("value: '%s' is out of range %d-%d", part, min, max)
+		}
+
+		for v := start; v <= end; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+//matchDay 日和周都指定时满足其一即可，与标准cron一致
+func (c *CronSchedule) matchDay(t time.Time) bool {
+	domMatch := c.dom&(1<<uint(t.Day())) != 0
+	dowMatch := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.anyDom || c.anyDow {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+//Next 返回after之后的下一次执行时间，精确到分钟，表达式不会触发时返回零值
+func (c *CronSchedule) Next(after time.Time) time.Time {
+
+	t := after.In(c.location).Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(cronSearchLimit)
+
+	for t.Before(limit) {
+
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, c.location)
+			continue
+		}
+
+		if !c.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, c.location)
+			continue
+		}
+
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, c.location)
+			continue
+		}
+
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
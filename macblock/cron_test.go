@@ -0,0 +1,63 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron_Next(t *testing.T) {
+
+	base := time.Date(2019, 7, 10, 8, 30, 0, 0, time.Local) //周三
+
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2019, 7, 10, 8, 31, 0, 0, time.Local)},
+		{"0 9 * * *", time.Date(2019, 7, 10, 9, 0, 0, 0, time.Local)},
+		{"*/20 * * * *", time.Date(2019, 7, 10, 8, 40, 0, 0, time.Local)},
+		{"0 10 * * 1", time.Date(2019, 7, 15, 10, 0, 0, 0, time.Local)},
+		{"0 10 * * 7", time.Date(2019, 7, 14, 10, 0, 0, 0, time.Local)},
+		{"0 0 1 * *", time.Date(2019, 8, 1, 0, 0, 0, 0, time.Local)},
+		{"0 0 1,15 * 5", time.Date(2019, 7, 12, 0, 0, 0, 0, time.Local)},
+		{"30 8 29 2 *", time.Date(2020, 2, 29, 8, 30, 0, 0, time.Local)},
+		{"15-45/15 8 * * 1-5", time.Date(2019, 7, 10, 8, 45, 0, 0, time.Local)},
+	}
+
+	for _, test := range tests {
+		cron, err := ParseCron(test.expr)
+		if err != nil {
+			t.Errorf("ParseCron(%s) unexpected error: %v", test.expr, err)
+			continue
+		}
+		if got := cron.Next(base); !got.Equal(test.want) {
+			t.Errorf("ParseCron(%s).Next = %s, want %s", test.expr, got, test.want)
+		}
+	}
+
+	cron, _ := ParseCron("0 0 30 2 *")
+	if got := cron.Next(base); !got.IsZero() {
+		t.Errorf("expression never fires, but Next = %s", got)
+	}
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%s) should fail", expr)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/openwallet/openwallet"
+	"strings"
+	"time"
+)
+
+//无法归属的充值原因
+const (
+	UnattributedNoMemo      = "noMemo"      //没有备注
+	UnattributedUnknownMemo = "unknownMemo" //备注找不到对应用户
+)
+
+//MemoScanTargetFunc 通过充值备注查找用户，返回sourceKey
+type MemoScanTargetFunc func(memo string) (string, bool)
+
+//UnattributedDeposit 转入固定充值地址但无法归属用户的充值
+type UnattributedDeposit struct {
+	TxID        string `storm:"id"`
+	Address     string
+	From        string
+	Amount      string
+	Memo        string
+	Reason      string
+	BlockHash   string
+	BlockHeight uint64 `storm:"index"`
+	Pending     bool //设置了确认数时等待确认，还没有通知观察者
+	CreateAt    int64
+}
+
+//UnattributedDepositObserver 可选的观察者接口，接收无法归属的充值通知
+type UnattributedDepositObserver interface {
+	UnattributedDepositNotify(deposit *UnattributedDeposit) error
+}
+
+//UnattributedDepositForkObserver 可选的观察者接口，区块被分叉时接收需要回滚的已通知的无法归属充值
+type UnattributedDepositForkObserver interface {
+	UnattributedDepositForkNotify(header *openwallet.BlockHeader, reversed []*UnattributedDeposit) error
+}
+
+//SetMemoScanTargetFunc 设置通过备注查找用户的方法
+//未设置时使用ScanTargetFunc，以备注作为账户查找：ScanTarget{Address: memo, Alias: memo, BalanceModelType: BalanceModelTypeAccount}
+func (bs *MACBlockScanner) SetMemoScanTargetFunc(memoScanTargetFunc MemoScanTargetFunc) {
+	bs.memoScanTargetFunc = memoScanTargetFunc
+}
+
+//isMemoDeposit 是否转入固定充值地址
+func (bs *MACBlockScanner) isMemoDeposit(to string) bool {
+	return bs.wm.Config.MemoDeposit && len(bs.wm.Config.tokenAddress) > 0 && to == bs.wm.Config.tokenAddress
+}
+
+//depositMemoKey 充值备注中用于查找用户的值，配置了memoDepositField时取结构化备注的字段
+func (bs *MACBlockScanner) depositMemoKey(note string) string {
+	field := bs.wm.Config.MemoDepositField
+	if len(field) > 0 {
+		memo, err := ParseMemo(note)
+		if err != nil || memo.Format == MemoFormatText {
+			return ""
+		}
+		return strings.TrimSpace(memo.Field(field))
+	}
+	return strings.TrimSpace(note)
+}
+
+//lookupDepositMemo 通过备注查找充值用户，找不到时返回原因
+func (bs *MACBlockScanner) lookupDepositMemo(note string, scanTargetFunc openwallet.BlockScanTargetFunc) (string, string) {
+
+	key := bs.depositMemoKey(note)
+	if len(key) == 0 {
+		return "", UnattributedNoMemo
+	}
+
+	var (
+		sourceKey string
+		ok        bool
+	)
+
+	if bs.memoScanTargetFunc != nil {
+		sourceKey, ok = bs.memoScanTargetFunc(key)
+	} else {
+		sourceKey, ok = scanTargetFunc(openwallet.ScanTarget{
+			Address:          key,
+			Alias:            key,
+			Symbol:           bs.wm.Symbol(),
+			BalanceModelType: openwallet.BalanceModelTypeAccount,
+		})
+	}
+	if !ok {
+		return "", UnattributedUnknownMemo
+	}
+
+	return sourceKey, ""
+}
+
+//newUnattributedDeposit 无法归属的充值记录
+func newUnattributedDeposit(trx *Transaction, reason string) *UnattributedDeposit {
+	return &UnattributedDeposit{
+		TxID:        trx.TxID,
+		Address:     trx.ToToken,
+		From:        trx.FromToken,
+		Amount:      trx.Amount,
+		Memo:        trx.Note,
+		Reason:      reason,
+		BlockHash:   trx.BlockHash,
+		BlockHeight: trx.BlockHeight,
+		CreateAt:    time.Now().Unix(),
+	}
+}
+
+//deliverUnattributedDeposit 保存无法归属的充值，通过事件箱通知实现了UnattributedDepositObserver的观察者
+//同一区块已保存过的充值不重复通知，设置了确认数时先保存为待确认，达到确认数后再通知
+func (bs *MACBlockScanner) deliverUnattributedDeposit(height uint64, blockHash string, deposit *UnattributedDeposit) error {
+
+	deposit.BlockHeight = height
+	deposit.BlockHash = blockHash
+
+	var exist UnattributedDeposit
+	if err := bs.wm.blockChainDB.One("TxID", deposit.TxID, &exist); err == nil && exist.BlockHash == blockHash {
+		bs.wm.Log.Std.Info("deposit: %s was saved from block: %s, skipped", deposit.TxID, blockHash)
+		return nil
+	}
+
+	bs.wm.Log.Std.Warning("deposit: %s to %s with memo: '%s' can not be attributed, reason: %s", deposit.TxID, deposit.Address, deposit.Memo, deposit.Reason)
+
+	if bs.wm.Config.ConfirmationDepth > 0 {
+		deposit.Pending = true
+		return bs.wm.blockChainDB.Save(deposit)
+	}
+
+	//充值记录和通知事件在同一个事务中保存
+	return bs.publishOutboxWith([]interface{}{deposit}, unattributedEvent(deposit))
+}
+
+//unattributedEvent 无法归属的充值的通知事件
+func unattributedEvent(deposit *UnattributedDeposit) *OutboxEvent {
+	return &OutboxEvent{
+		Kind:         OutboxEventUnattributed,
+		BlockHeight:  deposit.BlockHeight,
+		TxID:         deposit.TxID,
+		Unattributed: deposit,
+	}
+}
+
+//releasePendingDeposits 通知已达到确认数的无法归属充值，区块已被分叉的直接删除
+//@param blockHash 查询节点上指定高度的区块hash
+func (bs *MACBlockScanner) releasePendingDeposits(maxHeight uint64, blockHash func(height uint64) (string, error)) error {
+
+	var list []*UnattributedDeposit
+	err := bs.wm.blockChainDB.Select(q.Eq("Pending", true), q.Lte("BlockHeight", maxHeight)).OrderBy("BlockHeight").Find(&list)
+	if err != nil {
+		if err == storm.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+
+	for _, deposit := range list {
+
+		hash, err := blockHash(deposit.BlockHeight)
+		if err != nil {
+			return err
+		}
+
+		if hash != deposit.BlockHash {
+			bs.wm.Log.Std.Warning("pending deposit: %s was in forked block: %s on height: %d, dropped", deposit.TxID, deposit.BlockHash, deposit.BlockHeight)
+			if err := bs.wm.blockChainDB.DeleteStruct(deposit); err != nil {
+				return err
+			}
+			continue
+		}
+
+		deposit.Pending = false
+		if err := bs.publishOutboxWith([]interface{}{deposit}, unattributedEvent(deposit)); err != nil {
+			bs.wm.Log.Std.Error("pending deposit: %s notify failed; unexpected error: %v", deposit.TxID, err)
+		}
+	}
+
+	return nil
+}
+
+//GetUnattributedDeposits 查询无法归属的充值
+func (bs *MACBlockScanner) GetUnattributedDeposits() ([]*UnattributedDeposit, error) {
+	var list []*UnattributedDeposit
+	err := bs.wm.blockChainDB.All(&list)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return list, nil
+}
+
+//DeleteUnattributedDeposit 人工处理后删除记录
+func (bs *MACBlockScanner) DeleteUnattributedDeposit(txid string) error {
+	return bs.wm.blockChainDB.DeleteStruct(&UnattributedDeposit{TxID: txid})
+}
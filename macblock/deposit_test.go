@@ -0,0 +1,290 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"fmt"
+	"github.com/blocktree/openwallet/openwallet"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+//testDepositObserver 记录充值通知
+type testDepositObserver struct {
+	mu           sync.Mutex
+	extracted    map[string][]*openwallet.TxExtractData
+	unattributed []*UnattributedDeposit
+	reversed     map[uint64][]*UnattributedDeposit
+	failures     int //无法归属的充值通知前几次失败
+}
+
+func (o *testDepositObserver) BlockScanNotify(header *openwallet.BlockHeader) error {
+	return nil
+}
+
+func (o *testDepositObserver) BlockExtractDataNotify(sourceKey string, data *openwallet.TxExtractData) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.extracted[sourceKey] = append(o.extracted[sourceKey], data)
+	return nil
+}
+
+func (o *testDepositObserver) UnattributedDepositNotify(deposit *UnattributedDeposit) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.failures > 0 {
+		o.failures--
+		return fmt.Errorf("observer is busy")
+	}
+	o.unattributed = append(o.unattributed, deposit)
+	return nil
+}
+
+func (o *testDepositObserver) UnattributedDepositForkNotify(header *openwallet.BlockHeader, reversed []*UnattributedDeposit) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.reversed[header.Height] = reversed
+	return nil
+}
+
+//newTestUnattributedScanner 所有充值都无法归属的扫描器，节点在高度8之后是另一条链
+func newTestUnattributedScanner(t *testing.T) (*WalletManager, *MACBlockScanner, *testDepositObserver, func()) {
+
+	wm, cleanup := testNewOfflineWalletManager(t, map[string]testNodeAction{
+		"GetTransactionRecordHight": func(form url.Values) string {
+			height, _ := strconv.Atoi(form.Get("height"))
+			prefix := "a"
+			if height > 8 {
+				prefix = "b"
+			}
+			return fmt.Sprintf(`{"errCode": 0, "blockhash": "%s%d", "Content": []}`, prefix, height)
+		},
+	})
+
+	wm.Config.tokenAddress = "MACcbc6a02cab9F8ACJYVUJIQBAUlV"
+	wm.Config.MemoDeposit = true
+
+	bs := wm.Blockscanner.(*MACBlockScanner)
+	bs.SetBlockScanTargetFunc(func(target openwallet.ScanTarget) (string, bool) {
+		return "", false
+	})
+
+	observer := &testDepositObserver{
+		extracted: make(map[string][]*openwallet.TxExtractData),
+		reversed:  make(map[uint64][]*UnattributedDeposit),
+	}
+	bs.AddObserver(observer)
+
+	return wm, bs, observer, cleanup
+}
+
+//testScanUnattributed 扫描高度8到10的区块，每个区块一笔没有备注的充值
+func testScanUnattributed(t *testing.T, wm *WalletManager, bs *MACBlockScanner, times int) {
+	for height := uint64(8); height <= 10; height++ {
+		hash := fmt.Sprintf("a%d", height)
+		txs := []*Transaction{
+			{TxID: fmt.Sprintf("0x%d", height), FromToken: "MACja4a7fbe76dBwVUBYFAWZVUWNlA", ToToken: wm.Config.tokenAddress, Amount: "1", BlockHeight: height, BlockHash: hash},
+		}
+		for i := 0; i < times; i++ {
+			if err := bs.BatchExtractTransaction(height, hash, txs); err != nil {
+				t.Fatalf("BatchExtractTransaction unexpected error: %v", err)
+			}
+		}
+		bs.SaveLocalBlock(&Block{Height: height, Hash: hash})
+	}
+	testWaitObserverQueues(t, bs)
+}
+
+func TestMACBlockScanner_MemoDeposit(t *testing.T) {
+
+	wm, cleanup := testNewOfflineWalletManager(t, nil)
+	defer cleanup()
+
+	tokenAddress := "MACcbc6a02cab9F8ACJYVUJIQBAUlV"
+	wm.Config.tokenAddress = tokenAddress
+	wm.Config.MemoDeposit = true
+
+	bs := wm.Blockscanner.(*MACBlockScanner)
+	bs.SetBlockScanTargetFunc(func(target openwallet.ScanTarget) (string, bool) {
+		if target.BalanceModelType == openwallet.BalanceModelTypeAccount && target.Alias == "1001" {
+			return "user1001", true
+		}
+		return "", false
+	})
+
+	observer := &testDepositObserver{extracted: make(map[string][]*openwallet.TxExtractData)}
+	bs.AddObserver(observer)
+
+	from := "MACja4a7fbe76dBwVUBYFAWZVUWNlA"
+	txs := []*Transaction{
+		{TxID: "0x1", FromToken: from, ToToken: tokenAddress, Amount: "1", Note: "1001", BlockHeight: 10},
+		{TxID: "0x2", FromToken: from, ToToken: tokenAddress, Amount: "2", Note: "", BlockHeight: 10},
+		{TxID: "0x3", FromToken: from, ToToken: tokenAddress, Amount: "3", Note: "9999", BlockHeight: 10},
+		{TxID: "0x4", FromToken: from, ToToken: "MACx6150b0728bVdQDOAABCYFAUN1U", Amount: "4", Note: "1001", BlockHeight: 10},
+	}
+
+	if err := bs.BatchExtractTransaction(10, "hash10", txs); err != nil {
+		t.Fatalf("BatchExtractTransaction unexpected error: %v", err)
+	}
+	testWaitObserverQueues(t, bs)
+
+	deposits := observer.extracted["user1001"]
+	if len(deposits) != 1 || deposits[0].Transaction.TxID != "0x1" || deposits[0].TxOutputs[0].Address != tokenAddress {
+		t.Errorf("attributed deposits = %+v", deposits)
+	}
+
+	reasons := make(map[string]string)
+	for _, d := range observer.unattributed {
+		reasons[d.TxID] = d.Reason
+	}
+	if len(reasons) != 2 || reasons["0x2"] != UnattributedNoMemo || reasons["0x3"] != UnattributedUnknownMemo {
+		t.Errorf("unattributed deposits = %v", reasons)
+	}
+
+	saved, _ := bs.GetUnattributedDeposits()
+	if len(saved) != 2 {
+		t.Errorf("GetUnattributedDeposits = %d, want 2", len(saved))
+	}
+
+	//结构化备注按字段归属
+	wm.Config.MemoDepositField = "uid"
+	bs.SetMemoScanTargetFunc(func(memo string) (string, bool) {
+		return "user" + memo, memo == "1001"
+	})
+	observer.extracted = make(map[string][]*openwallet.TxExtractData)
+
+	txs = []*Transaction{
+		{TxID: "0x5", FromToken: from, ToToken: tokenAddress, Amount: "5", Note: `{"uid":"1001"}`, BlockHeight: 11},
+	}
+	if err := bs.BatchExtractTransaction(11, "hash11", txs); err != nil {
+		t.Fatalf("BatchExtractTransaction unexpected error: %v", err)
+	}
+	testWaitObserverQueues(t, bs)
+	if len(observer.extracted["user1001"]) != 1 {
+		t.Errorf("structured memo deposit was not attributed: %v", observer.extracted)
+	}
+}
+
+func TestMACBlockScanner_UnattributedDepositOutbox(t *testing.T) {
+
+	wm, cleanup := testNewOfflineWalletManager(t, nil)
+	defer cleanup()
+
+	tokenAddress := "MACcbc6a02cab9F8ACJYVUJIQBAUlV"
+	wm.Config.tokenAddress = tokenAddress
+	wm.Config.MemoDeposit = true
+
+	bs := wm.Blockscanner.(*MACBlockScanner)
+	bs.SetBlockScanTargetFunc(func(target openwallet.ScanTarget) (string, bool) {
+		return "", false
+	})
+
+	//通知失败不影响扫描，由投递线程重试
+	observer := &testDepositObserver{extracted: make(map[string][]*openwallet.TxExtractData), failures: 2}
+	bs.AddObserver(observer)
+
+	txs := []*Transaction{
+		{TxID: "0x1", FromToken: "MACja4a7fbe76dBwVUBYFAWZVUWNlA", ToToken: tokenAddress, Amount: "1", Note: "", BlockHeight: 10},
+	}
+	if err := bs.BatchExtractTransaction(10, "hash10", txs); err != nil {
+		t.Fatalf("BatchExtractTransaction unexpected error: %v", err)
+	}
+	testWaitObserverQueues(t, bs)
+
+	observer.mu.Lock()
+	defer observer.mu.Unlock()
+	if len(observer.unattributed) != 1 || observer.unattributed[0].TxID != "0x1" || observer.failures != 0 {
+		t.Errorf("unattributed deposits = %d, failures left = %d", len(observer.unattributed), observer.failures)
+	}
+}
+
+func TestMACBlockScanner_UnattributedDepositRescan(t *testing.T) {
+
+	wm, bs, observer, cleanup := newTestUnattributedScanner(t)
+	defer cleanup()
+
+	//重扫同一区块不重复通知
+	testScanUnattributed(t, wm, bs, 2)
+
+	observer.mu.Lock()
+	defer observer.mu.Unlock()
+	if len(observer.unattributed) != 3 {
+		t.Errorf("unattributed notifications = %d, want 3", len(observer.unattributed))
+	}
+}
+
+func TestMACBlockScanner_UnattributedDepositConfirmation(t *testing.T) {
+
+	wm, bs, observer, cleanup := newTestUnattributedScanner(t)
+	defer cleanup()
+
+	wm.Config.ConfirmationDepth = 3
+	testScanUnattributed(t, wm, bs, 1)
+
+	if len(observer.unattributed) != 0 {
+		t.Fatalf("unattributed deposits notified before confirmation: %d", len(observer.unattributed))
+	}
+
+	//高度9和10的区块已被分叉，只通知高度8的充值
+	if err := bs.ReleasePendingExtractData(12); err != nil {
+		t.Fatalf("ReleasePendingExtractData unexpected error: %v", err)
+	}
+	testWaitObserverQueues(t, bs)
+
+	observer.mu.Lock()
+	notified := observer.unattributed
+	observer.mu.Unlock()
+	if len(notified) != 1 || notified[0].TxID != "0x8" || notified[0].Pending {
+		t.Errorf("released unattributed deposits = %+v", notified)
+	}
+
+	saved, _ := bs.GetUnattributedDeposits()
+	if len(saved) != 1 || saved[0].Pending {
+		t.Errorf("saved unattributed deposits = %+v", saved)
+	}
+}
+
+func TestMACBlockScanner_UnattributedDepositFork(t *testing.T) {
+
+	wm, bs, observer, cleanup := newTestUnattributedScanner(t)
+	defer cleanup()
+
+	testScanUnattributed(t, wm, bs, 1)
+
+	if _, err := bs.handleReorg(10, "a10"); err != nil {
+		t.Fatalf("handleReorg unexpected error: %v", err)
+	}
+	testWaitObserverQueues(t, bs)
+
+	observer.mu.Lock()
+	defer observer.mu.Unlock()
+	for _, height := range []uint64{9, 10} {
+		reversed := observer.reversed[height]
+		if len(reversed) != 1 || reversed[0].TxID != fmt.Sprintf("0x%d", height) {
+			t.Errorf("reversed unattributed deposits on height: %d = %+v", height, reversed)
+		}
+	}
+	if _, ok := observer.reversed[8]; ok {
+		t.Errorf("common ancestor should not be reversed")
+	}
+
+	saved, _ := bs.GetUnattributedDeposits()
+	if len(saved) != 1 || saved[0].BlockHeight != 8 {
+		t.Errorf("unattributed deposits after reorg = %+v", saved)
+	}
+}
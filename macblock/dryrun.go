@@ -0,0 +1,161 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"fmt"
+	"github.com/blocktree/openwallet/openwallet"
+	"github.com/shopspring/decimal"
+	"time"
+)
+
+//TransferPreview 转账预演结果
+type TransferPreview struct {
+	From          string   `json:"from"`
+	To            string   `json:"to"`
+	Amount        string   `json:"amount"`
+	Memo          string   `json:"memo"`
+	Sign          string   `json:"sign"`
+	BalanceBefore string   `json:"balanceBefore"` //转账前可用余额
+	BalanceAfter  string   `json:"balanceAfter"`  //转账后可用余额
+	Warnings      []string `json:"warnings"`
+	Approval      bool     `json:"approval"` //发送时需要审批
+	Error         string   `json:"error"`    //批量预演时，该笔未通过检查的原因
+}
+
+//DryRunResult 交易单扩展参数dryRun为true时，SendTransaction返回预演结果，不发送转账
+type DryRunResult struct {
+	Preview *TransferPreview
+}
+
+//Error 错误信息
+func (err *DryRunResult) Error() string {
+	return fmt.Sprintf("[%d]dry run of transfer to: %s, amount: %s, not sent", ErrDryRun, err.Preview.To, err.Preview.Amount)
+}
+
+//Code 错误码
+func (err *DryRunResult) Code() uint64 {
+	return ErrDryRun
+}
+
+//isDryRun 交易单是否只预演
+func isDryRun(rawTx *openwallet.RawTransaction) bool {
+	return rawTx.GetExtParam().Get("dryRun").Bool()
+}
+
+//DryRunTransaction 预演转账：检查金额、可用余额、策略、审批和备注，生成sign，但不调用AssetTransferMN2，不修改rawTx
+func (wm *WalletManager) DryRunTransaction(wallet *MACWallet, password string, rawTx *openwallet.RawTransaction) (*TransferPreview, error) {
+
+	available, err := wm.availableBalance(wallet.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	preview, _, err := wm.dryRunTransfer(wallet, password, rawTx, available, time.Now(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return preview, nil
+}
+
+//DryRunTransactions 批量预演同一钱包的转账，余额和策略限额按顺序累计
+//单笔未通过检查时记录在该笔的Error，不影响其它交易单的预演
+func (wm *WalletManager) DryRunTransactions(wallet *MACWallet, password string, rawTxs []*openwallet.RawTransaction) ([]*TransferPreview, error) {
+
+	available, err := wm.availableBalance(wallet.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	pending := make([]*TransferUsage, 0, len(rawTxs))
+	previews := make([]*TransferPreview, 0, len(rawTxs))
+
+	for _, rawTx := range rawTxs {
+		preview, usage, err := wm.dryRunTransfer(wallet, password, rawTx, available, now, pending)
+		if err != nil {
+			preview = &TransferPreview{
+				From:     wallet.Address,
+				Warnings: make([]string, 0),
+				Error:    err.Error(),
+			}
+		} else {
+			available, _ = decimal.NewFromString(preview.BalanceAfter)
+			pending = append(pending, usage)
+		}
+		previews = append(previews, preview)
+	}
+
+	return previews, nil
+}
+
+//dryRunTransfer 按可用余额和前面交易单的限额计数预演一笔转账，返回该笔的限额计数
+func (wm *WalletManager) dryRunTransfer(wallet *MACWallet, password string, rawTx *openwallet.RawTransaction, available decimal.Decimal, now time.Time, pending []*TransferUsage) (*TransferPreview, *TransferUsage, error) {
+
+	//解析备注会写入扩展参数，预演使用副本
+	copied := *rawTx
+	plan, err := wm.prepareTransfer(wallet, &copied)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	policy, err := wm.GetTransferPolicy()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = wm.checkTransferPolicy(policy, plan.from, plan.to, plan.amount, now, pending...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if available.LessThan(plan.amount) {
+		return nil, nil, openwallet.Errorf(openwallet.ErrInsufficientBalanceOfAddress, "address's balance is not enough")
+	}
+
+	after := available.Sub(plan.amount)
+
+	preview := &TransferPreview{
+		From:          plan.from,
+		To:            plan.to,
+		Amount:        plan.amount.String(),
+		Memo:          plan.note,
+		Sign:          wm.SignBorn("", wallet.MtSign, password),
+		BalanceBefore: available.String(),
+		BalanceAfter:  after.String(),
+		Warnings:      plan.warnings,
+		Approval:      wm.requiresApproval(plan.amount),
+	}
+
+	if preview.Approval {
+		preview.Warnings = append(preview.Warnings, fmt.Sprintf("transaction requires %d approvals before it is sent", wm.Config.ApprovalRequired))
+	}
+
+	if len(plan.note) == 0 {
+		preview.Warnings = append(preview.Warnings, "transaction has no memo")
+	}
+
+	if after.IsZero() {
+		preview.Warnings = append(preview.Warnings, "transaction spends the whole available balance")
+	}
+
+	if plan.from == plan.to {
+		preview.Warnings = append(preview.Warnings, "transaction is sent to its own address")
+	}
+
+	return preview, NewTransferUsage(plan.from, plan.to, plan.amount, now), nil
+}
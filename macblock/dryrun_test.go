@@ -0,0 +1,141 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"github.com/blocktree/openwallet/openwallet"
+	"github.com/shopspring/decimal"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestWalletManager_DryRunTransactions(t *testing.T) {
+
+	sent := 0
+	wm, cleanup := testNewOfflineWalletManager(t, map[string]testNodeAction{
+		"GetAssetBalanceAds": func(form url.Values) string {
+			return `{"errCode": 0, "AssetBalance": "10", "LockedBalance": "0"}`
+		},
+		"AssetTransferMN2": func(form url.Values) string {
+			sent++
+			return `{"errCode": 0, "TranHash": "0x01"}`
+		},
+	})
+	defer cleanup()
+
+	wallet := &MACWallet{Address: "MACsender000000000000000000000", MtSign: "mtsign"}
+
+	newRawTx := func(to, amount, memo string) *openwallet.RawTransaction {
+		rawTx := &openwallet.RawTransaction{To: map[string]string{to: amount}}
+		rawTx.SetExtParam("memo", memo)
+		return rawTx
+	}
+
+	preview, err := wm.DryRunTransaction(wallet, "1234qwer", newRawTx("MACuser00000000000000000000000", "4", "john"))
+	if err != nil {
+		t.Fatalf("DryRunTransaction unexpected error: %v", err)
+	}
+	if preview.From != "MACsender000000000000000000000" || preview.To != "MACuser00000000000000000000000" || preview.Amount != "4" || preview.Memo != "john" ||
+		preview.BalanceBefore != "10" || preview.BalanceAfter != "6" || len(preview.Sign) == 0 {
+		t.Errorf("DryRunTransaction preview = %+v", preview)
+	}
+
+	previews, err := wm.DryRunTransactions(wallet, "1234qwer", []*openwallet.RawTransaction{
+		newRawTx("MACuser00000000000000000000000", "4", "a"),
+		newRawTx("MACuser00000000000000000000000", "7", "b"),
+		newRawTx("MACuser00000000000000000000000", "6", ""),
+	})
+	if err != nil {
+		t.Fatalf("DryRunTransactions unexpected error: %v", err)
+	}
+	if previews[0].BalanceAfter != "6" || len(previews[1].Error) == 0 || previews[2].BalanceAfter != "0" {
+		t.Errorf("DryRunTransactions previews = %+v %+v %+v", previews[0], previews[1], previews[2])
+	}
+	if len(previews[2].Warnings) != 2 {
+		t.Errorf("DryRunTransactions warnings = %v", previews[2].Warnings)
+	}
+
+	//策略限额按批量中前面的交易单累计
+	policy := NewTransferPolicy()
+	policy.Enabled = true
+	policy.WalletLimits[PolicyAnyAddress] = &TransferLimit{PerDay: decimal.New(5, 0)}
+	wm.SaveTransferPolicy(policy)
+	wm.Config.ApprovalThreshold = decimal.New(2, 0)
+	wm.Config.StructuredMemo = true
+
+	first := newRawTx("MACuser00000000000000000000000", "3", "uid=1001")
+	previews, err = wm.DryRunTransactions(wallet, "1234qwer", []*openwallet.RawTransaction{
+		first,
+		newRawTx("MACuser00000000000000000000000", "3", "b"),
+		newRawTx("MACuser00000000000000000000000", "2", "c"),
+	})
+	if err != nil {
+		t.Fatalf("DryRunTransactions unexpected error: %v", err)
+	}
+	if len(previews[0].Error) > 0 || !strings.Contains(previews[1].Error, PolicyRuleWalletPerDay) || len(previews[2].Error) > 0 {
+		t.Errorf("DryRunTransactions with daily limit = %+v %+v %+v", previews[0], previews[1], previews[2])
+	}
+	if !previews[0].Approval || previews[2].Approval {
+		t.Errorf("DryRunTransactions approval = %v %v, want true false", previews[0].Approval, previews[2].Approval)
+	}
+	if first.GetExtParam().Get("memoFields").Exists() {
+		t.Errorf("dry run changed the raw transaction: %s", first.ExtParam)
+	}
+
+	//SendTransaction的预演选项
+	rawTx := newRawTx("MACuser00000000000000000000000", "1", "d")
+	rawTx.SetExtParam("dryRun", true)
+	_, err = wm.SendTransaction(wallet, "1234qwer", rawTx)
+	if result, ok := err.(*DryRunResult); !ok || result.Preview.Amount != "1" || ErrorCode(err) != ErrDryRun {
+		t.Errorf("SendTransaction dry run error = %v", err)
+	}
+
+	if sent > 0 {
+		t.Errorf("dry run called AssetTransferMN2 %d times", sent)
+	}
+}
+
+func TestWalletManager_DryRunTransaction_Reservation(t *testing.T) {
+
+	wm, cleanup := testNewOfflineWalletManager(t, map[string]testNodeAction{
+		"GetAssetBalanceAds": func(form url.Values) string {
+			return `{"errCode": 0, "AssetBalance": "10", "LockedBalance": "0"}`
+		},
+	})
+	defer cleanup()
+
+	wallet := &MACWallet{Address: "MACsender000000000000000000000", MtSign: "mtsign"}
+	rawTx := &openwallet.RawTransaction{To: map[string]string{"MACuser00000000000000000000000": "4"}}
+
+	//已发送未确认的转账占用余额
+	wm.reserveTransfer("0x01", wallet.Address, "MACuser00000000000000000000000", decimal.New(7, 0))
+
+	if _, err := wm.DryRunTransaction(wallet, "1234qwer", rawTx); ErrorCode(err) != openwallet.ErrInsufficientBalanceOfAddress {
+		t.Errorf("DryRunTransaction error = %v, want insufficient balance", err)
+	}
+
+	previews, err := wm.DryRunTransactions(wallet, "1234qwer", []*openwallet.RawTransaction{
+		{To: map[string]string{"MACuser00000000000000000000000": "2"}},
+		rawTx,
+	})
+	if err != nil {
+		t.Fatalf("DryRunTransactions unexpected error: %v", err)
+	}
+	if previews[0].BalanceBefore != "3" || previews[0].BalanceAfter != "1" || len(previews[1].Error) == 0 {
+		t.Errorf("DryRunTransactions previews = %+v %+v", previews[0], previews[1])
+	}
+}
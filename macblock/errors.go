@@ -0,0 +1,65 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+//适配器自定义错误码，与openwallet的错误码区间不重叠，通过openwallet.Errorf生成
+const (
+	/* 金额类别 */
+	ErrAmountInvalidFormat = 5001 //金额格式不正确
+	ErrAmountNotPositive   = 5002 //金额必须大于0
+	ErrAmountPrecision     = 5003 //金额小数位超出精度
+	ErrAmountExceedMaximum = 5004 //金额超过单笔上限
+
+	/* 备注类别 */
+	ErrMemoRequired         = 5101 //目标地址要求填写备注
+	ErrMemoTooLong          = 5102 //备注超过最大长度
+	ErrMemoInvalidCharacter = 5103 //备注包含不允许的字符
+	ErrMemoInvalidFormat    = 5104 //结构化备注格式不正确
+
+	/* 策略类别 */
+	ErrPolicyRejected = 5201 //转账策略拒绝
+
+	/* 审批类别 */
+	ErrApprovalRequired = 5301 //转账需要审批
+	ErrApprovalInvalid  = 5302 //审批操作不合法
+
+	/* 地址类别 */
+	ErrAddressEmpty            = 5401 //地址为空
+	ErrAddressPrefix           = 5402 //地址前缀不正确
+	ErrAddressLength           = 5403 //地址长度不正确
+	ErrAddressInvalidCharacter = 5404 //地址包含不允许的字符
+
+	/* 预演类别 */
+	ErrDryRun = 5501 //预演完成，转账没有发送
+
+	/* 审计类别 */
+	ErrAuditUnavailable = 5601 //审计日志无法写入，转账没有发送
+)
+
+//ErrorCode 获取错误码，没有错误码的返回ErrUnknownException
+func ErrorCode(err error) uint64 {
+	if err == nil {
+		return 0
+	}
+	if coder, ok := err.(interface{ Code() uint64 }); ok {
+		return coder.Code()
+	}
+	return openwallet.ErrUnknownException
+}
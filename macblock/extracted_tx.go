@@ -0,0 +1,222 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"fmt"
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/openwallet/openwallet"
+	"time"
+)
+
+//ExtractedTransaction 已提取的交易，用于分叉时回滚
+type ExtractedTransaction struct {
+	ID          string `storm:"id"` //区块hash_交易ID_sourceKey
+	BlockHeight uint64 `storm:"index"`
+	BlockHash   string `storm:"index"`
+	TxID        string `storm:"index"`
+	SourceKey   string `storm:"index"`
+	Data        *openwallet.TxExtractData
+	Pending     bool //等待确认且没有提前通知观察者，分叉时不通知回滚
+	CreateAt    int64
+}
+
+//ExtractedTransactionQuery 已提取交易的查询条件，为空的条件不过滤
+type ExtractedTransactionQuery struct {
+	BlockHeight uint64
+	BlockHash   string
+	TxID        string
+	SourceKey   string
+}
+
+//BlockForkObserver 可选的观察者接口，区块被分叉时接收需要回滚的提取结果
+type BlockForkObserver interface {
+	BlockForkNotify(header *openwallet.BlockHeader, reversed []*ExtractedTransaction) error
+}
+
+//extractedID 已提取交易的记录ID
+func extractedID(blockHash, txid, sourceKey string) string {
+	return fmt.Sprintf("%s_%s_%s", blockHash, txid, sourceKey)
+}
+
+//unextractedData 过滤掉区块中已保存过的提取结果
+func (bs *MACBlockScanner) unextractedData(blockHash string, extractData map[string]*openwallet.TxExtractData) map[string]*openwallet.TxExtractData {
+
+	filtered := make(map[string]*openwallet.TxExtractData, len(extractData))
+	for key, data := range extractData {
+		if data.Transaction != nil {
+			var exist ExtractedTransaction
+			if err := bs.wm.blockChainDB.One("ID", extractedID(blockHash, data.Transaction.TxID, key), &exist); err == nil {
+				bs.wm.Log.Std.Info("transaction: %s of %s was extracted from block: %s, skipped", data.Transaction.TxID, key, blockHash)
+				continue
+			}
+		}
+		filtered[key] = data
+	}
+	return filtered
+}
+
+//extractedRecords 区块提取结果的记录，与通知事件在同一个事务中保存
+//@param pending 等待确认且没有通知观察者
+func extractedRecords(height uint64, blockHash string, extractData map[string]*openwallet.TxExtractData, pending bool) []interface{} {
+
+	now := time.Now().Unix()
+	records := make([]interface{}, 0, len(extractData))
+	for key, data := range extractData {
+		if data.Transaction == nil {
+			continue
+		}
+		record := &ExtractedTransaction{
+			ID:          extractedID(blockHash, data.Transaction.TxID, key),
+			BlockHeight: height,
+			BlockHash:   blockHash,
+			TxID:        data.Transaction.TxID,
+			SourceKey:   key,
+			Data:        data,
+			Pending:     pending,
+			CreateAt:    now,
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+//markExtractedNotified 待确认的交易已通知观察者
+func (bs *MACBlockScanner) markExtractedNotified(blockHash, txid, sourceKey string) {
+	err := bs.wm.blockChainDB.UpdateField(&ExtractedTransaction{ID: extractedID(blockHash, txid, sourceKey)}, "Pending", false)
+	if err != nil && err != storm.ErrNotFound {
+		bs.wm.Log.Std.Error("transaction: %s of %s can not be marked as notified; unexpected error: %v", txid, sourceKey, err)
+	}
+}
+
+//GetExtractedTransactions 查询已提取的交易
+func (bs *MACBlockScanner) GetExtractedTransactions(query *ExtractedTransactionQuery) ([]*ExtractedTransaction, error) {
+
+	matchers := make([]q.Matcher, 0)
+	if query.BlockHeight > 0 {
+		matchers = append(matchers, q.Eq("BlockHeight", query.BlockHeight))
+	}
+	if len(query.BlockHash) > 0 {
+		matchers = append(matchers, q.Eq("BlockHash", query.BlockHash))
+	}
+	if len(query.TxID) > 0 {
+		matchers = append(matchers, q.Eq("TxID", query.TxID))
+	}
+	if len(query.SourceKey) > 0 {
+		matchers = append(matchers, q.Eq("SourceKey", query.SourceKey))
+	}
+
+	var list []*ExtractedTransaction
+	err := bs.wm.blockChainDB.Select(matchers...).OrderBy("BlockHeight", "ID").Find(&list)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	if list == nil {
+		list = make([]*ExtractedTransaction, 0)
+	}
+	return list, nil
+}
+
+//reverseExtractedTransactions 通过事件箱通知分叉区块需要回滚的提取结果，保存事件后删除
+//没有通知过观察者的待确认交易只删除，不通知回滚
+func (bs *MACBlockScanner) reverseExtractedTransactions(block *Block) error {
+
+	extracted, err := bs.GetExtractedTransactions(&ExtractedTransactionQuery{BlockHeight: block.Height, BlockHash: block.Hash})
+	if err != nil {
+		return err
+	}
+
+	reversed := make([]*ExtractedTransaction, 0, len(extracted))
+	for _, r := range extracted {
+		if !r.Pending {
+			reversed = append(reversed, r)
+		}
+	}
+
+	header := block.BlockHeader(bs.wm.Symbol())
+	header.Fork = true
+
+	var deposits []*UnattributedDeposit
+	err = bs.wm.blockChainDB.Select(q.Eq("BlockHeight", block.Height), q.Eq("BlockHash", block.Hash)).Find(&deposits)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+
+	events := []*OutboxEvent{{
+		Kind:        OutboxEventFork,
+		BlockHeight: block.Height,
+		Header:      header,
+		Reversed:    reversed,
+	}}
+
+	notified := make([]*UnattributedDeposit, 0, len(deposits))
+	for _, d := range deposits {
+		if !d.Pending {
+			notified = append(notified, d)
+		}
+	}
+	if len(notified) > 0 {
+		events = append(events, &OutboxEvent{
+			Kind:        OutboxEventUnattributedFork,
+			BlockHeight: block.Height,
+			Header:      header,
+			Deposits:    notified,
+		})
+	}
+
+	//回滚的提取结果保存在事件箱中，每个观察者确认后才清理，保存失败时保留记录
+	if err := bs.publishOutboxEvents(events...); err != nil {
+		return err
+	}
+
+	for _, d := range deposits {
+		bs.wm.Log.Std.Info("deposit: %s is reversed by fork on height: %d", d.TxID, d.BlockHeight)
+		if err := bs.wm.blockChainDB.DeleteStruct(d); err != nil {
+			return err
+		}
+	}
+
+	for _, r := range extracted {
+		bs.wm.Log.Std.Info("transaction: %s of %s is reversed by fork on height: %d", r.TxID, r.SourceKey, r.BlockHeight)
+		if err := bs.wm.blockChainDB.DeleteStruct(r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//pruneExtractedTransactions 删除maxHeight及之前的区块的提取记录
+func (bs *MACBlockScanner) pruneExtractedTransactions(maxHeight uint64) error {
+
+	var list []*ExtractedTransaction
+	err := bs.wm.blockChainDB.Range("BlockHeight", uint64(0), maxHeight, &list)
+	if err != nil {
+		if err == storm.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+
+	for _, r := range list {
+		if err := bs.wm.blockChainDB.DeleteStruct(r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,177 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"fmt"
+	"github.com/blocktree/openwallet/openwallet"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+//testForkObserver 记录需要回滚的交易，failures次之前的通知返回错误
+type testForkObserver struct {
+	mu       sync.Mutex
+	reversed map[uint64][]*ExtractedTransaction
+	failures int
+}
+
+func (o *testForkObserver) BlockScanNotify(header *openwallet.BlockHeader) error {
+	return nil
+}
+
+func (o *testForkObserver) BlockExtractDataNotify(sourceKey string, data *openwallet.TxExtractData) error {
+	return nil
+}
+
+func (o *testForkObserver) BlockForkNotify(header *openwallet.BlockHeader, reversed []*ExtractedTransaction) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.failures > 0 {
+		o.failures--
+		return fmt.Errorf("fork observer is unavailable")
+	}
+	o.reversed[header.Height] = reversed
+	return nil
+}
+
+func TestMACBlockScanner_ReverseExtractedTransactions(t *testing.T) {
+
+	//节点在高度8之后是另一条链
+	wm, cleanup := testNewOfflineWalletManager(t, map[string]testNodeAction{
+		"GetTransactionRecordHight": func(form url.Values) string {
+			height, _ := strconv.Atoi(form.Get("height"))
+			prefix := "a"
+			if height > 8 {
+				prefix = "b"
+			}
+			return fmt.Sprintf(`{"errCode": 0, "blockhash": "%s%d", "Content": []}`, prefix, height)
+		},
+	})
+	defer cleanup()
+
+	receiver := "MACja4a7fbe76dBwVUBYFAWZVUWNlA"
+	bs := wm.Blockscanner.(*MACBlockScanner)
+	bs.SetBlockScanTargetFunc(func(target openwallet.ScanTarget) (string, bool) {
+		return "receiver", target.Address == receiver
+	})
+	//通知失败时事件留在事件箱中重试
+	wm.Config.OutboxRetryInterval = time.Millisecond
+	observer := &testForkObserver{reversed: make(map[uint64][]*ExtractedTransaction), failures: 2}
+	bs.AddObserver(observer)
+
+	for height := uint64(8); height <= 10; height++ {
+		hash := fmt.Sprintf("a%d", height)
+		txs := []*Transaction{
+			{TxID: fmt.Sprintf("0x%d1", height), FromToken: "MACx6150b0728bVdQDOAABCYFAUN1U", ToToken: receiver, Amount: "1", BlockHeight: height, BlockHash: hash},
+			{TxID: fmt.Sprintf("0x%d2", height), FromToken: "MACx6150b0728bVdQDOAABCYFAUN1U", ToToken: receiver, Amount: "2", BlockHeight: height, BlockHash: hash},
+		}
+		if err := bs.BatchExtractTransaction(height, hash, txs); err != nil {
+			t.Fatalf("BatchExtractTransaction unexpected error: %v", err)
+		}
+		bs.SaveLocalBlock(&Block{Height: height, Hash: hash})
+	}
+
+	list, err := bs.GetExtractedTransactions(&ExtractedTransactionQuery{TxID: "0x91"})
+	if err != nil || len(list) != 1 || list[0].BlockHash != "a9" || list[0].SourceKey != "receiver" || list[0].Data.Transaction.Amount != "1" {
+		t.Fatalf("GetExtractedTransactions = %+v, error: %v", list, err)
+	}
+
+	if _, err := bs.handleReorg(10, "a10"); err != nil {
+		t.Fatalf("handleReorg unexpected error: %v", err)
+	}
+	testWaitObserverQueues(t, bs)
+
+	for _, height := range []uint64{9, 10} {
+		reversed := observer.reversed[height]
+		if len(reversed) != 2 || reversed[0].BlockHeight != height {
+			t.Errorf("reversed transactions on height: %d = %+v", height, reversed)
+		}
+	}
+	if _, ok := observer.reversed[8]; ok {
+		t.Errorf("common ancestor should not be reversed")
+	}
+
+	list, _ = bs.GetExtractedTransactions(&ExtractedTransactionQuery{SourceKey: "receiver"})
+	if len(list) != 2 || list[0].BlockHeight != 8 {
+		t.Errorf("extracted transactions after reorg = %d, want 2 on height 8", len(list))
+	}
+}
+
+func TestMACBlockScanner_ReverseExtractedTransactions_Pending(t *testing.T) {
+
+	wm, cleanup := testNewOfflineWalletManager(t, map[string]testNodeAction{
+		"GetTransactionRecordHight": func(form url.Values) string {
+			height, _ := strconv.Atoi(form.Get("height"))
+			prefix := "a"
+			if height > 8 {
+				prefix = "b"
+			}
+			return fmt.Sprintf(`{"errCode": 0, "blockhash": "%s%d", "Content": []}`, prefix, height)
+		},
+	})
+	defer cleanup()
+
+	wm.Config.ConfirmationDepth = 3
+	wm.Config.NotifyUnconfirmed = false
+
+	receiver := "MACja4a7fbe76dBwVUBYFAWZVUWNlA"
+	bs := wm.Blockscanner.(*MACBlockScanner)
+	bs.SetBlockScanTargetFunc(func(target openwallet.ScanTarget) (string, bool) {
+		return "receiver", target.Address == receiver
+	})
+	observer := &testForkObserver{reversed: make(map[uint64][]*ExtractedTransaction)}
+	bs.AddObserver(observer)
+
+	for height := uint64(8); height <= 10; height++ {
+		hash := fmt.Sprintf("a%d", height)
+		txs := []*Transaction{
+			{TxID: fmt.Sprintf("0x%d1", height), FromToken: "MACx6150b0728bVdQDOAABCYFAUN1U", ToToken: receiver, Amount: "1", BlockHeight: height, BlockHash: hash},
+		}
+		//重扫同一区块不重复保存待确认记录
+		for i := 0; i < 2; i++ {
+			if err := bs.BatchExtractTransaction(height, hash, txs); err != nil {
+				t.Fatalf("BatchExtractTransaction unexpected error: %v", err)
+			}
+		}
+		bs.SaveLocalBlock(&Block{Height: height, Hash: hash})
+	}
+
+	pending, _ := bs.GetPendingExtractData()
+	if len(pending) != 3 {
+		t.Fatalf("pending records = %d, want 3", len(pending))
+	}
+
+	if _, err := bs.handleReorg(10, "a10"); err != nil {
+		t.Fatalf("handleReorg unexpected error: %v", err)
+	}
+	testWaitObserverQueues(t, bs)
+
+	//没有通知过的待确认交易不通知回滚
+	for _, height := range []uint64{9, 10} {
+		if reversed := observer.reversed[height]; len(reversed) != 0 {
+			t.Errorf("reversed transactions on height: %d = %+v, want none", height, reversed)
+		}
+	}
+
+	list, _ := bs.GetExtractedTransactions(&ExtractedTransactionQuery{SourceKey: "receiver"})
+	if len(list) != 1 || list[0].BlockHeight != 8 {
+		t.Errorf("extracted transactions after reorg = %d, want 1 on height 8", len(list))
+	}
+}
@@ -16,12 +16,21 @@
 package macblock
 
 import (
+	"fmt"
 	"github.com/asdine/storm"
 	"github.com/astaxie/beego/config"
 	"github.com/blocktree/go-owcrypt"
 	"github.com/blocktree/openwallet/log"
 	"github.com/blocktree/openwallet/openwallet"
+	"github.com/shopspring/decimal"
+	bolt "go.etcd.io/bbolt"
 	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	dbOpenTimeout = 5 * time.Second //等待其他进程释放数据库文件锁的时间
 )
 
 //FullName 币种全名
@@ -41,12 +50,12 @@ func (wm *WalletManager) Symbol() string {
 
 //小数位精度
 func (wm *WalletManager) Decimal() int32 {
-	return 8
+	return Decimals
 }
 
 //AddressDecode 地址解析器
 func (wm *WalletManager) GetAddressDecode() openwallet.AddressDecoder {
-	return nil
+	return wm.Decoder
 }
 
 //TransactionDecoder 交易单解析器
@@ -66,21 +75,108 @@ func (wm *WalletManager) LoadAssetsConfig(c config.Configer) error {
 	wm.Config.tokenAddress = c.String("tokenAddress")
 	wm.Config.DataDir = c.String("dataDir")
 
+	maxTransferAmount := c.String("maxTransferAmount")
+	if len(maxTransferAmount) > 0 {
+		maximum, err := decimal.NewFromString(maxTransferAmount)
+		if err != nil {
+			return fmt.Errorf("maxTransferAmount: '%s' is invalid", maxTransferAmount)
+		}
+		wm.Config.MaxTransferAmount = maximum
+	}
+
+	memoRequiredAddresses := make([]string, 0)
+	if addrs := c.String("memoRequiredAddresses"); len(addrs) > 0 {
+		memoRequiredAddresses = strings.Split(addrs, ",")
+	}
+	memoPolicy, err := NewMemoPolicy(c.DefaultInt("memoMaxLength", 0), c.String("memoPattern"), memoRequiredAddresses)
+	if err != nil {
+		return fmt.Errorf("memoPattern: '%s' is invalid", c.String("memoPattern"))
+	}
+	wm.Config.MemoPolicy = memoPolicy
+	wm.Config.StructuredMemo = c.DefaultBool("structuredMemo", false)
+	wm.Config.MemoDeposit = c.DefaultBool("memoDeposit", false)
+	wm.Config.MemoDepositField = c.String("memoDepositField")
+	if wm.Config.MemoDeposit && CheckAddress(wm.Config.tokenAddress) != nil {
+		return fmt.Errorf("memoDeposit requires a valid tokenAddress")
+	}
+
+	approvalThreshold := c.String("approvalThreshold")
+	if len(approvalThreshold) > 0 {
+		threshold, err := decimal.NewFromString(approvalThreshold)
+		if err != nil {
+			return fmt.Errorf("approvalThreshold: '%s' is invalid", approvalThreshold)
+		}
+		wm.Config.ApprovalThreshold = threshold
+	}
+	wm.Config.ApprovalRequired = c.DefaultInt("approvalRequired", wm.Config.ApprovalRequired)
+	wm.Config.ApprovalExpiry = time.Duration(c.DefaultInt64("approvalExpiry", int64(wm.Config.ApprovalExpiry/time.Second))) * time.Second
+	wm.Config.ApprovalExecutingTimeout = time.Duration(c.DefaultInt64("approvalExecutingTimeout", int64(wm.Config.ApprovalExecutingTimeout/time.Second))) * time.Second
+
+	wm.Config.RequestsPerSecond = c.DefaultFloat("requestsPerSecond", 0)
+	wm.Config.ConfirmationDepth = uint64(c.DefaultInt64("confirmationDepth", 0))
+	wm.Config.NotifyUnconfirmed = c.DefaultBool("notifyUnconfirmed", false)
+	wm.Config.MaxReorgDepth = uint64(c.DefaultInt64("maxReorgDepth", int64(wm.Config.MaxReorgDepth)))
+	wm.Config.PrefetchWindow = c.DefaultInt("prefetchWindow", wm.Config.PrefetchWindow)
+	wm.Config.BlockHeightCacheTTL = time.Duration(c.DefaultInt64("blockHeightCacheTTL", int64(wm.Config.BlockHeightCacheTTL/time.Second))) * time.Second
+	wm.Config.HeaderRetention = uint64(c.DefaultInt64("headerRetention", int64(wm.Config.HeaderRetention)))
+	wm.Config.RescanMaxAttempts = c.DefaultInt("rescanMaxAttempts", wm.Config.RescanMaxAttempts)
+	wm.Config.RescanBackoff = time.Duration(c.DefaultInt64("rescanBackoff", int64(wm.Config.RescanBackoff/time.Second))) * time.Second
+	wm.Config.RescanMaxBackoff = time.Duration(c.DefaultInt64("rescanMaxBackoff", int64(wm.Config.RescanMaxBackoff/time.Second))) * time.Second
+	wm.Config.OutboxMaxAttempts = c.DefaultInt("outboxMaxAttempts", 0)
+	wm.Config.ObserverQueueSize = c.DefaultInt("observerQueueSize", wm.Config.ObserverQueueSize)
+	wm.Config.OutboxRetryInterval = time.Duration(c.DefaultInt64("outboxRetryInterval", int64(wm.Config.OutboxRetryInterval/time.Second))) * time.Second
+	wm.Config.ObserverQueuePolicy = c.DefaultString("observerQueuePolicy", wm.Config.ObserverQueuePolicy)
+	switch wm.Config.ObserverQueuePolicy {
+	case ObserverQueueBlock, ObserverQueueDropOldest, ObserverQueueSpill:
+	default:
+		return fmt.Errorf("observerQueuePolicy: '%s' is invalid", wm.Config.ObserverQueuePolicy)
+	}
+
 	wm.client = NewClient(wm.Config.serverAPI, false)
+	wm.client.SetRateLimit(wm.Config.RequestsPerSecond)
 
 	//数据文件夹
 	wm.Config.makeDataDir()
 
-	blockchaindb, err := storm.Open(filepath.Join(wm.Config.dbPath, wm.Config.BlockchainFile))
+	blockchaindb, err := openBlockchainDB(filepath.Join(wm.Config.dbPath, wm.Config.BlockchainFile))
 	if err != nil {
 		return err
 	}
 
 	wm.blockChainDB = blockchaindb
 
+	//旧版本保存的区块没有hash索引，重建一次
+	var hashIndexed bool
+	err = blockchaindb.Get(blockchainBucket, "blockHashIndexed", &hashIndexed)
+	if err != nil && err != storm.ErrNotFound {
+		return fmt.Errorf("blockchain db: can not read block hash index flag; %v", err)
+	}
+	if !hashIndexed {
+		//新数据库没有区块数据，无需重建
+		if count, _ := blockchaindb.Count(&Block{}); count > 0 {
+			err = blockchaindb.ReIndex(&Block{})
+			if err != nil {
+				return err
+			}
+		}
+		err = blockchaindb.Set(blockchainBucket, "blockHashIndexed", true)
+		if err != nil {
+			return fmt.Errorf("blockchain db: can not save block hash index flag; %v", err)
+		}
+	}
+
 	return nil
 }
 
+//openBlockchainDB 打开区块链数据库，文件被其他进程锁定时超时返回错误
+func openBlockchainDB(path string) (*storm.DB, error) {
+	db, err := storm.Open(path, storm.BoltOptions(0600, &bolt.Options{Timeout: dbOpenTimeout}))
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("blockchain db: %s is locked by another process, stop the scanner first", path)
+	}
+	return db, err
+}
+
 //InitAssetsConfig 初始化默认配置
 func (wm *WalletManager) InitAssetsConfig() (config.Configer, error) {
 	return nil, nil
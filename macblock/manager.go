@@ -27,11 +27,13 @@ import (
 	"github.com/blocktree/openwallet/openwallet"
 	"github.com/imroc/req"
 	"github.com/shopspring/decimal"
+	"github.com/tidwall/gjson"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -50,18 +52,26 @@ type WalletManager struct {
 	Blockscanner    openwallet.BlockScanner         //区块扫描器
 	client          *Client                         //远程客户端
 	blockChainDB    *storm.DB                       //区块链数据库
+	policyMu        sync.Mutex                      //转账策略锁
+	auditMu         sync.Mutex                      //审计日志锁
+	approvalMu      sync.Mutex                      //审批提案锁
+	sendMu          sync.Mutex                      //发送地址锁表的锁
+	sendLocks       map[string]*sync.Mutex          //发送地址锁
+	labelMu         sync.Mutex                      //地址标签缓存锁
+	labelCache      map[string]*AddressLabel        //地址标签缓存，nil表示没有标签
 }
 
 func NewWalletManager() *WalletManager {
 	wm := WalletManager{}
 	wm.Config = NewConfig()
 	wm.Blockscanner = NewMACBlockScanner(&wm)
+	wm.Decoder = NewAddressDecoder(&wm)
 	wm.Log = log.NewOWLogger(wm.Symbol())
 	return &wm
 }
 
 // GetAssetBalanceAds 获取余额
-func (wm *WalletManager) GetAssetBalanceAds(address string) (decimal.Decimal, error) {
+func (wm *WalletManager) GetAssetBalanceAds(address string) (*AccountBalance, error) {
 
 	param := req.Param{
 		"action":       "GetAssetBalanceAds",
@@ -70,11 +80,10 @@ func (wm *WalletManager) GetAssetBalanceAds(address string) (decimal.Decimal, er
 
 	result, err := wm.client.Call(param)
 	if err != nil {
-		return decimal.Zero, nil
+		return nil, err
 	}
 
-	balance := result.Get("AssetBalance").String()
-	return decimal.NewFromString(balance)
+	return NewAccountBalance(address, result)
 }
 
 // CreateNewAddress 创建地址
@@ -170,6 +179,14 @@ func (wm *WalletManager) CreateNewWallet(keydir, alias, password string) (*MACWa
 		return nil, "", err
 	}
 
+	//记录地址标签，失败不影响创建结果
+	if wm.blockChainDB != nil {
+		label := &AddressLabel{Address: address, Label: alias, Source: AddressSourceCreated}
+		if err := wm.SaveAddressLabel(label); err != nil {
+			wm.Log.Std.Warning("address: %s label can not be saved; unexpected error: %v", address, err)
+		}
+	}
+
 	return wallet, filePath, nil
 }
 
@@ -290,8 +307,31 @@ func (wm *WalletManager) GetMtsign2(token, walletKey, mnemonicWords, password st
 	return mtsign, nil
 }
 
+//AssetTransferMN2 提交转账，与SendTransaction一样经过金额、备注、策略、余额和审批检查
+//金额超过审批阈值时返回ApprovalRequiredError
 func (wm *WalletManager) AssetTransferMN2(fromtoken, totoken, amount, note, mtsign, password string) (string, error) {
 
+	rawTx := &openwallet.RawTransaction{
+		Coin: openwallet.Coin{
+			Symbol:     wm.Symbol(),
+			IsContract: false,
+		},
+		To: map[string]string{totoken: amount},
+	}
+	if len(note) > 0 {
+		rawTx.SetExtParam("memo", note)
+	}
+
+	tx, err := wm.sendTransaction(&MACWallet{Address: fromtoken, MtSign: mtsign}, password, rawTx, "")
+	if err != nil {
+		return "", err
+	}
+
+	return tx.TxID, nil
+}
+
+func (wm *WalletManager) assetTransferMN2(fromtoken, totoken, amount, note, mtsign, password string) (*gjson.Result, error) {
+
 	sign := wm.SignBorn("", mtsign, password)
 
 	param := req.Param{
@@ -303,49 +343,166 @@ func (wm *WalletManager) AssetTransferMN2(fromtoken, totoken, amount, note, mtsi
 		"note":      note,
 	}
 
-	result, err := wm.client.Call(param)
-	if err != nil {
-		return "", err
-	}
+	return wm.client.Call(param)
+}
 
-	txid := result.Get("TranHash").String()
-	return txid, nil
+//transferPlan 校验通过的转账参数
+type transferPlan struct {
+	from     string
+	to       string
+	amount   decimal.Decimal
+	note     string
+	warnings []string
 }
 
-func (wm *WalletManager) SendTransaction(wallet *MACWallet, password string, rawTx *openwallet.RawTransaction) (*openwallet.Transaction, error) {
+//prepareTransfer 解析交易单并检查金额和备注，在任何远程调用前完成
+func (wm *WalletManager) prepareTransfer(wallet *MACWallet, rawTx *openwallet.RawTransaction) (*transferPlan, error) {
 
 	var (
-		fromtoken string
-		totoken   string
-		toamount  string
-		note      string
+		totoken  string
+		toamount string
 	)
 
-	fromtoken = wallet.Address
+	plan := &transferPlan{
+		from:     wallet.Address,
+		warnings: make([]string, 0),
+	}
 
 	for to, amount := range rawTx.To {
 		totoken = to
 		toamount = amount
 	}
 
-	note = rawTx.GetExtParam().Get("memo").String()
+	if len(rawTx.To) > 1 {
+		plan.warnings = append(plan.warnings, fmt.Sprintf("transaction has %d destinations, only %s will be sent", len(rawTx.To), totoken))
+	}
+
+	if err := CheckAddress(totoken); err != nil {
+		return nil, err
+	}
+
+	totalAmount, err := wm.ValidateAmount(toamount)
+	if err != nil {
+		return nil, err
+	}
+
+	note, err := wm.resolveMemo(rawTx, totoken)
+	if err != nil {
+		return nil, err
+	}
+
+	plan.to = totoken
+	plan.amount = totalAmount
+	plan.note = note
+
+	return plan, nil
+}
+
+//SendTransaction 发送转账，金额超过审批阈值时创建提案并返回ApprovalRequiredError
+//扩展参数dryRun为true时只预演，返回DryRunResult
+func (wm *WalletManager) SendTransaction(wallet *MACWallet, password string, rawTx *openwallet.RawTransaction) (*openwallet.Transaction, error) {
+	if isDryRun(rawTx) {
+		preview, err := wm.DryRunTransaction(wallet, password, rawTx)
+		if err != nil {
+			return nil, err
+		}
+		return nil, &DryRunResult{Preview: preview}
+	}
+	return wm.sendTransaction(wallet, password, rawTx, "")
+}
+
+//sendTransaction 发送转账
+//@param proposalID 审批通过的提案，为空时检查是否需要审批
+func (wm *WalletManager) sendTransaction(wallet *MACWallet, password string, rawTx *openwallet.RawTransaction, proposalID string) (tx *openwallet.Transaction, err error) {
+
+	//每次调用都记录审计日志，提交节点前另外记录一条，发送后的记录写入失败时转账已发送，只记录日志
+	audit := newAuditEntry("SendTransaction", wallet, rawTx)
+	audit.Decision = AuditDecisionRejected
+	defer func() {
+		wm.appendAudit(audit, err)
+	}()
+
+	plan, err := wm.prepareTransfer(wallet, rawTx)
+	if err != nil {
+		return nil, err
+	}
+
+	audit.To = plan.to
+	audit.Amount = plan.amount.String()
+	audit.Memo = plan.note
+
+	//大额转账需要审批
+	if len(proposalID) == 0 && wm.requiresApproval(plan.amount) {
+		proposal, err := wm.createProposal(plan, rawTx)
+		if err != nil {
+			return nil, err
+		}
+		audit.Decision = AuditDecisionPendingApproval
+		return nil, &ApprovalRequiredError{ProposalID: proposal.ID}
+	}
+
+	fromtoken := plan.from
+	totoken := plan.to
+	toamount := plan.amount.String()
+
+	//同一发送地址逐笔检查余额和发送，避免并发转账透支
+	lock := wm.sendLock(fromtoken)
+	lock.Lock()
+	defer lock.Unlock()
+
+	//转账策略检查，并占用限额
+	usage, err := wm.reserveTransferPolicy(fromtoken, totoken, plan.amount, time.Now())
+	if err != nil {
+		return nil, err
+	}
 
 	balance, err := wm.GetAssetBalanceAds(fromtoken)
 	if err != nil {
+		wm.releaseTransferPolicy(usage)
 		return nil, err
 	}
 
-	totalAmount, _ := decimal.NewFromString(toamount)
+	//已发送未确认的转账还没有计入节点余额
+	reserved, err := wm.reservedBalance(fromtoken)
+	if err != nil {
+		wm.releaseTransferPolicy(usage)
+		return nil, err
+	}
+
+	if balance.AssetBalance.Sub(reserved).LessThan(plan.amount) {
+		wm.releaseTransferPolicy(usage)
+		return nil, openwallet.Errorf(openwallet.ErrInsufficientBalanceOfAddress, "address's balance is not enough, %s is reserved by unconfirmed transfers", reserved.String())
+	}
 
-	if balance.LessThan(totalAmount) {
-		return nil, openwallet.Errorf(openwallet.ErrInsufficientBalanceOfAddress, "address's balance is not enough")
+	if err := wm.auditBeforeSend(audit, AuditDecisionAllowed); err != nil {
+		wm.releaseTransferPolicy(usage)
+		return nil, err
 	}
 
-	txid, err := wm.AssetTransferMN2(fromtoken, totoken, toamount, note, wallet.MtSign, password)
+	audit.Decision = AuditDecisionFailed
+
+	result, err := wm.assetTransferMN2(fromtoken, totoken, toamount, plan.note, wallet.MtSign, password)
 	if err != nil {
+		wm.releaseTransferPolicy(usage)
 		return nil, err
 	}
 
+	audit.Decision = AuditDecisionSent
+	txid := result.Get("TranHash").String()
+	audit.Response = result.Raw
+	audit.TxID = txid
+
+	//审批的转账立即记录交易单号，执行中断后可以恢复
+	if len(proposalID) > 0 {
+		wm.recordProposalTxID(proposalID, txid)
+	}
+
+	wm.confirmTransferPolicy(usage, txid)
+
+	if err := wm.reserveTransfer(txid, fromtoken, totoken, plan.amount); err != nil {
+		wm.Log.Std.Error("transfer: %s was sent, but its balance can not be reserved; unexpected error: %v", txid, err)
+	}
+
 	rawTx.TxID = txid
 	rawTx.IsSubmit = true
 
@@ -354,7 +511,7 @@ func (wm *WalletManager) SendTransaction(wallet *MACWallet, password string, raw
 	decimals := wm.Decimal()
 
 	//记录一个交易单
-	tx := &openwallet.Transaction{
+	tx = &openwallet.Transaction{
 		From:       txFrom,
 		To:         txTo,
 		Amount:     rawTx.TxAmount,
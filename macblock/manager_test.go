@@ -16,11 +16,18 @@
 package macblock
 
 import (
+	"github.com/asdine/storm"
 	"github.com/astaxie/beego/config"
 	"github.com/blocktree/openwallet/log"
 	"github.com/blocktree/openwallet/openwallet"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 var (
@@ -48,13 +55,55 @@ func testNewWalletManager() *WalletManager {
 	return wm
 }
 
+//testNodeAction 模拟节点接口，返回JSON
+type testNodeAction func(form url.Values) string
+
+//testNewOfflineWalletManager 创建使用模拟节点和临时数据库的钱包管理实例
+func testNewOfflineWalletManager(t *testing.T, actions map[string]testNodeAction) (*WalletManager, func()) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		action, ok := actions[r.Form.Get("action")]
+		if !ok {
+			w.Write([]byte(`{"errCode": 1, "Msg": "unknown action"}`))
+			return
+		}
+		w.Write([]byte(action(r.Form)))
+	}))
+
+	dir, err := ioutil.TempDir("", "macblock")
+	if err != nil {
+		t.Fatalf("TempDir unexpected error: %v", err)
+	}
+
+	db, err := storm.Open(filepath.Join(dir, "blockchain.db"))
+	if err != nil {
+		t.Fatalf("storm.Open unexpected error: %v", err)
+	}
+
+	wm := NewWalletManager()
+	wm.Config.DataDir = dir
+	wm.client = NewClient(server.URL, false)
+	wm.blockChainDB = db
+	wm.Config.OutboxRetryInterval = 10 * time.Millisecond
+
+	return wm, func() {
+		if bs, ok := wm.Blockscanner.(*MACBlockScanner); ok {
+			bs.stopObserverQueues()
+		}
+		server.Close()
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
 func TestWalletManager_GetAssetBalanceAds(t *testing.T) {
 	balance, err := tw.GetAssetBalanceAds("MACja4a7fbe76dBwVUBYFAWZVUWNlA")
 	if err != nil {
 		t.Errorf("GetAssetBalanceAds failed unexpected error: %v\n", err)
 		return
 	}
-	log.Infof("balance: %s", balance.String())
+	log.Infof("balance: %+v", balance)
 }
 
 func TestWalletManager_Macpwdencode(t *testing.T) {
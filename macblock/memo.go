@@ -0,0 +1,273 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/blocktree/openwallet/openwallet"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+//备注格式
+const (
+	MemoFormatText = "text" //普通文本
+	MemoFormatJSON = "json" //JSON对象，如：{"uid":"1001"}
+	MemoFormatKV   = "kv"   //键值对，如：uid=1001&type=deposit
+)
+
+//MemoPolicy 备注规则
+type MemoPolicy struct {
+	MaxLength         int             //最大字符数，为0时不限制
+	Pattern           *regexp.Regexp  //允许的字符，为nil时不限制
+	RequiredAddresses map[string]bool //必须填写备注的目标地址，如交易所地址
+}
+
+//NewMemoPolicy 创建备注规则
+//@param pattern 允许字符的正则表达式，为空时不限制
+func NewMemoPolicy(maxLength int, pattern string, requiredAddresses []string) (*MemoPolicy, error) {
+
+	policy := &MemoPolicy{
+		MaxLength:         maxLength,
+		RequiredAddresses: make(map[string]bool),
+	}
+
+	if len(pattern) > 0 {
+		reg, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		policy.Pattern = reg
+	}
+
+	for _, a := range requiredAddresses {
+		a = strings.TrimSpace(a)
+		if len(a) > 0 {
+			policy.RequiredAddresses[a] = true
+		}
+	}
+
+	return policy, nil
+}
+
+//Check 检查转账到目标地址的备注
+func (p *MemoPolicy) Check(to, memo string) error {
+
+	if p == nil {
+		return nil
+	}
+
+	if len(memo) == 0 {
+		if p.RequiredAddresses[to] {
+			return openwallet.Errorf(ErrMemoRequired, "address: %s requires a memo", to)
+		}
+		return nil
+	}
+
+	if p.MaxLength > 0 && utf8.RuneCountInString(memo) > p.MaxLength {
+		return openwallet.Errorf(ErrMemoTooLong, "memo is longer than %d characters", p.MaxLength)
+	}
+
+	if p.Pattern != nil && !p.Pattern.MatchString(memo) {
+		return openwallet.Errorf(ErrMemoInvalidCharacter, "memo: '%s' contains characters not allowed by: %s", memo, p.Pattern.String())
+	}
+
+	return nil
+}
+
+//memoKeyPattern 键值对备注的键
+var memoKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.\-]*$`)
+
+//Memo 结构化备注
+type Memo struct {
+	Raw    string                 //原始备注
+	Format string                 //备注格式
+	Fields map[string]interface{} //结构化字段，JSON保留原类型，数字为json.Number，键值对为string
+}
+
+//Field 字段的文本值，不存在时为空
+func (m *Memo) Field(key string) string {
+	return memoFieldString(m.Fields[key])
+}
+
+//memoFieldString 字段值转为文本
+func memoFieldString(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	default:
+		b, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Sprint(value)
+		}
+		return string(b)
+	}
+}
+
+//decodeMemoFields 解析JSON对象，数字保留为json.Number
+func decodeMemoFields(text string) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+//parseMemoKV 解析键值对备注，用&或;分隔，任何一段不是key=value时不是键值对
+func parseMemoKV(text string) (map[string]interface{}, bool) {
+
+	if !strings.Contains(text, "=") {
+		return nil, false
+	}
+
+	separator := "&"
+	if !strings.Contains(text, "&") && strings.Contains(text, ";") {
+		separator = ";"
+	}
+
+	fields := make(map[string]interface{})
+	for _, pair := range strings.Split(text, separator) {
+		kv := strings.Split(pair, "=")
+		if len(kv) != 2 {
+			return nil, false
+		}
+		//值为空时可能是base64的填充，不作为键值对
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if !memoKeyPattern.MatchString(key) || len(value) == 0 {
+			return nil, false
+		}
+		fields[key] = value
+	}
+	return fields, true
+}
+
+//ParseMemo 解析备注，JSON对象或键值对解析为结构化字段，其它为普通文本
+//只有每一段都是key=value时才作为键值对，否则如base64等含有=的备注按普通文本处理
+func ParseMemo(raw string) (*Memo, error) {
+
+	memo := &Memo{
+		Raw:    raw,
+		Format: MemoFormatText,
+		Fields: make(map[string]interface{}),
+	}
+
+	text := strings.TrimSpace(raw)
+
+	if strings.HasPrefix(text, "{") {
+		fields, err := decodeMemoFields(text)
+		if err != nil {
+			return nil, openwallet.Errorf(ErrMemoInvalidFormat, "memo: '%s' is not a valid json object", raw)
+		}
+		memo.Fields = fields
+		memo.Format = MemoFormatJSON
+		return memo, nil
+	}
+
+	if fields, ok := parseMemoKV(text); ok {
+		memo.Fields = fields
+		memo.Format = MemoFormatKV
+	}
+
+	return memo, nil
+}
+
+//EncodeMemo 把结构化字段编码为备注
+func EncodeMemo(fields map[string]interface{}, format string) (string, error) {
+
+	switch format {
+	case MemoFormatJSON:
+		b, err := json.Marshal(fields)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	case MemoFormatKV:
+		keys := make([]string, 0, len(fields))
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		pairs := make([]string, 0, len(keys))
+		for _, k := range keys {
+			pairs = append(pairs, k+"="+memoFieldString(fields[k]))
+		}
+		return strings.Join(pairs, "&"), nil
+	default:
+		return "", openwallet.Errorf(ErrMemoInvalidFormat, "memo format: '%s' is not supported", format)
+	}
+}
+
+//resolveMemo 获取交易单的备注并按规则检查，结构化备注的字段写入交易单扩展参数
+func (wm *WalletManager) resolveMemo(rawTx *openwallet.RawTransaction, to string) (string, error) {
+
+	ext := rawTx.GetExtParam()
+	note := ext.Get("memo").String()
+
+	//只提供了结构化字段，编码为备注
+	if len(note) == 0 && ext.Get("memoFields").IsObject() {
+		fields, err := decodeMemoFields(ext.Get("memoFields").Raw)
+		if err != nil {
+			return "", openwallet.Errorf(ErrMemoInvalidFormat, "memoFields is not a valid json object")
+		}
+		format := ext.Get("memoFormat").String()
+		if len(format) == 0 {
+			format = MemoFormatJSON
+		}
+		encoded, err := EncodeMemo(fields, format)
+		if err != nil {
+			return "", err
+		}
+		note = encoded
+		rawTx.SetExtParam("memo", note)
+	}
+
+	if err := wm.Config.MemoPolicy.Check(to, note); err != nil {
+		return "", err
+	}
+
+	if wm.Config.StructuredMemo && len(note) > 0 {
+		memo, err := ParseMemo(note)
+		if err != nil {
+			return "", err
+		}
+		for k, v := range memoExtParam(memo) {
+			rawTx.SetExtParam(k, v)
+		}
+	}
+
+	return note, nil
+}
+
+//memoExtParam 结构化备注写入扩展参数的字段
+func memoExtParam(memo *Memo) map[string]interface{} {
+	ext := map[string]interface{}{
+		"memo":       memo.Raw,
+		"memoFormat": memo.Format,
+	}
+	if memo.Format != MemoFormatText {
+		ext["memoFields"] = memo.Fields
+	}
+	return ext
+}
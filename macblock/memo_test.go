@@ -0,0 +1,136 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"encoding/json"
+	"github.com/blocktree/openwallet/openwallet"
+	"net/url"
+	"testing"
+)
+
+func TestMemoPolicy_Check(t *testing.T) {
+
+	policy, err := NewMemoPolicy(10, `^[A-Za-z0-9=&]*$`, []string{"MACexchange0000000000000000000"})
+	if err != nil {
+		t.Fatalf("NewMemoPolicy unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		to   string
+		memo string
+		code uint64
+	}{
+		{to: "MACuser00000000000000000000000", memo: ""},
+		{to: "MACuser00000000000000000000000", memo: "uid=1001"},
+		{to: "MACexchange0000000000000000000", memo: "", code: ErrMemoRequired},
+		{to: "MACexchange0000000000000000000", memo: "1001"},
+		{to: "MACuser00000000000000000000000", memo: "12345678901", code: ErrMemoTooLong},
+		{to: "MACuser00000000000000000000000", memo: "a b", code: ErrMemoInvalidCharacter},
+	}
+
+	for _, test := range tests {
+		err := policy.Check(test.to, test.memo)
+		if ErrorCode(err) != test.code {
+			t.Errorf("Check(%s, %q) error = %v, want code %d", test.to, test.memo, err, test.code)
+		}
+	}
+}
+
+func TestParseMemo(t *testing.T) {
+
+	memo, err := ParseMemo(`{"uid":"1001","type":2,"vip":true}`)
+	if err != nil || memo.Format != MemoFormatJSON || memo.Fields["uid"] != "1001" || memo.Field("type") != "2" {
+		t.Errorf("ParseMemo json = %+v, error = %v", memo, err)
+	}
+	if memo.Fields["type"] != json.Number("2") || memo.Fields["vip"] != true {
+		t.Errorf("ParseMemo json = %+v, error = %v", memo, err)
+	}
+
+	memo, err = ParseMemo("uid=1001&type=deposit")
+	if err != nil || memo.Format != MemoFormatKV || memo.Fields["type"] != "deposit" {
+		t.Errorf("ParseMemo kv = %+v, error = %v", memo, err)
+	}
+
+	memo, err = ParseMemo("john")
+	if err != nil || memo.Format != MemoFormatText || len(memo.Fields) != 0 {
+		t.Errorf("ParseMemo text = %+v, error = %v", memo, err)
+	}
+
+	if _, err = ParseMemo(`{"uid":`); ErrorCode(err) != ErrMemoInvalidFormat {
+		t.Errorf("ParseMemo broken json error = %v", err)
+	}
+
+	//不是每一段都是key=value时按普通文本处理
+	for _, text := range []string{"uid=1&type", "aGVsbG8gd29ybGQ=", "a+b=c", "x==y"} {
+		memo, err = ParseMemo(text)
+		if err != nil || memo.Format != MemoFormatText || len(memo.Fields) != 0 {
+			t.Errorf("ParseMemo(%q) = %+v, error = %v; want text", text, memo, err)
+		}
+	}
+
+	memo, err = ParseMemo("uid=1001;type=deposit")
+	if err != nil || memo.Format != MemoFormatKV || memo.Field("uid") != "1001" {
+		t.Errorf("ParseMemo kv with ; = %+v, error = %v", memo, err)
+	}
+
+	encoded, _ := EncodeMemo(map[string]interface{}{"type": "deposit", "uid": json.Number("1001")}, MemoFormatKV)
+	if encoded != "type=deposit&uid=1001" {
+		t.Errorf("EncodeMemo kv = %s", encoded)
+	}
+}
+
+func TestWalletManager_SendTransaction_RejectBeforeCall(t *testing.T) {
+
+	calls := 0
+	wm, cleanup := testNewOfflineWalletManager(t, map[string]testNodeAction{
+		"GetAssetBalanceAds": func(form url.Values) string {
+			calls++
+			return `{"errCode": 0, "AssetBalance": "100"}`
+		},
+	})
+	defer cleanup()
+
+	wm.Config.MemoPolicy, _ = NewMemoPolicy(0, "", []string{"MACexchange0000000000000000000"})
+
+	wallet := &MACWallet{Address: "MACsender000000000000000000000"}
+
+	tests := []struct {
+		to     string
+		amount string
+		memo   string
+		code   uint64
+	}{
+		{to: "MACuser00000000000000000000000", amount: "-1", code: ErrAmountInvalidFormat},
+		{to: "MACuser00000000000000000000000", amount: "0.000000001", code: ErrAmountPrecision},
+		{to: "MACexchange0000000000000000000", amount: "1", code: ErrMemoRequired},
+	}
+
+	for _, test := range tests {
+		rawTx := &openwallet.RawTransaction{
+			To: map[string]string{test.to: test.amount},
+		}
+		rawTx.SetExtParam("memo", test.memo)
+		_, err := wm.SendTransaction(wallet, "1234qwer", rawTx)
+		if ErrorCode(err) != test.code {
+			t.Errorf("SendTransaction(%s, %s) error = %v, want code %d", test.to, test.amount, err, test.code)
+		}
+	}
+
+	if calls > 0 {
+		t.Errorf("SendTransaction called the node %d times before validation passed", calls)
+	}
+}
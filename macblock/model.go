@@ -20,6 +20,7 @@ import (
 	"github.com/blocktree/openwallet/common"
 	"github.com/blocktree/openwallet/crypto"
 	"github.com/blocktree/openwallet/openwallet"
+	"github.com/shopspring/decimal"
 	"github.com/tidwall/gjson"
 )
 
@@ -45,8 +46,66 @@ type cryptoJSON struct {
 	CipherMtSign string `json:"cipherMtSign"`
 }
 
+//AccountBalance 地址余额
+type AccountBalance struct {
+	Address       string
+	AllAsset      decimal.Decimal //总资产
+	AssetBalance  decimal.Decimal //可用余额
+	LockedBalance decimal.Decimal //锁定余额
+	Assetpaifa    decimal.Decimal //派发资产
+}
+
+func NewAccountBalance(address string, json *gjson.Result) (*AccountBalance, error) {
+
+	var err error
+
+	obj := &AccountBalance{}
+	//解析json
+	obj.Address = address
+
+	obj.AssetBalance, err = balanceField(json, "AssetBalance")
+	if err != nil {
+		return nil, err
+	}
+
+	obj.LockedBalance, err = balanceField(json, "LockedBalance")
+	if err != nil {
+		return nil, err
+	}
+
+	obj.Assetpaifa, err = balanceField(json, "Assetpaifa")
+	if err != nil {
+		return nil, err
+	}
+
+	//节点没有返回总资产，由可用和锁定余额累加
+	if len(gjson.Get(json.Raw, "AllAsset").String()) == 0 {
+		obj.AllAsset = obj.AssetBalance.Add(obj.LockedBalance)
+	} else {
+		obj.AllAsset, err = balanceField(json, "AllAsset")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return obj, nil
+}
+
+//balanceField 解析余额字段，空值或null为0
+func balanceField(json *gjson.Result, key string) (decimal.Decimal, error) {
+	value := gjson.Get(json.Raw, key).String()
+	if len(value) == 0 {
+		return decimal.Zero, nil
+	}
+	d, err := decimal.NewFromString(value)
+	if err != nil {
+		return decimal.Zero, fmt.Errorf("%s: '%s' is not a valid decimal", key, value)
+	}
+	return d, nil
+}
+
 type Block struct {
-	Hash              string
+	Hash              string `storm:"index"`
 	Previousblockhash string
 	Height            uint64 `storm:"id"`
 	Time              uint64
@@ -100,6 +159,7 @@ type Transaction struct {
 	Note        string
 	BlockHeight uint64
 	BlockHash   string
+	amountErr   error //金额校验错误
 }
 
 func NewTransaction(json *gjson.Result) *Transaction {
@@ -110,6 +170,13 @@ func NewTransaction(json *gjson.Result) *Transaction {
 	obj.FromToken = gjson.Get(json.Raw, "fromtoken").String()
 	obj.ToToken = gjson.Get(json.Raw, "totoken").String()
 	obj.Amount = gjson.Get(json.Raw, "amount").String()
+	//与发送时相同的金额规则校验，扫描的交易不限制上限
+	amount, err := ParseAmount(obj.Amount, Decimals, decimal.Zero)
+	if err != nil {
+		obj.amountErr = err
+	} else {
+		obj.Amount = amount.String()
+	}
 	obj.Time = gjson.Get(json.Raw, "time").Int()
 	obj.Note = gjson.Get(json.Raw, "note").String()
 
@@ -121,7 +188,13 @@ type UnscanRecord struct {
 	ID          string `storm:"id"` // primary key
 	BlockHeight uint64
 	TxID        string
+	Observer    string //通知失败的观察者，为空时是提取失败
+	Confirmed   bool   //通知失败的是否已确认的交易，重放时按原样通知
 	Reason      string
+	Attempts    int   //失败次数
+	FirstFailAt int64 //首次失败时间
+	LastFailAt  int64 //最近失败时间
+	NextRetryAt int64 //下次允许重扫的时间
 }
 
 func NewUnscanRecord(height uint64, txID, reason string) *UnscanRecord {
@@ -132,3 +205,14 @@ func NewUnscanRecord(height uint64, txID, reason string) *UnscanRecord {
 	obj.ID = common.Bytes2Hex(crypto.SHA256([]byte(fmt.Sprintf("%d_%s", height, txID))))
 	return &obj
 }
+
+//NewObserverUnscanRecord 交易通知指定观察者失败的记录
+func NewObserverUnscanRecord(height uint64, txID, observer, reason string) *UnscanRecord {
+	obj := UnscanRecord{}
+	obj.BlockHeight = height
+	obj.TxID = txID
+	obj.Observer = observer
+	obj.Reason = reason
+	obj.ID = common.Bytes2Hex(crypto.SHA256([]byte(fmt.Sprintf("%d_%s_%s", height, txID, observer))))
+	return &obj
+}
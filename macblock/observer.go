@@ -0,0 +1,35 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"fmt"
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+//NamedObserver 可选的观察者接口，返回稳定的观察者名称，用于按观察者记录通知失败
+//未实现时使用观察者的类型名，同一类型注册多个观察者时需要实现该接口
+type NamedObserver interface {
+	ObserverName() string
+}
+
+//observerName 观察者名称
+func observerName(o openwallet.BlockScanNotificationObject) string {
+	if named, ok := o.(NamedObserver); ok {
+		return named.ObserverName()
+	}
+	return fmt.Sprintf("%T", o)
+}
@@ -0,0 +1,506 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"fmt"
+	"github.com/blocktree/openwallet/openwallet"
+	"sync"
+	"time"
+)
+
+const (
+	ObserverQueueBlock      = "block"      //队列满时阻塞扫描
+	ObserverQueueDropOldest = "dropOldest" //队列满时丢弃最早的事件，记录为观察者的未扫记录
+	ObserverQueueSpill      = "spill"      //队列满时事件留在事件箱，由投递线程从数据库读取
+
+	outboxMaxRetryInterval = time.Minute //通知失败重试间隔的上限
+)
+
+//ObserverQueueMetrics 观察者投递队列的指标
+type ObserverQueueMetrics struct {
+	Observer  string
+	Policy    string
+	QueueLen  int    //队列中的事件数
+	QueueCap  int    //队列容量
+	Acked     uint64 //已确认的最后一个事件
+	Latest    uint64 //事件箱最新的事件
+	Lag       uint64 //未确认的事件数
+	Delivered uint64 //通知成功次数
+	Failed    uint64 //通知失败次数
+	Dropped   uint64 //队列满时丢弃的事件数
+	Spilling  bool   //是否从事件箱读取
+	LastError string
+	LastAckAt int64
+}
+
+//observerQueue 单个观察者的投递队列，一个线程按顺序投递
+type observerQueue struct {
+	bs       *MACBlockScanner
+	observer openwallet.BlockScanNotificationObject
+	name     string
+	policy   string
+	ch       chan *OutboxEvent
+	wake     chan struct{}
+	quit     chan struct{}
+	done     chan struct{}
+	prev     *observerQueue //被替换的同名队列，结束后才开始投递
+
+	mu       sync.Mutex
+	spilling bool   //新事件留在事件箱，由投递线程从数据库读取
+	enqueued uint64 //已放入队列的最后一个事件
+	cursor   ObserverCursor
+	metrics  ObserverQueueMetrics
+}
+
+//newObserverQueue 从观察者的游标开始投递，启动时先从事件箱读取积压的事件
+//prev不为空时等待被替换的队列结束，从它保存的游标继续投递
+func newObserverQueue(bs *MACBlockScanner, o openwallet.BlockScanNotificationObject, cursor ObserverCursor, prev *observerQueue) *observerQueue {
+
+	size := bs.wm.Config.ObserverQueueSize
+	if size <= 0 {
+		size = 1
+	}
+
+	q := &observerQueue{
+		bs:       bs,
+		observer: o,
+		name:     cursor.Observer,
+		policy:   bs.wm.Config.ObserverQueuePolicy,
+		ch:       make(chan *OutboxEvent, size),
+		wake:     make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+		spilling: true,
+		enqueued: cursor.Seq,
+		cursor:   cursor,
+		prev:     prev,
+	}
+
+	go q.run()
+
+	return q
+}
+
+//stop 停止投递线程，wait为true时等待线程结束
+func (q *observerQueue) stop(wait bool) {
+	select {
+	case <-q.quit:
+	default:
+		close(q.quit)
+	}
+	if wait {
+		<-q.done
+	}
+}
+
+//push 放入新事件，只由持有outboxMu的分发线程调用
+func (q *observerQueue) push(event *OutboxEvent) {
+
+	q.mu.Lock()
+	if q.spilling || event.Seq <= q.enqueued {
+		q.mu.Unlock()
+		return
+	}
+	//事件不连续时，中间的事件从事件箱读取
+	if event.Seq != q.enqueued+1 {
+		q.spillLocked()
+		q.mu.Unlock()
+		return
+	}
+	q.mu.Unlock()
+
+	switch q.policy {
+	case ObserverQueueBlock:
+		select {
+		case q.ch <- event:
+		case <-q.quit:
+			return
+		}
+	case ObserverQueueDropOldest:
+		for pushed := false; !pushed; {
+			select {
+			case q.ch <- event:
+				pushed = true
+			default:
+				select {
+				case old := <-q.ch:
+					q.drop(old)
+				default:
+				}
+			}
+		}
+	default:
+		select {
+		case q.ch <- event:
+		default:
+			q.mu.Lock()
+			q.spillLocked()
+			q.mu.Unlock()
+			return
+		}
+	}
+
+	q.mu.Lock()
+	q.enqueued = event.Seq
+	q.mu.Unlock()
+}
+
+//spillLocked 转为从事件箱读取，调用方需持有mu
+func (q *observerQueue) spillLocked() {
+	q.spilling = true
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+//drop 丢弃队列中最早的事件，记录为观察者的未扫记录
+func (q *observerQueue) drop(event *OutboxEvent) {
+
+	q.mu.Lock()
+	q.metrics.Dropped++
+	q.mu.Unlock()
+
+	if q.targeted(event) {
+		q.bs.wm.Log.Std.Warning("observer: %s queue is full, event: %d dropped", q.name, event.Seq)
+		if !event.extract() {
+			//其他事件无法重新提取
+			return
+		}
+		q.bs.recordUnscanFailure(event.unscanRecord(q.name, "dropped by full observer queue"), event.Replay)
+	}
+}
+
+//targeted 事件是否需要投递给该观察者
+func (q *observerQueue) targeted(event *OutboxEvent) bool {
+	return len(event.Observers) == 0 || containsString(event.Observers, q.name)
+}
+
+func (q *observerQueue) run() {
+
+	defer close(q.done)
+
+	if q.prev != nil {
+		select {
+		case <-q.prev.done:
+		case <-q.quit:
+			return
+		}
+		q.prev = nil
+		//被替换的队列可能已确认更多事件
+		var cursor ObserverCursor
+		if err := q.bs.wm.blockChainDB.One("Observer", q.name, &cursor); err == nil {
+			q.mu.Lock()
+			q.cursor = cursor
+			q.enqueued = cursor.Seq
+			q.mu.Unlock()
+		}
+	}
+
+	var backlog []*OutboxEvent
+	for {
+		event := q.next(&backlog)
+		if event == nil {
+			return
+		}
+		if !q.deliver(event) {
+			return
+		}
+	}
+}
+
+//next 取下一个事件，先取队列中的事件，再从事件箱读取溢出的事件，停止时返回nil
+func (q *observerQueue) next(backlog *[]*OutboxEvent) *OutboxEvent {
+
+	for {
+
+		if len(*backlog) > 0 {
+			event := (*backlog)[0]
+			*backlog = (*backlog)[1:]
+			return event
+		}
+
+		select {
+		case event := <-q.ch:
+			return event
+		case <-q.quit:
+			return nil
+		default:
+		}
+
+		q.mu.Lock()
+		spilling := q.spilling
+		seq := q.cursor.Seq
+		q.mu.Unlock()
+
+		if spilling {
+			//持有outboxMu时没有新事件写入，确认事件箱读完后结束溢出
+			q.bs.outboxMu.Lock()
+			events, err := q.bs.GetOutboxEvents(seq, outboxBatchSize)
+			if err == nil && len(events) == 0 {
+				q.mu.Lock()
+				q.spilling = false
+				q.enqueued = seq
+				q.mu.Unlock()
+			}
+			q.bs.outboxMu.Unlock()
+
+			if err != nil {
+				q.bs.wm.Log.Std.Error("observer: %s can not read outbox; unexpected error: %v", q.name, err)
+				if !q.sleep(q.bs.wm.Config.OutboxRetryInterval) {
+					return nil
+				}
+				continue
+			}
+			*backlog = events
+			continue
+		}
+
+		select {
+		case event := <-q.ch:
+			return event
+		case <-q.wake:
+		case <-q.quit:
+			return nil
+		}
+	}
+}
+
+//deliver 通知观察者并确认事件，失败时按间隔重试，停止时返回false
+//连续失败超过上限的事件转为观察者的未扫记录，重放的事件失败时直接累计到未扫记录
+func (q *observerQueue) deliver(event *OutboxEvent) bool {
+
+	if q.targeted(event) {
+
+		interval := q.bs.wm.Config.OutboxRetryInterval
+		for {
+			err := q.notify(event)
+			if err == nil {
+				q.mu.Lock()
+				q.metrics.Delivered++
+				q.mu.Unlock()
+				if event.Replay {
+					q.bs.deleteUnscanRecord(NewObserverUnscanRecord(event.BlockHeight, event.TxID, q.name, "").ID)
+				}
+				break
+			}
+
+			q.bs.wm.Log.Std.Error("observer: %s event: %d notify failed; unexpected error: %v", q.name, event.Seq, err)
+
+			q.mu.Lock()
+			q.metrics.Failed++
+			q.metrics.LastError = err.Error()
+			q.cursor.Attempts++
+			q.cursor.LastError = err.Error()
+			q.cursor.UpdateAt = time.Now().Unix()
+			cursor := q.cursor
+			q.mu.Unlock()
+
+			maxAttempts := q.bs.wm.Config.OutboxMaxAttempts
+			if event.Replay || (maxAttempts > 0 && cursor.Attempts >= maxAttempts) {
+				if !event.extract() {
+					//其他事件无法重新提取，跳过并记录日志，事件内容可通过GetOutboxEvents查询到被清理为止
+					q.bs.wm.Log.Std.Error("observer: %s event: %d %s skipped after %d attempts", q.name, event.Seq, event.Kind, cursor.Attempts)
+					break
+				}
+				//交给未扫记录重试，跳过该事件
+				q.bs.recordUnscanFailure(event.unscanRecord(q.name, err.Error()), event.Replay)
+				break
+			}
+
+			if err := q.bs.wm.blockChainDB.Save(&cursor); err != nil {
+				q.bs.wm.Log.Std.Error("observer: %s cursor save failed; unexpected error: %v", q.name, err)
+			}
+
+			if !q.sleep(interval) {
+				return false
+			}
+			if interval *= 2; interval > outboxMaxRetryInterval {
+				interval = outboxMaxRetryInterval
+			}
+		}
+	}
+
+	//确认事件
+	q.mu.Lock()
+	q.cursor.Seq = event.Seq
+	q.cursor.Attempts = 0
+	q.cursor.LastError = ""
+	q.cursor.UpdateAt = time.Now().Unix()
+	q.metrics.LastAckAt = q.cursor.UpdateAt
+	cursor := q.cursor
+	q.mu.Unlock()
+
+	if err := q.bs.wm.blockChainDB.Save(&cursor); err != nil {
+		q.bs.wm.Log.Std.Error("observer: %s cursor save failed; unexpected error: %v", q.name, err)
+	}
+
+	return true
+}
+
+//notify 按事件类型通知观察者，观察者没有实现对应的接口时视为成功
+func (q *observerQueue) notify(event *OutboxEvent) error {
+	switch event.Kind {
+	case OutboxEventUnattributed:
+		if observer, ok := q.observer.(UnattributedDepositObserver); ok && event.Unattributed != nil {
+			return observer.UnattributedDepositNotify(event.Unattributed)
+		}
+		return nil
+	case OutboxEventFork:
+		if observer, ok := q.observer.(BlockForkObserver); ok && event.Header != nil {
+			return observer.BlockForkNotify(event.Header, event.Reversed)
+		}
+		return nil
+	case OutboxEventUnattributedFork:
+		if observer, ok := q.observer.(UnattributedDepositForkObserver); ok && event.Header != nil {
+			return observer.UnattributedDepositForkNotify(event.Header, event.Deposits)
+		}
+		return nil
+	case OutboxEventReorgAlert:
+		if observer, ok := q.observer.(ReorgAlertObserver); ok && event.Alert != nil {
+			return observer.ReorgAlertNotify(event.Alert)
+		}
+		return nil
+	case OutboxEventDeadLetter:
+		if observer, ok := q.observer.(UnscanDeadLetterObserver); ok && event.DeadLetter != nil {
+			return observer.UnscanDeadLetterNotify(event.DeadLetter)
+		}
+		return nil
+	default:
+		return q.observer.BlockExtractDataNotify(event.SourceKey, event.Data)
+	}
+}
+
+//sleep 等待d，停止时返回false
+func (q *observerQueue) sleep(d time.Duration) bool {
+	if d <= 0 {
+		d = time.Millisecond
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-q.quit:
+		return false
+	}
+}
+
+//acked 已确认的最后一个事件
+func (q *observerQueue) acked() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.cursor.Seq
+}
+
+//snapshot 队列指标
+func (q *observerQueue) snapshot(latest uint64) *ObserverQueueMetrics {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	m := q.metrics
+	m.Observer = q.name
+	m.Policy = q.policy
+	m.QueueLen = len(q.ch)
+	m.QueueCap = cap(q.ch)
+	m.Acked = q.cursor.Seq
+	m.Latest = latest
+	if latest > m.Acked {
+		m.Lag = latest - m.Acked
+	}
+	m.Spilling = q.spilling
+	if len(m.LastError) == 0 {
+		m.LastError = q.cursor.LastError
+	}
+	return &m
+}
+
+//ObserverQueueMetrics 获取每个观察者投递队列的指标
+func (bs *MACBlockScanner) ObserverQueueMetrics() []*ObserverQueueMetrics {
+
+	bs.queuesMu.Lock()
+	defer bs.queuesMu.Unlock()
+
+	latest := bs.outboxLatest()
+	list := make([]*ObserverQueueMetrics, 0, len(bs.queues))
+	for _, q := range bs.queues {
+		list = append(list, q.snapshot(latest))
+	}
+	return list
+}
+
+//CloseBlockScanner 关闭扫描器，停止观察者的投递线程
+func (bs *MACBlockScanner) CloseBlockScanner() error {
+	bs.stopObserverQueues()
+	return bs.BlockScannerBase.CloseBlockScanner()
+}
+
+//RemoveObserver 移除观测者，等待其投递线程结束，游标保留
+//游标未删除时事件箱保留该观察者未确认的事件，不再注册的观察者需要调用DeleteObserverCursor
+func (bs *MACBlockScanner) RemoveObserver(obj openwallet.BlockScanNotificationObject) error {
+
+	if err := bs.BlockScannerBase.RemoveObserver(obj); err != nil {
+		return err
+	}
+
+	bs.queuesMu.Lock()
+	name := observerName(obj)
+	q, ok := bs.queues[name]
+	if ok && q.observer == obj {
+		delete(bs.queues, name)
+	}
+	bs.queuesMu.Unlock()
+
+	if ok && q.observer == obj {
+		q.stop(true)
+	}
+	return nil
+}
+
+//DeleteObserverCursor 删除不再注册的观察者的游标，事件箱不再为它保留事件
+func (bs *MACBlockScanner) DeleteObserverCursor(name string) error {
+
+	bs.outboxMu.Lock()
+	defer bs.outboxMu.Unlock()
+
+	for _, o := range bs.observerSnapshot() {
+		if observerName(o) == name {
+			return fmt.Errorf("observer: %s is registered, remove it first", name)
+		}
+	}
+
+	err := bs.wm.blockChainDB.DeleteStruct(&ObserverCursor{Observer: name})
+	if err != nil {
+		return err
+	}
+
+	bs.pruneOutbox()
+	return nil
+}
+
+//stopObserverQueues 停止全部投递线程
+func (bs *MACBlockScanner) stopObserverQueues() {
+
+	bs.queuesMu.Lock()
+	queues := bs.queues
+	bs.queues = nil
+	bs.queuesMu.Unlock()
+
+	for _, q := range queues {
+		q.stop(true)
+	}
+}
@@ -0,0 +1,204 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"fmt"
+	"github.com/blocktree/openwallet/openwallet"
+	"sync"
+	"testing"
+	"time"
+)
+
+//testSlowObserver 第一次通知后等待gate关闭才返回
+type testSlowObserver struct {
+	name     string
+	gate     chan struct{}
+	entered  chan struct{}
+	mu       sync.Mutex
+	received []string
+}
+
+func newTestSlowObserver(name string) *testSlowObserver {
+	return &testSlowObserver{name: name, gate: make(chan struct{}), entered: make(chan struct{}, 1)}
+}
+
+func (o *testSlowObserver) ObserverName() string {
+	return o.name
+}
+
+func (o *testSlowObserver) BlockScanNotify(header *openwallet.BlockHeader) error {
+	return nil
+}
+
+func (o *testSlowObserver) BlockExtractDataNotify(sourceKey string, data *openwallet.TxExtractData) error {
+	select {
+	case o.entered <- struct{}{}:
+	default:
+	}
+	<-o.gate
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.received = append(o.received, data.Transaction.TxID)
+	return nil
+}
+
+func (o *testSlowObserver) wait(t *testing.T) {
+	t.Helper()
+	select {
+	case <-o.entered:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("observer %s was not notified", o.name)
+	}
+}
+
+func (o *testSlowObserver) txIDs() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return fmt.Sprint(o.received)
+}
+
+//testObserverQueueScanner 创建扫描器，启动观察者的投递队列并等待读完事件箱
+func testObserverQueueScanner(t *testing.T, policy string, size int, observers ...openwallet.BlockScanNotificationObject) (*MACBlockScanner, func(from, to int), func()) {
+
+	wm, cleanup := testNewOfflineWalletManager(t, nil)
+	wm.Config.ObserverQueuePolicy = policy
+	wm.Config.ObserverQueueSize = size
+
+	bs := wm.Blockscanner.(*MACBlockScanner)
+	for _, o := range observers {
+		bs.AddObserver(o)
+	}
+	bs.dispatchOutbox()
+	testWaitObserverMetrics(t, bs, func(m *ObserverQueueMetrics) bool {
+		return !m.Spilling
+	})
+
+	notify := func(from, to int) {
+		for i := from; i <= to; i++ {
+			data := &openwallet.TxExtractData{Transaction: &openwallet.Transaction{TxID: fmt.Sprintf("0x%d", i), BlockHeight: uint64(i)}}
+			if err := bs.newExtractDataNotify(uint64(i), map[string]*openwallet.TxExtractData{"user": data}, nil, false); err != nil {
+				t.Fatalf("newExtractDataNotify unexpected error: %v", err)
+			}
+		}
+	}
+	return bs, notify, cleanup
+}
+
+func TestObserverQueue_Spill(t *testing.T) {
+
+	slow := newTestSlowObserver("slow")
+	fast := &testNamedObserver{name: "fast", failures: map[string]int{}}
+	bs, notify, cleanup := testObserverQueueScanner(t, ObserverQueueSpill, 2, slow, fast)
+	defer cleanup()
+
+	notify(1, 1)
+	slow.wait(t)
+	notify(2, 10)
+
+	//慢的观察者不影响其他观察者
+	testWaitObserverMetrics(t, bs, func(m *ObserverQueueMetrics) bool {
+		return m.Observer == "slow" || m.Lag == 0
+	})
+	if fmt.Sprint(fast.received) != "[0x1 0x2 0x3 0x4 0x5 0x6 0x7 0x8 0x9 0x10]" {
+		t.Errorf("fast received = %v", fast.received)
+	}
+
+	for _, m := range bs.ObserverQueueMetrics() {
+		if m.Observer == "slow" && (!m.Spilling || m.Lag != 10 || m.QueueLen != 2 || m.Latest != 10) {
+			t.Errorf("slow observer metrics = %+v", *m)
+		}
+	}
+
+	//溢出的事件从事件箱按顺序读取
+	close(slow.gate)
+	testWaitObserverQueues(t, bs)
+	if slow.txIDs() != "[0x1 0x2 0x3 0x4 0x5 0x6 0x7 0x8 0x9 0x10]" {
+		t.Errorf("slow received = %v", slow.txIDs())
+	}
+	for _, m := range bs.ObserverQueueMetrics() {
+		if m.Spilling || m.Delivered != 10 || m.Dropped != 0 {
+			t.Errorf("observer metrics after catch up = %+v", *m)
+		}
+	}
+}
+
+func TestObserverQueue_DropOldest(t *testing.T) {
+
+	slow := newTestSlowObserver("slow")
+	bs, notify, cleanup := testObserverQueueScanner(t, ObserverQueueDropOldest, 2, slow)
+	defer cleanup()
+
+	notify(1, 1)
+	slow.wait(t)
+	notify(2, 6)
+
+	close(slow.gate)
+	testWaitObserverQueues(t, bs)
+
+	if slow.txIDs() != "[0x1 0x5 0x6]" {
+		t.Errorf("slow received = %v, want [0x1 0x5 0x6]", slow.txIDs())
+	}
+	if metrics := bs.ObserverQueueMetrics(); len(metrics) != 1 || metrics[0].Dropped != 3 {
+		t.Errorf("observer metrics = %+v", metrics)
+	}
+
+	//丢弃的事件记录为观察者的未扫记录
+	records, _ := bs.ListUnscanRecords(UnscanRecordQuery{Observer: "slow"})
+	dropped := make([]string, 0)
+	for _, r := range records {
+		dropped = append(dropped, r.TxID)
+	}
+	if fmt.Sprint(dropped) != "[0x2 0x3 0x4]" {
+		t.Errorf("unscan records = %v, want [0x2 0x3 0x4]", dropped)
+	}
+}
+
+func TestObserverQueue_Block(t *testing.T) {
+
+	slow := newTestSlowObserver("slow")
+	bs, notify, cleanup := testObserverQueueScanner(t, ObserverQueueBlock, 1, slow)
+	defer cleanup()
+
+	notify(1, 1)
+	slow.wait(t)
+	notify(2, 2)
+
+	//队列满时阻塞扫描，直到观察者处理完
+	done := make(chan struct{})
+	go func() {
+		notify(3, 3)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("notify should block while the observer queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(slow.gate)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("notify was not released")
+	}
+
+	testWaitObserverQueues(t, bs)
+	if slow.txIDs() != "[0x1 0x2 0x3]" {
+		t.Errorf("slow received = %v, want [0x1 0x2 0x3]", slow.txIDs())
+	}
+}
@@ -0,0 +1,377 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/openwallet/openwallet"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+const (
+	outboxBatchSize     = 100  //每次读取的事件数
+	outboxPruneInterval = 100  //每保存多少次事件清理一次事件箱，扫描任务开始时也会清理
+	outboxPruneLimit    = 1000 //每次清理的最大事件数，避免长时间持有outboxMu
+)
+
+//事件箱的事件类型
+const (
+	OutboxEventExtract      = "extract"      //提取结果，通知BlockExtractDataNotify，旧版本的事件类型为空
+	OutboxEventUnattributed = "unattributed" //无法归属的充值，通知UnattributedDepositObserver
+	OutboxEventFork         = "fork"         //分叉区块需要回滚的提取结果，通知BlockForkObserver
+	OutboxEventReorgAlert   = "reorgAlert"   //分叉无法自动回滚，通知ReorgAlertObserver
+	OutboxEventDeadLetter   = "deadLetter"   //未扫记录进入死信，通知UnscanDeadLetterObserver
+
+	OutboxEventUnattributedFork = "unattributedFork" //分叉区块需要回滚的无法归属充值，通知UnattributedDepositForkObserver
+)
+
+//OutboxEvent 待通知观察者的事件，先持久化再投递
+type OutboxEvent struct {
+	Seq          uint64 `storm:"id,increment"`
+	Kind         string
+	BlockHeight  uint64 `storm:"index"`
+	TxID         string
+	SourceKey    string
+	Observers    []string //只投递给指定的观察者，为空时投递给全部观察者
+	Replay       bool     //是否重放的失败记录
+	Data         *openwallet.TxExtractData
+	Unattributed *UnattributedDeposit
+	Header       *openwallet.BlockHeader //被分叉的区块
+	Reversed     []*ExtractedTransaction //被分叉的区块需要回滚的提取结果
+	Deposits     []*UnattributedDeposit  //被分叉的区块需要回滚的无法归属充值
+	Alert        *ReorgAlert
+	DeadLetter   *DeadUnscanRecord
+	CreateAt     int64
+}
+
+//extract 是否提取结果事件，只有提取结果可以转为未扫记录重新提取
+func (event *OutboxEvent) extract() bool {
+	return len(event.Kind) == 0 || event.Kind == OutboxEventExtract
+}
+
+//unscanRecord 提取结果通知观察者失败的未扫记录，记录通知的是否已确认的交易
+func (event *OutboxEvent) unscanRecord(observer, reason string) *UnscanRecord {
+	record := NewObserverUnscanRecord(event.BlockHeight, event.TxID, observer, reason)
+	record.Confirmed = extractDataConfirmed(event.Data)
+	return record
+}
+
+//ObserverCursor 观察者已确认的事件位置
+type ObserverCursor struct {
+	Observer  string `storm:"id"`
+	Seq       uint64 //已确认的最后一个事件
+	Attempts  int    //下一个事件连续失败次数
+	LastError string
+	UpdateAt  int64
+}
+
+//AddObserver 添加观测者，新的观察者从当前事件之后开始投递
+//观察者按名称记录游标，名称与已注册的其他观察者相同时返回错误
+func (bs *MACBlockScanner) AddObserver(obj openwallet.BlockScanNotificationObject) error {
+
+	if obj == nil {
+		return nil
+	}
+
+	bs.outboxMu.Lock()
+	defer bs.outboxMu.Unlock()
+
+	name := observerName(obj)
+	for _, o := range bs.observerSnapshot() {
+		if o != obj && observerName(o) == name {
+			return fmt.Errorf("observer name: %s is already registered, implement ObserverName to tell them apart", name)
+		}
+	}
+
+	//数据库未加载时，游标在首次投递时创建
+	if bs.wm.blockChainDB != nil {
+		if _, err := bs.loadObserverCursor(name); err != nil {
+			return err
+		}
+	}
+
+	//持有outboxMu，名称检查和注册之间没有其他观察者加入
+	return bs.BlockScannerBase.AddObserver(obj)
+}
+
+//loadObserverCursor 读取观察者的游标，没有时从最新事件开始，调用方需持有outboxMu
+func (bs *MACBlockScanner) loadObserverCursor(name string) (ObserverCursor, error) {
+
+	var cursor ObserverCursor
+	err := bs.wm.blockChainDB.One("Observer", name, &cursor)
+	if err != storm.ErrNotFound {
+		return cursor, err
+	}
+
+	cursor = ObserverCursor{Observer: name, Seq: bs.outboxLatest(), UpdateAt: time.Now().Unix()}
+	return cursor, bs.wm.blockChainDB.Save(&cursor)
+}
+
+//outboxLatest 事件箱最新的事件
+func (bs *MACBlockScanner) outboxLatest() uint64 {
+	var last OutboxEvent
+	bs.wm.blockChainDB.Select().OrderBy("Seq").Reverse().First(&last)
+	return last.Seq
+}
+
+//publishOutbox 保存提取结果到事件箱，再放入每个观察者的投递队列
+func (bs *MACBlockScanner) publishOutbox(height uint64, extractData map[string]*openwallet.TxExtractData, observers []string, replay bool) error {
+	return bs.publishOutboxEvents(extractEvents(height, extractData, observers, replay)...)
+}
+
+//extractEvents 提取结果的事件
+func extractEvents(height uint64, extractData map[string]*openwallet.TxExtractData, observers []string, replay bool) []*OutboxEvent {
+
+	events := make([]*OutboxEvent, 0, len(extractData))
+	for key, data := range extractData {
+		event := &OutboxEvent{
+			Kind:        OutboxEventExtract,
+			BlockHeight: height,
+			SourceKey:   key,
+			Observers:   observers,
+			Replay:      replay,
+			Data:        data,
+		}
+		if data.Transaction != nil {
+			event.TxID = data.Transaction.TxID
+		}
+		events = append(events, event)
+	}
+
+	return events
+}
+
+//publishOutboxEvents 保存事件到事件箱，再放入每个观察者的投递队列
+func (bs *MACBlockScanner) publishOutboxEvents(events ...*OutboxEvent) error {
+	return bs.publishOutboxWith(nil, events...)
+}
+
+//publishOutboxWith 在同一个数据库事务中保存记录和事件，再放入每个观察者的投递队列
+//用于标记已通知的记录，不会出现已通知但没有标记，或已标记但没有通知
+func (bs *MACBlockScanner) publishOutboxWith(records []interface{}, events ...*OutboxEvent) error {
+
+	bs.outboxMu.Lock()
+	defer bs.outboxMu.Unlock()
+
+	if err := bs.appendOutbox(events, records); err != nil {
+		return err
+	}
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	for _, q := range bs.ensureObserverQueues() {
+		for _, event := range events {
+			q.push(event)
+		}
+	}
+
+	bs.outboxPublished++
+	if bs.outboxPublished >= outboxPruneInterval {
+		bs.outboxPublished = 0
+		bs.pruneOutbox()
+	}
+
+	return nil
+}
+
+//appendOutbox 保存事件到事件箱，records在同一个事务中保存，调用方需持有outboxMu
+func (bs *MACBlockScanner) appendOutbox(events []*OutboxEvent, records []interface{}) error {
+
+	tx, err := bs.wm.blockChainDB.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, record := range records {
+		if err := tx.Save(record); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now().Unix()
+	for _, event := range events {
+		event.CreateAt = now
+		if err := tx.Save(event); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+//observerSnapshot 当前注册的观察者
+func (bs *MACBlockScanner) observerSnapshot() []openwallet.BlockScanNotificationObject {
+	bs.Mu.RLock()
+	defer bs.Mu.RUnlock()
+	list := make([]openwallet.BlockScanNotificationObject, 0, len(bs.Observers))
+	for o := range bs.Observers {
+		list = append(list, o)
+	}
+	return list
+}
+
+//dispatchOutbox 为注册的观察者启动投递队列，继续投递事件箱中未确认的事件
+func (bs *MACBlockScanner) dispatchOutbox() {
+
+	bs.outboxMu.Lock()
+	defer bs.outboxMu.Unlock()
+
+	bs.ensureObserverQueues()
+	bs.pruneOutbox()
+}
+
+//ensureObserverQueues 为新的观察者创建投递队列，停止已移除的观察者的队列，调用方需持有outboxMu
+func (bs *MACBlockScanner) ensureObserverQueues() []*observerQueue {
+
+	observers := bs.observerSnapshot()
+
+	bs.queuesMu.Lock()
+	defer bs.queuesMu.Unlock()
+
+	if bs.queues == nil {
+		bs.queues = make(map[string]*observerQueue)
+	}
+
+	registered := make(map[string]bool, len(observers))
+	for _, o := range observers {
+		name := observerName(o)
+		registered[name] = true
+		prev, ok := bs.queues[name]
+		if ok && prev.observer == o {
+			continue
+		} else if ok {
+			//持有outboxMu时不能等待，旧队列的线程可能在等待outboxMu，由新队列等待它结束
+			prev.stop(false)
+		}
+
+		cursor, err := bs.loadObserverCursor(name)
+		if err != nil {
+			bs.wm.Log.Std.Error("observer: %s can not load cursor; unexpected error: %v", name, err)
+			delete(bs.queues, name)
+			continue
+		}
+		bs.queues[name] = newObserverQueue(bs, o, cursor, prev)
+	}
+
+	list := make([]*observerQueue, 0, len(bs.queues))
+	for name, q := range bs.queues {
+		if !registered[name] {
+			q.stop(false)
+			delete(bs.queues, name)
+			continue
+		}
+		list = append(list, q)
+	}
+	return list
+}
+
+//pruneOutbox 清理全部观察者已确认的事件，调用方需持有outboxMu
+//按保存的游标计算，已移除但游标保留的观察者重新注册后可以继续投递
+func (bs *MACBlockScanner) pruneOutbox() {
+
+	cursors, err := bs.GetObserverCursors()
+	if err != nil {
+		bs.wm.Log.Std.Error("outbox prune failed; unexpected error: %v", err)
+		return
+	}
+
+	var (
+		minSeq uint64
+		first  = true
+	)
+	for _, c := range cursors {
+		if first || c.Seq < minSeq {
+			minSeq = c.Seq
+			first = false
+		}
+	}
+
+	if first || minSeq == 0 {
+		return
+	}
+
+	if err := bs.deleteOutboxBefore(minSeq, outboxPruneLimit); err != nil {
+		bs.wm.Log.Std.Error("outbox prune failed; unexpected error: %v", err)
+	}
+}
+
+//deleteOutboxBefore 按主键顺序删除seq及之前的事件，最多删除limit个
+//事件的主键是大端编码的自增序号，从游标开头读到seq为止，不需要扫描整个事件箱
+func (bs *MACBlockScanner) deleteOutboxBefore(seq uint64, limit int) error {
+
+	db := bs.wm.blockChainDB
+	return db.Bolt.Update(func(tx *bolt.Tx) error {
+
+		bucket := db.GetBucket(tx, "OutboxEvent")
+		if bucket == nil {
+			return nil
+		}
+
+		seqs := make([]uint64, 0, limit)
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil && len(seqs) < limit; k, v = c.Next() {
+			//索引和元数据保存在子bucket中，主键为8字节
+			if v == nil || len(k) != 8 {
+				continue
+			}
+			s := binary.BigEndian.Uint64(k)
+			if s > seq {
+				break
+			}
+			seqs = append(seqs, s)
+		}
+
+		node := db.WithTransaction(tx)
+		for _, s := range seqs {
+			//按主键删除，同时清理索引
+			if err := node.DeleteStruct(&OutboxEvent{Seq: s}); err != nil && err != storm.ErrNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+//GetObserverCursors 获取全部观察者的投递位置
+func (bs *MACBlockScanner) GetObserverCursors() ([]*ObserverCursor, error) {
+	var list []*ObserverCursor
+	err := bs.wm.blockChainDB.All(&list)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return list, nil
+}
+
+//GetOutboxEvents 获取事件箱中seq之后的事件
+func (bs *MACBlockScanner) GetOutboxEvents(seq uint64, limit int) ([]*OutboxEvent, error) {
+	var list []*OutboxEvent
+	query := bs.wm.blockChainDB.Select(q.Gt("Seq", seq)).OrderBy("Seq")
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	err := query.Find(&list)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return list, nil
+}
@@ -0,0 +1,243 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"fmt"
+	"github.com/blocktree/openwallet/openwallet"
+	"testing"
+	"time"
+)
+
+//testWaitObserverQueues 等待全部观察者确认事件箱中的事件并读完溢出
+func testWaitObserverQueues(t *testing.T, bs *MACBlockScanner) {
+	t.Helper()
+	testWaitObserverMetrics(t, bs, func(m *ObserverQueueMetrics) bool {
+		return m.Lag == 0 && m.QueueLen == 0 && !m.Spilling
+	})
+}
+
+//testWaitObserverMetrics 等待每个观察者的队列指标满足条件
+func testWaitObserverMetrics(t *testing.T, bs *MACBlockScanner, done func(m *ObserverQueueMetrics) bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ok := true
+		metrics := bs.ObserverQueueMetrics()
+		for _, m := range metrics {
+			if !done(m) {
+				ok = false
+			}
+		}
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			list := make([]ObserverQueueMetrics, 0, len(metrics))
+			for _, m := range metrics {
+				list = append(list, *m)
+			}
+			t.Fatalf("observer queues not settled: %+v", list)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMACBlockScanner_OutboxDelivery(t *testing.T) {
+
+	wm, cleanup := testNewOfflineWalletManager(t, nil)
+	defer cleanup()
+
+	bs := wm.Blockscanner.(*MACBlockScanner)
+	wallet := &testNamedObserver{name: "wallet", failures: map[string]int{"0x2": 1000}}
+	audit := &testNamedObserver{name: "audit", failures: map[string]int{}}
+	bs.AddObserver(wallet)
+	bs.AddObserver(audit)
+
+	notify := func(height uint64, txID string) {
+		data := &openwallet.TxExtractData{Transaction: &openwallet.Transaction{TxID: txID, BlockHeight: height}}
+		if err := bs.newExtractDataNotify(height, map[string]*openwallet.TxExtractData{"user": data}, nil, false); err != nil {
+			t.Fatalf("newExtractDataNotify unexpected error: %v", err)
+		}
+	}
+	notify(10, "0x1")
+	notify(11, "0x2")
+	notify(12, "0x3")
+
+	//失败的观察者停在失败的事件，其他观察者不受影响
+	testWaitObserverMetrics(t, bs, func(m *ObserverQueueMetrics) bool {
+		if m.Observer == "wallet" {
+			return m.Acked == 1 && m.Failed >= 2
+		}
+		return m.Lag == 0
+	})
+	bs.stopObserverQueues()
+
+	if fmt.Sprint(wallet.received) != "[0x1]" {
+		t.Errorf("wallet received = %v, want [0x1]", wallet.received)
+	}
+	if fmt.Sprint(audit.received) != "[0x1 0x2 0x3]" {
+		t.Errorf("audit received = %v, want [0x1 0x2 0x3]", audit.received)
+	}
+
+	cursors, _ := bs.GetObserverCursors()
+	positions := make(map[string]string)
+	for _, c := range cursors {
+		positions[c.Observer] = fmt.Sprint(c.Seq)
+		if c.Observer == "wallet" && c.Attempts < 2 {
+			t.Errorf("wallet cursor attempts = %d, want at least 2", c.Attempts)
+		}
+	}
+	if positions["wallet"] != "1" || positions["audit"] != "3" {
+		t.Errorf("observer cursors = %v", positions)
+	}
+
+	//重启后从游标继续投递，已确认的事件不重复
+	restarted := NewMACBlockScanner(wm)
+	defer restarted.stopObserverQueues()
+	wallet2 := &testNamedObserver{name: "wallet", failures: map[string]int{}}
+	audit2 := &testNamedObserver{name: "audit", failures: map[string]int{}}
+	late := &testNamedObserver{name: "late", failures: map[string]int{}}
+	restarted.AddObserver(wallet2)
+	restarted.AddObserver(audit2)
+	restarted.AddObserver(late)
+	restarted.dispatchOutbox()
+
+	//全部观察者已确认的事件被清理
+	events, _ := restarted.GetOutboxEvents(0, 0)
+	if len(events) != 2 || events[0].TxID != "0x2" || events[1].TxID != "0x3" {
+		t.Errorf("outbox events = %+v", events)
+	}
+
+	testWaitObserverQueues(t, restarted)
+
+	if fmt.Sprint(wallet2.received) != "[0x2 0x3]" {
+		t.Errorf("wallet received after restart = %v, want [0x2 0x3]", wallet2.received)
+	}
+	if len(audit2.received) != 0 || len(late.received) != 0 {
+		t.Errorf("audit received = %v, late received = %v after restart, want none", audit2.received, late.received)
+	}
+	restarted.dispatchOutbox()
+	if events, _ := restarted.GetOutboxEvents(0, 0); len(events) != 0 {
+		t.Errorf("outbox events after delivery = %+v", events)
+	}
+}
+
+func TestMACBlockScanner_ObserverRegistration(t *testing.T) {
+
+	wm, cleanup := testNewOfflineWalletManager(t, nil)
+	defer cleanup()
+
+	bs := wm.Blockscanner.(*MACBlockScanner)
+	defer bs.stopObserverQueues()
+	wallet := &testNamedObserver{name: "wallet", failures: map[string]int{}}
+	audit := &testNamedObserver{name: "audit", failures: map[string]int{}}
+	bs.AddObserver(wallet)
+	bs.AddObserver(audit)
+
+	//同名的其他观察者不能注册
+	if err := bs.AddObserver(&testNamedObserver{name: "wallet"}); err == nil {
+		t.Errorf("AddObserver with a duplicate name should fail")
+	}
+	if err := bs.AddObserver(wallet); err != nil {
+		t.Errorf("AddObserver of the same observer unexpected error: %v", err)
+	}
+
+	notify := func(height uint64, txID string) {
+		data := &openwallet.TxExtractData{Transaction: &openwallet.Transaction{TxID: txID, BlockHeight: height}}
+		if err := bs.newExtractDataNotify(height, map[string]*openwallet.TxExtractData{"user": data}, nil, false); err != nil {
+			t.Fatalf("newExtractDataNotify unexpected error: %v", err)
+		}
+	}
+	notify(10, "0x1")
+	testWaitObserverQueues(t, bs)
+
+	//移除的观察者游标保留，事件箱保留它未确认的事件
+	if err := bs.RemoveObserver(audit); err != nil {
+		t.Fatalf("RemoveObserver unexpected error: %v", err)
+	}
+	notify(11, "0x2")
+	notify(12, "0x3")
+	testWaitObserverQueues(t, bs)
+	bs.dispatchOutbox()
+
+	if events, _ := bs.GetOutboxEvents(0, 0); len(events) != 2 || events[0].TxID != "0x2" {
+		t.Errorf("outbox events = %+v, want events kept for the removed observer", events)
+	}
+
+	//重新注册的同名观察者从游标继续投递
+	audit2 := &testNamedObserver{name: "audit", failures: map[string]int{}}
+	if err := bs.AddObserver(audit2); err != nil {
+		t.Fatalf("AddObserver unexpected error: %v", err)
+	}
+	bs.dispatchOutbox()
+	testWaitObserverQueues(t, bs)
+	if fmt.Sprint(audit2.received) != "[0x2 0x3]" {
+		t.Errorf("audit received after register again = %v, want [0x2 0x3]", audit2.received)
+	}
+
+	//删除游标后不再为该观察者保留事件
+	bs.RemoveObserver(audit2)
+	notify(13, "0x4")
+	testWaitObserverQueues(t, bs)
+	if err := bs.DeleteObserverCursor("wallet"); err == nil {
+		t.Errorf("DeleteObserverCursor of a registered observer should fail")
+	}
+	if err := bs.DeleteObserverCursor("audit"); err != nil {
+		t.Fatalf("DeleteObserverCursor unexpected error: %v", err)
+	}
+	if events, _ := bs.GetOutboxEvents(0, 0); len(events) != 0 {
+		t.Errorf("outbox events after cursor deleted = %+v", events)
+	}
+}
+
+func TestMACBlockScanner_DeleteOutboxBefore(t *testing.T) {
+
+	wm, cleanup := testNewOfflineWalletManager(t, nil)
+	defer cleanup()
+
+	bs := wm.Blockscanner.(*MACBlockScanner)
+	for i := 1; i <= 5; i++ {
+		event := &OutboxEvent{Kind: OutboxEventExtract, BlockHeight: uint64(i), TxID: fmt.Sprintf("0x%d", i)}
+		if err := bs.publishOutboxEvents(event); err != nil {
+			t.Fatalf("publishOutboxEvents unexpected error: %v", err)
+		}
+	}
+
+	//每次最多删除limit个，按序号从小到大删除
+	if err := bs.deleteOutboxBefore(4, 2); err != nil {
+		t.Fatalf("deleteOutboxBefore unexpected error: %v", err)
+	}
+	if events, _ := bs.GetOutboxEvents(0, 0); len(events) != 3 || events[0].TxID != "0x3" {
+		t.Errorf("outbox events = %+v, want 3 events from 0x3", events)
+	}
+
+	if err := bs.deleteOutboxBefore(4, outboxPruneLimit); err != nil {
+		t.Fatalf("deleteOutboxBefore unexpected error: %v", err)
+	}
+	if events, _ := bs.GetOutboxEvents(0, 0); len(events) != 1 || events[0].TxID != "0x5" {
+		t.Errorf("outbox events = %+v, want 0x5 only", events)
+	}
+
+	//删除的事件同时清理索引
+	var list []*OutboxEvent
+	if err := wm.blockChainDB.Find("BlockHeight", uint64(4), &list); err == nil {
+		t.Errorf("index of deleted event = %+v", list)
+	}
+	if err := wm.blockChainDB.Find("BlockHeight", uint64(5), &list); err != nil || len(list) != 1 {
+		t.Errorf("index of kept event = %+v, error: %v", list, err)
+	}
+}
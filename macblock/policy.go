@@ -0,0 +1,368 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"fmt"
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/openwallet/common"
+	"github.com/blocktree/openwallet/crypto"
+	"github.com/shopspring/decimal"
+	"time"
+)
+
+const (
+	policyBucket      = "policy" // transfer policy dataset
+	transferPolicyKey = "transferPolicy"
+
+	//PolicyAnyAddress 限额表中适用于所有地址的默认项
+	PolicyAnyAddress = "*"
+)
+
+//策略规则名称，拒绝时通过PolicyError.Rule返回
+const (
+	PolicyRuleDenyList                  = "denyList"
+	PolicyRuleAllowList                 = "allowList"
+	PolicyRuleTimeWindow                = "timeWindow"
+	PolicyRuleWalletPerTransaction      = "wallet.perTransaction"
+	PolicyRuleWalletPerDay              = "wallet.perDay"
+	PolicyRuleWalletPerWindow           = "wallet.perWindow"
+	PolicyRuleDestinationPerTransaction = "destination.perTransaction"
+	PolicyRuleDestinationPerDay         = "destination.perDay"
+	PolicyRuleDestinationPerWindow      = "destination.perWindow"
+)
+
+//PolicyError 策略拒绝错误，Rule为未通过的规则
+type PolicyError struct {
+	Rule    string
+	Message string
+}
+
+//Error 错误信息
+func (err *PolicyError) Error() string {
+	return fmt.Sprintf("[%d]%s: %s", ErrPolicyRejected, err.Rule, err.Message)
+}
+
+//Code 错误码
+func (err *PolicyError) Code() uint64 {
+	return ErrPolicyRejected
+}
+
+//TransferLimit 转账限额，为0的项不限制
+type TransferLimit struct {
+	PerTransaction decimal.Decimal `json:"perTransaction"` //单笔上限
+	PerDay         decimal.Decimal `json:"perDay"`         //自然日累计上限
+	PerWindow      decimal.Decimal `json:"perWindow"`      //滚动窗口累计上限
+	Window         int64           `json:"window"`         //滚动窗口秒数
+}
+
+//TransferPolicy 转账策略，在提交AssetTransferMN2前检查
+type TransferPolicy struct {
+	Enabled           bool                      `json:"enabled"`
+	WalletLimits      map[string]*TransferLimit `json:"walletLimits"`      //发送地址限额，key为地址或PolicyAnyAddress
+	DestinationLimits map[string]*TransferLimit `json:"destinationLimits"` //目标地址限额，key为地址或PolicyAnyAddress
+	AllowList         []string                  `json:"allowList"`         //目标地址白名单，不为空时只允许白名单
+	DenyList          []string                  `json:"denyList"`          //目标地址黑名单
+	AllowedFrom       string                    `json:"allowedFrom"`       //允许转账的开始时间，格式HH:MM，本地时间
+	AllowedTo         string                    `json:"allowedTo"`         //允许转账的结束时间，格式HH:MM，本地时间
+}
+
+//NewTransferPolicy 创建空策略
+func NewTransferPolicy() *TransferPolicy {
+	return &TransferPolicy{
+		WalletLimits:      make(map[string]*TransferLimit),
+		DestinationLimits: make(map[string]*TransferLimit),
+		AllowList:         make([]string, 0),
+		DenyList:          make([]string, 0),
+	}
+}
+
+//TransferUsage 策略限额计数，每笔通过检查的转账记录一条
+type TransferUsage struct {
+	ID     string `storm:"id"` // primary key
+	From   string `storm:"index"`
+	To     string `storm:"index"`
+	Amount decimal.Decimal
+	Time   int64 `storm:"index"`
+	TxID   string
+}
+
+func NewTransferUsage(from, to string, amount decimal.Decimal, now time.Time) *TransferUsage {
+	obj := TransferUsage{}
+	obj.From = from
+	obj.To = to
+	obj.Amount = amount
+	obj.Time = now.Unix()
+	obj.ID = common.Bytes2Hex(crypto.SHA256([]byte(fmt.Sprintf("%s_%s_%s_%d_%s", from, to, amount.String(), now.UnixNano(), randSeq(8)))))
+	return &obj
+}
+
+//GetTransferPolicy 获取本地保存的转账策略
+func (wm *WalletManager) GetTransferPolicy() (*TransferPolicy, error) {
+
+	policy := NewTransferPolicy()
+	err := wm.blockChainDB.Get(policyBucket, transferPolicyKey, policy)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return policy, nil
+}
+
+//SaveTransferPolicy 保存转账策略
+func (wm *WalletManager) SaveTransferPolicy(policy *TransferPolicy) error {
+
+	if policy == nil {
+		return fmt.Errorf("the transfer policy to save is nil")
+	}
+
+	for _, t := range []string{policy.AllowedFrom, policy.AllowedTo} {
+		if _, err := parseClock(t); err != nil {
+			return err
+		}
+	}
+
+	wm.policyMu.Lock()
+	defer wm.policyMu.Unlock()
+
+	return wm.blockChainDB.Set(policyBucket, transferPolicyKey, policy)
+}
+
+//CheckTransferPolicy 检查转账是否满足策略，不记录限额
+func (wm *WalletManager) CheckTransferPolicy(from, to string, amount decimal.Decimal) error {
+
+	wm.policyMu.Lock()
+	defer wm.policyMu.Unlock()
+
+	policy, err := wm.GetTransferPolicy()
+	if err != nil {
+		return err
+	}
+
+	return wm.checkTransferPolicy(policy, from, to, amount, time.Now())
+}
+
+//reserveTransferPolicy 检查策略并占用限额，转账失败时需调用releaseTransferPolicy
+func (wm *WalletManager) reserveTransferPolicy(from, to string, amount decimal.Decimal, now time.Time) (*TransferUsage, error) {
+
+	wm.policyMu.Lock()
+	defer wm.policyMu.Unlock()
+
+	policy, err := wm.GetTransferPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	if !policy.Enabled {
+		return nil, nil
+	}
+
+	err = wm.checkTransferPolicy(policy, from, to, amount, now)
+	if err != nil {
+		return nil, err
+	}
+
+	//清理已超出统计周期的计数，失败时只影响统计速度
+	err = wm.blockChainDB.Select(q.Lt("Time", now.Unix()-policy.maxWindow())).Delete(new(TransferUsage))
+	if err != nil && err != storm.ErrNotFound {
+		wm.Log.Std.Error("transfer policy can not prune usages; unexpected error: %v", err)
+	}
+
+	usage := NewTransferUsage(from, to, amount, now)
+	err = wm.blockChainDB.Save(usage)
+	if err != nil {
+		return nil, err
+	}
+
+	return usage, nil
+}
+
+//confirmTransferPolicy 转账成功，记录交易单号
+func (wm *WalletManager) confirmTransferPolicy(usage *TransferUsage, txid string) {
+	if usage == nil {
+		return
+	}
+	if err := wm.blockChainDB.UpdateField(usage, "TxID", txid); err != nil {
+		wm.Log.Std.Error("transfer policy can not record txid: %s of usage: %s; unexpected error: %v", txid, usage.ID, err)
+	}
+}
+
+//releaseTransferPolicy 转账失败，释放占用的限额，释放失败时限额在统计周期内一直被占用
+func (wm *WalletManager) releaseTransferPolicy(usage *TransferUsage) {
+	if usage == nil {
+		return
+	}
+	if err := wm.blockChainDB.DeleteStruct(usage); err != nil && err != storm.ErrNotFound {
+		wm.Log.Std.Error("transfer policy can not release usage: %s of %s; unexpected error: %v", usage.ID, usage.Amount.String(), err)
+	}
+}
+
+//checkTransferPolicy 按策略检查转账
+//@param pending 还没有保存的限额计数，批量预演时累计前面的交易单
+func (wm *WalletManager) checkTransferPolicy(policy *TransferPolicy, from, to string, amount decimal.Decimal, now time.Time, pending ...*TransferUsage) error {
+
+	if !policy.Enabled {
+		return nil
+	}
+
+	for _, a := range policy.DenyList {
+		if a == to {
+			return &PolicyError{Rule: PolicyRuleDenyList, Message: fmt.Sprintf("address: %s is in the deny list", to)}
+		}
+	}
+
+	if len(policy.AllowList) > 0 {
+		allowed := false
+		for _, a := range policy.AllowList {
+			if a == to {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return &PolicyError{Rule: PolicyRuleAllowList, Message: fmt.Sprintf("address: %s is not in the allow list", to)}
+		}
+	}
+
+	if !policy.inTimeWindow(now) {
+		return &PolicyError{Rule: PolicyRuleTimeWindow, Message: fmt.Sprintf("transfers are only allowed between %s and %s", policy.AllowedFrom, policy.AllowedTo)}
+	}
+
+	if limit := policy.limitOf(policy.WalletLimits, from); limit != nil {
+		err := wm.checkTransferLimit(limit, "From", from, amount, now, pending,
+			PolicyRuleWalletPerTransaction, PolicyRuleWalletPerDay, PolicyRuleWalletPerWindow)
+		if err != nil {
+			return err
+		}
+	}
+
+	if limit := policy.limitOf(policy.DestinationLimits, to); limit != nil {
+		err := wm.checkTransferLimit(limit, "To", to, amount, now, pending,
+			PolicyRuleDestinationPerTransaction, PolicyRuleDestinationPerDay, PolicyRuleDestinationPerWindow)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//checkTransferLimit 检查单笔、自然日和滚动窗口的累计限额
+func (wm *WalletManager) checkTransferLimit(limit *TransferLimit, field, address string, amount decimal.Decimal, now time.Time, pending []*TransferUsage, perTxRule, perDayRule, perWindowRule string) error {
+
+	if limit.PerTransaction.IsPositive() && amount.GreaterThan(limit.PerTransaction) {
+		return &PolicyError{Rule: perTxRule, Message: fmt.Sprintf("amount: %s of address: %s exceeds the limit: %s", amount.String(), address, limit.PerTransaction.String())}
+	}
+
+	if !limit.PerDay.IsPositive() && !limit.PerWindow.IsPositive() {
+		return nil
+	}
+
+	var list []*TransferUsage
+	err := wm.blockChainDB.Find(field, address, &list)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	for _, u := range pending {
+		if (field == "From" && u.From == address) || (field == "To" && u.To == address) {
+			list = append(list, u)
+		}
+	}
+
+	if limit.PerDay.IsPositive() {
+		dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()).Unix()
+		used := sumTransferUsage(list, dayStart)
+		if used.Add(amount).GreaterThan(limit.PerDay) {
+			return &PolicyError{Rule: perDayRule, Message: fmt.Sprintf("address: %s has used %s of the daily limit: %s", address, used.String(), limit.PerDay.String())}
+		}
+	}
+
+	if limit.PerWindow.IsPositive() && limit.Window > 0 {
+		used := sumTransferUsage(list, now.Unix()-limit.Window)
+		if used.Add(amount).GreaterThan(limit.PerWindow) {
+			return &PolicyError{Rule: perWindowRule, Message: fmt.Sprintf("address: %s has used %s of the limit: %s in the last %d seconds", address, used.String(), limit.PerWindow.String(), limit.Window)}
+		}
+	}
+
+	return nil
+}
+
+//sumTransferUsage 统计since之后的转账金额
+func sumTransferUsage(list []*TransferUsage, since int64) decimal.Decimal {
+	total := decimal.Zero
+	for _, u := range list {
+		if u.Time >= since {
+			total = total.Add(u.Amount)
+		}
+	}
+	return total
+}
+
+//limitOf 获取地址的限额，没有单独设置时使用默认项
+func (p *TransferPolicy) limitOf(limits map[string]*TransferLimit, address string) *TransferLimit {
+	if limit, ok := limits[address]; ok {
+		return limit
+	}
+	return limits[PolicyAnyAddress]
+}
+
+//maxWindow 计数需要保留的最长秒数
+func (p *TransferPolicy) maxWindow() int64 {
+	max := int64(2 * 24 * 60 * 60)
+	for _, limits := range []map[string]*TransferLimit{p.WalletLimits, p.DestinationLimits} {
+		for _, limit := range limits {
+			if limit.Window > max {
+				max = limit.Window
+			}
+		}
+	}
+	return max
+}
+
+//inTimeWindow 是否在允许转账的时间段，支持跨零点
+func (p *TransferPolicy) inTimeWindow(now time.Time) bool {
+
+	if len(p.AllowedFrom) == 0 || len(p.AllowedTo) == 0 {
+		return true
+	}
+
+	from, err := parseClock(p.AllowedFrom)
+	if err != nil {
+		return false
+	}
+	to, err := parseClock(p.AllowedTo)
+	if err != nil {
+		return false
+	}
+
+	minute := now.Hour()*60 + now.Minute()
+	if from <= to {
+		return minute >= from && minute < to
+	}
+	return minute >= from || minute < to
+}
+
+//parseClock 解析HH:MM为当天的分钟数，空字符串返回0
+func parseClock(clock string) (int, error) {
+	if len(clock) == 0 {
+		return 0, nil
+	}
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("time: '%s' is not in HH:MM format", clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
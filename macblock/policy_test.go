@@ -0,0 +1,121 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"github.com/shopspring/decimal"
+	"testing"
+	"time"
+)
+
+func testPolicyRule(err error) string {
+	if policyErr, ok := err.(*PolicyError); ok {
+		return policyErr.Rule
+	}
+	return ""
+}
+
+func TestWalletManager_TransferPolicy(t *testing.T) {
+
+	wm, cleanup := testNewOfflineWalletManager(t, nil)
+	defer cleanup()
+
+	policy := NewTransferPolicy()
+	policy.Enabled = true
+	policy.DenyList = []string{"MACdenied"}
+	policy.WalletLimits[PolicyAnyAddress] = &TransferLimit{
+		PerTransaction: decimal.New(100, 0),
+		PerDay:         decimal.New(150, 0),
+	}
+	policy.DestinationLimits["MACpartner"] = &TransferLimit{
+		PerWindow: decimal.New(50, 0),
+		Window:    3600,
+	}
+	if err := wm.SaveTransferPolicy(policy); err != nil {
+		t.Fatalf("SaveTransferPolicy unexpected error: %v", err)
+	}
+
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.Local)
+
+	reserve := func(from, to string, amount int64, at time.Time) error {
+		_, err := wm.reserveTransferPolicy(from, to, decimal.New(amount, 0), at)
+		return err
+	}
+
+	if err := reserve("MACa", "MACdenied", 1, now); testPolicyRule(err) != PolicyRuleDenyList {
+		t.Errorf("deny list error = %v", err)
+	}
+	if err := reserve("MACa", "MACuser", 101, now); testPolicyRule(err) != PolicyRuleWalletPerTransaction {
+		t.Errorf("per transaction error = %v", err)
+	}
+	if err := reserve("MACa", "MACuser", 100, now); err != nil {
+		t.Errorf("reserve unexpected error: %v", err)
+	}
+	if err := reserve("MACa", "MACuser", 60, now.Add(time.Hour)); testPolicyRule(err) != PolicyRuleWalletPerDay {
+		t.Errorf("per day error = %v", err)
+	}
+	//第二天重新计算
+	if err := reserve("MACa", "MACuser", 60, now.Add(24*time.Hour)); err != nil {
+		t.Errorf("reserve next day unexpected error: %v", err)
+	}
+
+	if err := reserve("MACb", "MACpartner", 40, now); err != nil {
+		t.Errorf("reserve unexpected error: %v", err)
+	}
+	if err := reserve("MACc", "MACpartner", 20, now.Add(30*time.Minute)); testPolicyRule(err) != PolicyRuleDestinationPerWindow {
+		t.Errorf("per window error = %v", err)
+	}
+	//窗口滚动后释放
+	if err := reserve("MACc", "MACpartner", 20, now.Add(61*time.Minute)); err != nil {
+		t.Errorf("reserve after window unexpected error: %v", err)
+	}
+
+	//释放占用的限额
+	usage, err := wm.reserveTransferPolicy("MACd", "MACuser", decimal.New(100, 0), now)
+	if err != nil {
+		t.Fatalf("reserve unexpected error: %v", err)
+	}
+	wm.releaseTransferPolicy(usage)
+	if err := reserve("MACd", "MACuser", 100, now); err != nil {
+		t.Errorf("reserve after release unexpected error: %v", err)
+	}
+
+	if ErrorCode(&PolicyError{Rule: PolicyRuleDenyList}) != ErrPolicyRejected {
+		t.Errorf("PolicyError code is not ErrPolicyRejected")
+	}
+}
+
+func TestTransferPolicy_TimeWindow(t *testing.T) {
+
+	policy := NewTransferPolicy()
+	policy.AllowedFrom = "22:00"
+	policy.AllowedTo = "06:00"
+
+	at := func(hour, minute int) time.Time {
+		return time.Date(2019, 6, 1, hour, minute, 0, 0, time.Local)
+	}
+
+	if !policy.inTimeWindow(at(23, 0)) || !policy.inTimeWindow(at(5, 59)) {
+		t.Errorf("inTimeWindow should allow transfers across midnight")
+	}
+	if policy.inTimeWindow(at(12, 0)) || policy.inTimeWindow(at(6, 0)) {
+		t.Errorf("inTimeWindow should reject transfers outside the window")
+	}
+
+	if _, err := parseClock("25:00"); err == nil {
+		t.Errorf("parseClock should reject invalid time")
+	}
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"sync"
+	"time"
+)
+
+//prefetchResult 预取的区块
+type prefetchResult struct {
+	block *Block
+	err   error
+}
+
+//blockPrefetcher 并发预取后续区块，按高度顺序取出
+type blockPrefetcher struct {
+	wm      *WalletManager
+	window  uint64
+	pending map[uint64]chan *prefetchResult
+}
+
+//newBlockPrefetcher 创建区块预取
+//@param window 同时预取的区块数，小于1时按1处理
+func newBlockPrefetcher(wm *WalletManager, window int) *blockPrefetcher {
+	if window < 1 {
+		window = 1
+	}
+	p := blockPrefetcher{
+		wm:      wm,
+		window:  uint64(window),
+		pending: make(map[uint64]chan *prefetchResult),
+	}
+	return &p
+}
+
+//Get 获取指定高度的区块，同时预取之后window个高度，不超过maxHeight
+func (p *blockPrefetcher) Get(height, maxHeight uint64) (*Block, error) {
+
+	for h := height; h < height+p.window && h <= maxHeight; h++ {
+		if _, ok := p.pending[h]; ok {
+			continue
+		}
+		ch := make(chan *prefetchResult, 1)
+		p.pending[h] = ch
+		go func(h uint64) {
+			block, err := p.wm.GetTransactionRecordHight(h)
+			ch <- &prefetchResult{block: block, err: err}
+		}(h)
+	}
+
+	//丢弃已经不需要的高度
+	for h := range p.pending {
+		if h < height {
+			delete(p.pending, h)
+		}
+	}
+
+	ch, ok := p.pending[height]
+	if !ok {
+		return p.wm.GetTransactionRecordHight(height)
+	}
+	delete(p.pending, height)
+
+	result := <-ch
+	return result.block, result.err
+}
+
+//Reset 丢弃所有预取结果，分叉回滚后调用
+func (p *blockPrefetcher) Reset() {
+	p.pending = make(map[uint64]chan *prefetchResult)
+}
+
+//blockHeightCache 缓存节点最新高度
+type blockHeightCache struct {
+	mu       sync.Mutex
+	height   uint64
+	expireAt time.Time
+}
+
+//getBlockHeight 获取节点最新高度，缓存有效期内不再请求节点
+func (bs *MACBlockScanner) getBlockHeight() (uint64, error) {
+
+	ttl := bs.wm.Config.BlockHeightCacheTTL
+	if ttl <= 0 {
+		return bs.wm.GetBlockHeight()
+	}
+
+	bs.heightCache.mu.Lock()
+	defer bs.heightCache.mu.Unlock()
+
+	if time.Now().Before(bs.heightCache.expireAt) {
+		return bs.heightCache.height, nil
+	}
+
+	height, err := bs.wm.GetBlockHeight()
+	if err != nil {
+		return 0, err
+	}
+
+	bs.heightCache.height = height
+	bs.heightCache.expireAt = time.Now().Add(ttl)
+	return height, nil
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMACBlockScanner_ScanBlockTaskPrefetch(t *testing.T) {
+
+	var (
+		mu          sync.Mutex
+		tip         = 30
+		forkFrom    = 1000 //从该高度开始是另一条链
+		inFlight    = 0
+		maxInFlight = 0
+		tipCalls    = 0
+	)
+
+	hashOf := func(height int) string {
+		if height >= forkFrom {
+			return fmt.Sprintf("x%d", height)
+		}
+		return fmt.Sprintf("h%d", height)
+	}
+
+	wm, cleanup := testNewOfflineWalletManager(t, map[string]testNodeAction{
+		"GetBlockHeight": func(form url.Values) string {
+			mu.Lock()
+			defer mu.Unlock()
+			tipCalls++
+			return fmt.Sprintf(`{"errCode": 0, "BlockHeight": %d}`, tip)
+		},
+		"GetTransactionRecordHight": func(form url.Values) string {
+			mu.Lock()
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight = inFlight
+			}
+			mu.Unlock()
+
+			time.Sleep(5 * time.Millisecond)
+
+			mu.Lock()
+			defer mu.Unlock()
+			inFlight--
+			height, _ := strconv.Atoi(form.Get("height"))
+			return fmt.Sprintf(`{"errCode": 0, "blockhash": "%s", "parenthash": "%s", "Content": []}`, hashOf(height), hashOf(height-1))
+		},
+	})
+	defer cleanup()
+
+	wm.Config.PrefetchWindow = 8
+	wm.Config.BlockHeightCacheTTL = time.Minute
+
+	bs := wm.Blockscanner.(*MACBlockScanner)
+	observer := &testReorgObserver{}
+	bs.AddObserver(observer)
+	bs.Scanning = true
+
+	bs.SaveLocalNewBlock(5, "h5")
+	bs.SaveLocalBlock(&Block{Height: 5, Hash: "h5"})
+
+	bs.ScanBlockTask()
+
+	if height, hash := bs.GetLocalNewBlock(); height != 30 || hash != "h30" {
+		t.Fatalf("local new block = %d %s, want 30 h30", height, hash)
+	}
+	if maxInFlight < 2 || maxInFlight > 8 {
+		t.Errorf("max concurrent block requests = %d, want 2-8", maxInFlight)
+	}
+	if tipCalls > 2 {
+		t.Errorf("GetBlockHeight called %d times, want cached", tipCalls)
+	}
+
+	//节点从高度26开始分叉并延长到32
+	mu.Lock()
+	tip = 32
+	forkFrom = 26
+	mu.Unlock()
+	bs.heightCache.expireAt = time.Time{}
+
+	bs.ScanBlockTask()
+
+	if height, hash := bs.GetLocalNewBlock(); height != 32 || hash != "x32" {
+		t.Fatalf("local new block after fork = %d %s, want 32 x32", height, hash)
+	}
+
+	//区块按顺序通知，分叉区块从高到低
+	deadline := time.Now().Add(time.Second)
+	for {
+		observer.mu.Lock()
+		n := len(observer.headers)
+		observer.mu.Unlock()
+		if n >= 25+5+7 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	observer.mu.Lock()
+	defer observer.mu.Unlock()
+	got := make([]string, 0)
+	for _, h := range observer.headers {
+		got = append(got, h.Hash)
+	}
+	want := make([]string, 0)
+	for h := 6; h <= 30; h++ {
+		want = append(want, fmt.Sprintf("h%d", h))
+	}
+	for h := 30; h >= 26; h-- {
+		want = append(want, fmt.Sprintf("h%d", h))
+	}
+	for h := 26; h <= 32; h++ {
+		want = append(want, fmt.Sprintf("x%d", h))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("notified blocks = %v, want %v", got, want)
+	}
+}
+
+func TestMACBlockScanner_ScanBlockTaskFetchFailure(t *testing.T) {
+
+	var (
+		mu       sync.Mutex
+		failures = 1 //高度8第一次请求失败
+	)
+
+	wm, cleanup := testNewOfflineWalletManager(t, map[string]testNodeAction{
+		"GetBlockHeight": func(form url.Values) string {
+			return `{"errCode": 0, "BlockHeight": 10}`
+		},
+		"GetTransactionRecordHight": func(form url.Values) string {
+			height, _ := strconv.Atoi(form.Get("height"))
+			mu.Lock()
+			defer mu.Unlock()
+			if height == 8 && failures > 0 {
+				failures--
+				return `{"errCode": 1, "Msg": "node busy"}`
+			}
+			return fmt.Sprintf(`{"errCode": 0, "blockhash": "h%d", "parenthash": "h%d", "Content": []}`, height, height-1)
+		},
+	})
+	defer cleanup()
+
+	bs := wm.Blockscanner.(*MACBlockScanner)
+	observer := &testReorgObserver{}
+	bs.AddObserver(observer)
+	bs.Scanning = true
+
+	bs.SaveLocalNewBlock(5, "h5")
+	bs.SaveLocalBlock(&Block{Height: 5, Hash: "h5"})
+
+	//获取失败时停在上一高度，不误判分叉
+	bs.ScanBlockTask()
+	if height, hash := bs.GetLocalNewBlock(); height != 7 || hash != "h7" {
+		t.Fatalf("local new block = %d %s, want 7 h7", height, hash)
+	}
+
+	bs.ScanBlockTask()
+	if height, hash := bs.GetLocalNewBlock(); height != 10 || hash != "h10" {
+		t.Fatalf("local new block = %d %s, want 10 h10", height, hash)
+	}
+	if heights := observer.forkHeights(0); len(heights) != 0 {
+		t.Errorf("orphaned blocks notified = %v, want none", heights)
+	}
+	if records, _ := bs.GetUnscanRecords(); len(records) != 0 {
+		t.Errorf("unscan records = %+v, want none", records)
+	}
+}
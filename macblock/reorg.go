@@ -0,0 +1,151 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+//ReorgAlert 无法自动回滚分叉的告警，分叉深度超过上限或本地缺少区块头
+type ReorgAlert struct {
+	Height     uint64 //发现分叉的本地高度
+	Depth      uint64 //已回溯的区块数
+	MaxDepth   uint64
+	LocalHash  string
+	RemoteHash string
+	Reason     string //无法回滚的原因
+	Time       int64
+}
+
+//ReorgAlertObserver 可选的观察者接口，接收分叉告警
+type ReorgAlertObserver interface {
+	ReorgAlertNotify(alert *ReorgAlert) error
+}
+
+//findCommonAncestor 从本地最新区块逐个高度对比节点的区块，找到共同祖先
+//返回祖先区块和被分叉的本地区块，被分叉的区块按高度从高到低排列
+func (bs *MACBlockScanner) findCommonAncestor(tipHeight uint64, tipHash string) (*Block, []*Block, error) {
+
+	var (
+		height   = tipHeight
+		local    = &Block{Height: tipHeight, Hash: tipHash}
+		orphaned = make([]*Block, 0)
+		maxDepth = bs.wm.Config.MaxReorgDepth
+	)
+
+	if b, err := bs.GetLocalBlock(tipHeight); err == nil && b.Hash == tipHash {
+		local = b
+	}
+
+	for {
+
+		remote, err := bs.wm.GetTransactionRecordHight(height)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if remote.Hash == local.Hash {
+			if len(orphaned) == 0 {
+				//节点在本地最新高度的区块没有变化，下一区块的上一hash与之不符，是节点数据不一致，等待下次扫描
+				return nil, nil, fmt.Errorf("block height: %d hash: %s is unchanged on the node, the next block does not link to it", tipHeight, tipHash)
+			}
+			return remote, orphaned, nil
+		}
+
+		orphaned = append(orphaned, local)
+
+		if maxDepth > 0 && uint64(len(orphaned)) > maxDepth {
+			reason := fmt.Sprintf("block reorg from height: %d is deeper than %d blocks", tipHeight, maxDepth)
+			bs.reorgAlertNotify(newReorgAlert(tipHeight, orphaned, maxDepth, local.Hash, remote.Hash, reason))
+			return nil, nil, errors.New(reason)
+		}
+
+		if height <= 1 {
+			return nil, nil, fmt.Errorf("block reorg from height: %d can not find common ancestor", tipHeight)
+		}
+		height--
+
+		local, err = bs.GetLocalBlock(height)
+		if err != nil {
+			//本地没有区块头，无法确认共同祖先，告警并停止回滚
+			reason := fmt.Sprintf("block reorg from height: %d can not find local header on height: %d", tipHeight, height)
+			bs.reorgAlertNotify(newReorgAlert(tipHeight, orphaned, maxDepth, "", "", reason))
+			return nil, nil, errors.New(reason)
+		}
+	}
+}
+
+//newReorgAlert 创建分叉告警
+func newReorgAlert(tipHeight uint64, orphaned []*Block, maxDepth uint64, localHash, remoteHash, reason string) *ReorgAlert {
+	return &ReorgAlert{
+		Height:     tipHeight,
+		Depth:      uint64(len(orphaned)),
+		MaxDepth:   maxDepth,
+		LocalHash:  localHash,
+		RemoteHash: remoteHash,
+		Reason:     reason,
+		Time:       time.Now().Unix(),
+	}
+}
+
+//handleReorg 回滚到共同祖先，按高度从高到低通知被分叉的区块，返回新的扫描起点
+func (bs *MACBlockScanner) handleReorg(tipHeight uint64, tipHash string) (*Block, error) {
+
+	ancestor, orphaned, err := bs.findCommonAncestor(tipHeight, tipHash)
+	if err != nil {
+		return nil, err
+	}
+
+	bs.wm.Log.Std.Info("block reorg: %d blocks orphaned, common ancestor height: %d, hash: %s", len(orphaned), ancestor.Height, ancestor.Hash)
+
+	//删除祖先之后的待确认交易
+	bs.DeletePendingExtractData(ancestor.Height + 1)
+
+	for _, b := range orphaned {
+		bs.wm.Log.Std.Info("block height: %d hash: %s is orphaned", b.Height, b.Hash)
+		bs.DeleteUnscanRecord(b.Height)
+		bs.DeleteLocalBlock(b.Height)
+		//通知分叉区块给观测者
+		bs.newBlockNotify(b, true)
+		//通知需要回滚的交易
+		if err := bs.reverseExtractedTransactions(b); err != nil {
+			bs.wm.Log.Std.Error("block height: %d can not reverse transactions; unexpected error: %v", b.Height, err)
+		}
+	}
+
+	//重新记录一个新扫描起点
+	bs.SaveLocalNewBlock(ancestor.Height, ancestor.Hash)
+	bs.SaveLocalBlock(ancestor)
+
+	return ancestor, nil
+}
+
+//reorgAlertNotify 告警分叉无法自动回滚，通过事件箱通知实现了ReorgAlertObserver的观察者
+func (bs *MACBlockScanner) reorgAlertNotify(alert *ReorgAlert) {
+
+	bs.wm.Log.Std.Error("%s, local hash: %s, node hash: %s; scanning stopped until resolved", alert.Reason, alert.LocalHash, alert.RemoteHash)
+
+	err := bs.publishOutboxEvents(&OutboxEvent{
+		Kind:        OutboxEventReorgAlert,
+		BlockHeight: alert.Height,
+		Alert:       alert,
+	})
+	if err != nil {
+		bs.wm.Log.Std.Error("reorg alert can not be saved to outbox; unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"fmt"
+	"github.com/blocktree/openwallet/openwallet"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+//testReorgObserver 记录分叉通知和告警
+type testReorgObserver struct {
+	mu      sync.Mutex
+	headers []*openwallet.BlockHeader
+	alerts  []*ReorgAlert
+}
+
+func (o *testReorgObserver) BlockScanNotify(header *openwallet.BlockHeader) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.headers = append(o.headers, header)
+	return nil
+}
+
+func (o *testReorgObserver) BlockExtractDataNotify(sourceKey string, data *openwallet.TxExtractData) error {
+	return nil
+}
+
+func (o *testReorgObserver) ReorgAlertNotify(alert *ReorgAlert) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.alerts = append(o.alerts, alert)
+	return nil
+}
+
+func (o *testReorgObserver) forkHeights(want int) []uint64 {
+	deadline := time.Now().Add(time.Second)
+	for {
+		o.mu.Lock()
+		heights := make([]uint64, 0)
+		for _, h := range o.headers {
+			if h.Fork {
+				heights = append(heights, h.Height)
+			}
+		}
+		o.mu.Unlock()
+		if len(heights) >= want || time.Now().After(deadline) {
+			return heights
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMACBlockScanner_HandleReorg(t *testing.T) {
+
+	//节点在高度7之后是另一条链
+	wm, cleanup := testNewOfflineWalletManager(t, map[string]testNodeAction{
+		"GetTransactionRecordHight": func(form url.Values) string {
+			height, _ := strconv.Atoi(form.Get("height"))
+			prefix := "a"
+			if height > 7 {
+				prefix = "b"
+			}
+			return fmt.Sprintf(`{"errCode": 0, "blockhash": "%s%d", "parenthash": "%s%d", "Content": []}`, prefix, height, prefix, height-1)
+		},
+	})
+	defer cleanup()
+
+	bs := wm.Blockscanner.(*MACBlockScanner)
+	observer := &testReorgObserver{}
+	bs.AddObserver(observer)
+
+	for height := uint64(1); height <= 10; height++ {
+		bs.SaveLocalBlock(&Block{Height: height, Hash: fmt.Sprintf("a%d", height), Previousblockhash: fmt.Sprintf("a%d", height-1)})
+	}
+	bs.SaveLocalNewBlock(10, "a10")
+	wm.blockChainDB.Save(&PendingExtractData{ID: "9_0x9_user", BlockHeight: 9, BlockHash: "a9"})
+	wm.blockChainDB.Save(&PendingExtractData{ID: "7_0x7_user", BlockHeight: 7, BlockHash: "a7"})
+
+	//超过回溯上限时告警，不回滚
+	wm.Config.MaxReorgDepth = 2
+	if _, err := bs.handleReorg(10, "a10"); err == nil {
+		t.Fatalf("handleReorg deeper than max depth should fail")
+	}
+	testWaitObserverQueues(t, bs)
+	if len(observer.alerts) != 1 || observer.alerts[0].Height != 10 {
+		t.Errorf("reorg alerts = %+v", observer.alerts)
+	}
+	if height, _ := bs.GetLocalNewBlock(); height != 10 {
+		t.Errorf("local height = %d after failed reorg, want 10", height)
+	}
+
+	wm.Config.MaxReorgDepth = 100
+	ancestor, err := bs.handleReorg(10, "a10")
+	if err != nil {
+		t.Fatalf("handleReorg unexpected error: %v", err)
+	}
+	if ancestor.Height != 7 || ancestor.Hash != "a7" {
+		t.Errorf("common ancestor = %d %s, want 7 a7", ancestor.Height, ancestor.Hash)
+	}
+
+	heights := observer.forkHeights(3)
+	if fmt.Sprint(heights) != "[10 9 8]" {
+		t.Errorf("orphaned blocks notified = %v, want [10 9 8]", heights)
+	}
+
+	if height, hash := bs.GetLocalNewBlock(); height != 7 || hash != "a7" {
+		t.Errorf("local new block = %d %s, want 7 a7", height, hash)
+	}
+	if _, err := bs.GetLocalBlock(8); err == nil {
+		t.Errorf("orphaned local block was not deleted")
+	}
+	pending, _ := bs.GetPendingExtractData()
+	if len(pending) != 1 || pending[0].BlockHeight != 7 {
+		t.Errorf("pending after reorg = %+v", pending)
+	}
+}
+
+func TestMACBlockScanner_HandleReorg_Unresolved(t *testing.T) {
+
+	//节点在高度7之后是另一条链
+	wm, cleanup := testNewOfflineWalletManager(t, map[string]testNodeAction{
+		"GetTransactionRecordHight": func(form url.Values) string {
+			height, _ := strconv.Atoi(form.Get("height"))
+			prefix := "a"
+			if height > 7 {
+				prefix = "b"
+			}
+			return fmt.Sprintf(`{"errCode": 0, "blockhash": "%s%d", "parenthash": "%s%d", "Content": []}`, prefix, height, prefix, height-1)
+		},
+	})
+	defer cleanup()
+
+	bs := wm.Blockscanner.(*MACBlockScanner)
+	observer := &testReorgObserver{}
+	bs.AddObserver(observer)
+
+	//本地缺少区块头时告警，不回滚
+	for height := uint64(9); height <= 10; height++ {
+		bs.SaveLocalBlock(&Block{Height: height, Hash: fmt.Sprintf("a%d", height)})
+	}
+	bs.SaveLocalNewBlock(10, "a10")
+	if _, err := bs.handleReorg(10, "a10"); err == nil {
+		t.Fatalf("handleReorg without local header should fail")
+	}
+	testWaitObserverQueues(t, bs)
+	if len(observer.alerts) != 1 || observer.alerts[0].Depth != 2 || observer.alerts[0].Reason == "" {
+		t.Errorf("reorg alerts = %+v", observer.alerts)
+	}
+	if height, _ := bs.GetLocalNewBlock(); height != 10 {
+		t.Errorf("local height = %d after failed reorg, want 10", height)
+	}
+
+	//节点在本地最新高度的区块没有变化时不回滚
+	bs.SaveLocalBlock(&Block{Height: 7, Hash: "a7"})
+	if _, err := bs.handleReorg(7, "a7"); err == nil {
+		t.Fatalf("handleReorg on an unchanged tip should fail")
+	}
+	testWaitObserverQueues(t, bs)
+	if len(observer.alerts) != 1 {
+		t.Errorf("reorg alerts = %d, want 1", len(observer.alerts))
+	}
+	if heights := observer.forkHeights(0); len(heights) != 0 {
+		t.Errorf("orphaned blocks notified = %v, want none", heights)
+	}
+}
@@ -0,0 +1,413 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"fmt"
+	"github.com/asdine/storm"
+	"time"
+)
+
+//DeadUnscanRecord 超过最大重扫次数的未扫记录，需要人工重放
+type DeadUnscanRecord struct {
+	ID          string `storm:"id"`
+	BlockHeight uint64 `storm:"index"`
+	TxID        string
+	Observer    string
+	Confirmed   bool
+	Reason      string
+	Attempts    int
+	FirstFailAt int64
+	LastFailAt  int64
+	DeadAt      int64
+}
+
+//UnscanDeadLetterObserver 可选的观察者接口，接收进入死信的未扫记录
+type UnscanDeadLetterObserver interface {
+	UnscanDeadLetterNotify(record *DeadUnscanRecord) error
+}
+
+//rescanBackoff 第attempts次失败后到下次重扫的等待时间，按指数增长
+func (bs *MACBlockScanner) rescanBackoff(attempts int) time.Duration {
+
+	backoff := bs.wm.Config.RescanBackoff
+	maxBackoff := bs.wm.Config.RescanMaxBackoff
+	if backoff <= 0 {
+		return 0
+	}
+
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if maxBackoff > 0 && backoff >= maxBackoff {
+			return maxBackoff
+		}
+	}
+
+	if maxBackoff > 0 && backoff > maxBackoff {
+		return maxBackoff
+	}
+	return backoff
+}
+
+//dueUnscanRecords 到达重扫时间的未扫记录
+func (bs *MACBlockScanner) dueUnscanRecords(now time.Time) ([]*UnscanRecord, error) {
+
+	list, err := bs.GetUnscanRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	due := make([]*UnscanRecord, 0)
+	for _, r := range list {
+		if r.NextRetryAt <= now.Unix() {
+			due = append(due, r)
+		}
+	}
+	return due, nil
+}
+
+//rescanHeight 重扫指定高度，targets为空时重放整个区块，否则只重放指定交易
+//targets的值是交易通知失败的观察者，为空时通知全部观察者
+//每笔交易和观察者成功后删除对应的未扫和死信记录，失败时累计失败次数
+func (bs *MACBlockScanner) rescanHeight(height uint64, targets map[string][]string) error {
+
+	txIDs := make([]string, 0, len(targets))
+	for txID := range targets {
+		txIDs = append(txIDs, txID)
+	}
+
+	block, err := bs.wm.GetTransactionRecordHight(height)
+	if err != nil {
+		bs.retryUnscanRecords(height, txIDs, err.Error())
+		return err
+	}
+
+	txs := block.txDetails
+	replay := targets
+	if targets == nil {
+		replay = make(map[string][]string, len(txs))
+		for _, tx := range txs {
+			replay[tx.TxID] = nil
+		}
+	} else {
+		txs = make([]*Transaction, 0)
+		for _, tx := range block.txDetails {
+			if _, ok := targets[tx.TxID]; ok {
+				txs = append(txs, tx)
+			}
+		}
+		if len(txs) == 0 {
+			err = fmt.Errorf("transactions %v not found in block height: %d", txIDs, height)
+			bs.retryUnscanRecords(height, txIDs, err.Error())
+			return err
+		}
+	}
+
+	//没有交易的区块无需提取
+	if len(txs) > 0 {
+		err = bs.batchExtractTransaction(height, block.Hash, txs, replay)
+	}
+
+	//旧版本没有TxID的整块记录，失败的交易已经单独记录
+	if targets == nil {
+		bs.deleteUnscanRecord(NewUnscanRecord(height, "", "").ID)
+	}
+
+	return err
+}
+
+//unscanConfirmed 观察者通知失败的是否已确认的交易，死信记录重放时同样按原样通知
+func (bs *MACBlockScanner) unscanConfirmed(height uint64, txID, observer string) bool {
+
+	id := NewObserverUnscanRecord(height, txID, observer, "").ID
+
+	var record UnscanRecord
+	if err := bs.wm.blockChainDB.One("ID", id, &record); err == nil {
+		return record.Confirmed
+	}
+	var dead DeadUnscanRecord
+	if err := bs.wm.blockChainDB.One("ID", id, &dead); err == nil {
+		return dead.Confirmed
+	}
+	return false
+}
+
+//recordUnscanFailure 记录失败的交易，重放时累计失败次数
+func (bs *MACBlockScanner) recordUnscanFailure(record *UnscanRecord, replay bool) {
+
+	var err error
+	if replay {
+		err = bs.failUnscanRecord(record)
+	} else {
+		err = bs.SaveUnscanRecord(record)
+	}
+	if err != nil {
+		bs.wm.Log.Std.Error("block height: %d, save unscan record failed. unexpected error: %v", record.BlockHeight, err)
+	}
+}
+
+//deleteUnscanRecord 删除未扫和死信记录
+func (bs *MACBlockScanner) deleteUnscanRecord(id string) error {
+
+	bs.unscanMu.Lock()
+	defer bs.unscanMu.Unlock()
+
+	err := bs.wm.blockChainDB.DeleteStruct(&UnscanRecord{ID: id})
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	err = bs.wm.blockChainDB.DeleteStruct(&DeadUnscanRecord{ID: id})
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+//failUnscanRecord 累计一次重扫失败，记录不存在时新建
+func (bs *MACBlockScanner) failUnscanRecord(record *UnscanRecord) error {
+
+	bs.unscanMu.Lock()
+
+	var exist UnscanRecord
+	if err := bs.wm.blockChainDB.One("ID", record.ID, &exist); err == nil {
+		exist.Reason = record.Reason
+		exist.Confirmed = exist.Confirmed || record.Confirmed
+		record = &exist
+	}
+
+	dead, err := bs.incrementUnscanRecord(record, time.Now().Unix())
+
+	bs.unscanMu.Unlock()
+
+	if dead != nil {
+		bs.unscanDeadLetterNotify(dead)
+	}
+	return err
+}
+
+//retryUnscanRecords 记录指定高度重扫失败，txIDs为空时记录该高度全部记录
+func (bs *MACBlockScanner) retryUnscanRecords(height uint64, txIDs []string, reason string) error {
+
+	bs.unscanMu.Lock()
+
+	var list []*UnscanRecord
+	err := bs.wm.blockChainDB.Find("BlockHeight", height, &list)
+	if err != nil {
+		bs.unscanMu.Unlock()
+		if err == storm.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+
+	var (
+		now  = time.Now().Unix()
+		dead = make([]*DeadUnscanRecord, 0)
+	)
+
+	for _, r := range list {
+		if len(txIDs) > 0 && !containsString(txIDs, r.TxID) {
+			continue
+		}
+
+		r.Reason = reason
+		d, err := bs.incrementUnscanRecord(r, now)
+		if err != nil {
+			bs.unscanMu.Unlock()
+			return err
+		}
+		if d != nil {
+			dead = append(dead, d)
+		}
+	}
+
+	bs.unscanMu.Unlock()
+
+	for _, d := range dead {
+		bs.unscanDeadLetterNotify(d)
+	}
+
+	return nil
+}
+
+//incrementUnscanRecord 累计失败次数，超过最大次数的移入死信并返回死信记录，调用方需持有unscanMu
+func (bs *MACBlockScanner) incrementUnscanRecord(r *UnscanRecord, now int64) (*DeadUnscanRecord, error) {
+
+	r.Attempts++
+	r.LastFailAt = now
+	if r.FirstFailAt == 0 {
+		r.FirstFailAt = now
+	}
+
+	maxAttempts := bs.wm.Config.RescanMaxAttempts
+	if maxAttempts > 0 && r.Attempts >= maxAttempts {
+		d := &DeadUnscanRecord{
+			ID:          r.ID,
+			BlockHeight: r.BlockHeight,
+			TxID:        r.TxID,
+			Observer:    r.Observer,
+			Confirmed:   r.Confirmed,
+			Reason:      r.Reason,
+			Attempts:    r.Attempts,
+			FirstFailAt: r.FirstFailAt,
+			LastFailAt:  r.LastFailAt,
+			DeadAt:      now,
+		}
+		if err := bs.moveUnscanRecord(r, d); err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+
+	r.NextRetryAt = now + int64(bs.rescanBackoff(r.Attempts)/time.Second)
+	return nil, bs.wm.blockChainDB.Save(r)
+}
+
+//moveUnscanRecord 未扫记录移入死信
+func (bs *MACBlockScanner) moveUnscanRecord(record *UnscanRecord, dead *DeadUnscanRecord) error {
+
+	tx, err := bs.wm.blockChainDB.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := tx.Save(dead); err != nil {
+		return err
+	}
+	if err := tx.DeleteStruct(record); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+//unscanDeadLetterNotify 通过事件箱通知观察者未扫记录进入死信
+//调用方可能是持有outboxMu的分发线程或观察者的投递线程，另起线程写入事件箱，死信记录已先保存
+func (bs *MACBlockScanner) unscanDeadLetterNotify(record *DeadUnscanRecord) {
+
+	bs.wm.Log.Std.Error("block height: %d rescan failed %d times, moved to dead letter; reason: %s", record.BlockHeight, record.Attempts, record.Reason)
+
+	go func() {
+		err := bs.publishOutboxEvents(&OutboxEvent{
+			Kind:        OutboxEventDeadLetter,
+			BlockHeight: record.BlockHeight,
+			TxID:        record.TxID,
+			DeadLetter:  record,
+		})
+		if err != nil {
+			bs.wm.Log.Std.Error("dead letter: %s can not be saved to outbox; unexpected error: %v", record.ID, err)
+		}
+	}()
+}
+
+//GetDeadUnscanRecords 获取死信中的未扫记录，按高度排列
+func (bs *MACBlockScanner) GetDeadUnscanRecords() ([]*DeadUnscanRecord, error) {
+
+	var list []*DeadUnscanRecord
+	err := bs.wm.blockChainDB.AllByIndex("BlockHeight", &list)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	if list == nil {
+		list = make([]*DeadUnscanRecord, 0)
+	}
+	return list, nil
+}
+
+//ReplayDeadUnscanRecord 人工重放死信记录，重置失败次数并在下次重扫时处理
+func (bs *MACBlockScanner) ReplayDeadUnscanRecord(id string) error {
+
+	bs.unscanMu.Lock()
+	defer bs.unscanMu.Unlock()
+
+	var dead DeadUnscanRecord
+	err := bs.wm.blockChainDB.One("ID", id, &dead)
+	if err != nil {
+		return err
+	}
+
+	record := &UnscanRecord{
+		ID:          dead.ID,
+		BlockHeight: dead.BlockHeight,
+		TxID:        dead.TxID,
+		Observer:    dead.Observer,
+		Confirmed:   dead.Confirmed,
+		Reason:      dead.Reason,
+		FirstFailAt: dead.FirstFailAt,
+		LastFailAt:  dead.LastFailAt,
+	}
+
+	tx, err := bs.wm.blockChainDB.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := tx.Save(record); err != nil {
+		return err
+	}
+	if err := tx.DeleteStruct(&dead); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+//ReplayDeadUnscanRecords 人工重放全部死信记录，返回重放数量
+func (bs *MACBlockScanner) ReplayDeadUnscanRecords() (int, error) {
+
+	list, err := bs.GetDeadUnscanRecords()
+	if err != nil {
+		return 0, err
+	}
+
+	for i, d := range list {
+		if err := bs.ReplayDeadUnscanRecord(d.ID); err != nil {
+			return i, err
+		}
+	}
+	return len(list), nil
+}
+
+//DeleteDeadUnscanRecord 删除死信记录，放弃重扫
+func (bs *MACBlockScanner) DeleteDeadUnscanRecord(id string) error {
+	return bs.wm.blockChainDB.DeleteStruct(&DeadUnscanRecord{ID: id})
+}
+
+//addUnscanObserver 合并交易需要重新通知的观察者，提取失败的记录需要通知全部观察者，用空列表表示
+func addUnscanObserver(observers []string, observer string) []string {
+	if len(observer) == 0 {
+		return make([]string, 0)
+	}
+	if observers != nil && len(observers) == 0 {
+		return observers
+	}
+	if containsString(observers, observer) {
+		return observers
+	}
+	return append(observers, observer)
+}
+
+//containsString list是否包含s
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
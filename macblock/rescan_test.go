@@ -0,0 +1,330 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"fmt"
+	"github.com/blocktree/openwallet/openwallet"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//testNamedObserver 记录收到的交易，指定的交易前几次通知失败
+type testNamedObserver struct {
+	mu        sync.Mutex
+	name      string
+	failures  map[string]int
+	received  []string
+	confirmed []bool //收到的交易扩展参数confirmed
+}
+
+func (o *testNamedObserver) ObserverName() string {
+	return o.name
+}
+
+func (o *testNamedObserver) BlockScanNotify(header *openwallet.BlockHeader) error {
+	return nil
+}
+
+func (o *testNamedObserver) BlockExtractDataNotify(sourceKey string, data *openwallet.TxExtractData) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	txID := data.Transaction.TxID
+	if o.failures[txID] > 0 {
+		o.failures[txID]--
+		return fmt.Errorf("%s is unavailable", o.name)
+	}
+	o.received = append(o.received, txID)
+	o.confirmed = append(o.confirmed, data.Transaction.GetExtParam().Get("confirmed").Bool())
+	return nil
+}
+
+//testDeadLetterObserver 记录进入死信的未扫记录
+type testDeadLetterObserver struct {
+	mu   sync.Mutex
+	dead []*DeadUnscanRecord
+}
+
+func (o *testDeadLetterObserver) BlockScanNotify(header *openwallet.BlockHeader) error {
+	return nil
+}
+
+func (o *testDeadLetterObserver) BlockExtractDataNotify(sourceKey string, data *openwallet.TxExtractData) error {
+	return nil
+}
+
+func (o *testDeadLetterObserver) UnscanDeadLetterNotify(record *DeadUnscanRecord) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.dead = append(o.dead, record)
+	return nil
+}
+
+//deadLetters 等待收到want个死信通知
+func (o *testDeadLetterObserver) deadLetters(want int) []*DeadUnscanRecord {
+	deadline := time.Now().Add(time.Second)
+	for {
+		o.mu.Lock()
+		dead := append([]*DeadUnscanRecord(nil), o.dead...)
+		o.mu.Unlock()
+		if len(dead) >= want || time.Now().After(deadline) {
+			return dead
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMACBlockScanner_RescanBackoff(t *testing.T) {
+
+	wm, cleanup := testNewOfflineWalletManager(t, nil)
+	defer cleanup()
+
+	bs := wm.Blockscanner.(*MACBlockScanner)
+	wm.Config.RescanBackoff = time.Minute
+	wm.Config.RescanMaxBackoff = 5 * time.Minute
+
+	want := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute}
+	for i, w := range want {
+		if got := bs.rescanBackoff(i + 1); got != w {
+			t.Errorf("rescanBackoff(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+}
+
+func TestMACBlockScanner_RescanDeadLetter(t *testing.T) {
+
+	var (
+		calls   int32
+		healthy int32
+	)
+
+	wm, cleanup := testNewOfflineWalletManager(t, map[string]testNodeAction{
+		"GetTransactionRecordHight": func(form url.Values) string {
+			atomic.AddInt32(&calls, 1)
+			if atomic.LoadInt32(&healthy) == 0 {
+				return `{"errCode": 1, "Msg": "node busy"}`
+			}
+			return `{"errCode": 0, "blockhash": "a5", "parenthash": "a4", "Content": []}`
+		},
+	})
+	defer cleanup()
+
+	bs := wm.Blockscanner.(*MACBlockScanner)
+	observer := &testDeadLetterObserver{}
+	bs.AddObserver(observer)
+
+	//未到重扫时间时不请求节点
+	wm.Config.RescanBackoff = time.Hour
+	bs.SaveUnscanRecord(NewUnscanRecord(5, "", "scan failed"))
+	bs.SaveUnscanRecord(NewUnscanRecord(5, "", "notify failed"))
+	bs.RescanFailedRecord()
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Fatalf("node called %d times before retry time", n)
+	}
+
+	list, _ := bs.GetUnscanRecords()
+	if len(list) != 1 || list[0].Attempts != 1 || list[0].Reason != "notify failed" || list[0].FirstFailAt == 0 {
+		t.Fatalf("unscan records = %+v", list)
+	}
+
+	//立即重扫，第3次失败后移入死信
+	wm.Config.RescanBackoff = 0
+	wm.Config.RescanMaxAttempts = 3
+	list[0].NextRetryAt = 0
+	wm.blockChainDB.Save(list[0])
+
+	bs.RescanFailedRecord()
+	list, _ = bs.GetUnscanRecords()
+	if len(list) != 1 || list[0].Attempts != 2 {
+		t.Fatalf("unscan records after 1 retry = %+v", list)
+	}
+
+	bs.RescanFailedRecord()
+	if list, _ := bs.GetUnscanRecords(); len(list) != 0 {
+		t.Fatalf("unscan records after max attempts = %+v", list)
+	}
+	dead, err := bs.GetDeadUnscanRecords()
+	if err != nil {
+		t.Fatalf("GetDeadUnscanRecords unexpected error: %v", err)
+	}
+	if len(dead) != 1 || dead[0].BlockHeight != 5 || dead[0].Attempts != 3 || dead[0].DeadAt == 0 {
+		t.Fatalf("dead unscan records = %+v", dead)
+	}
+	if notified := observer.deadLetters(1); len(notified) != 1 || notified[0].ID != dead[0].ID {
+		t.Errorf("dead letter notified = %+v", notified)
+	}
+
+	//死信不再自动重扫
+	atomic.StoreInt32(&calls, 0)
+	bs.RescanFailedRecord()
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Errorf("node called %d times for dead letter", n)
+	}
+
+	//人工重放后重扫成功
+	atomic.StoreInt32(&healthy, 1)
+	replayed, err := bs.ReplayDeadUnscanRecords()
+	if err != nil || replayed != 1 {
+		t.Fatalf("ReplayDeadUnscanRecords = %d, %v; want 1, nil", replayed, err)
+	}
+	if dead, _ := bs.GetDeadUnscanRecords(); len(dead) != 0 {
+		t.Errorf("dead unscan records after replay = %+v", dead)
+	}
+	list, _ = bs.GetUnscanRecords()
+	if len(list) != 1 || list[0].Attempts != 0 || list[0].NextRetryAt != 0 {
+		t.Fatalf("unscan records after replay = %+v", list)
+	}
+
+	bs.RescanFailedRecord()
+	if list, _ := bs.GetUnscanRecords(); len(list) != 0 {
+		t.Errorf("unscan records after successful rescan = %+v", list)
+	}
+}
+
+func TestMACBlockScanner_RescanFailedTransaction(t *testing.T) {
+
+	receiver := "MACuser00000000000000000000000"
+	wm, cleanup := testNewOfflineWalletManager(t, map[string]testNodeAction{
+		"GetTransactionRecordHight": func(form url.Values) string {
+			return `{"errCode": 0, "blockhash": "a10", "Content": [
+				{"hash": "0x1", "fromtoken": "MACfrom0000000000000000000000", "totoken": "` + receiver + `", "amount": "1", "time": 1},
+				{"hash": "0x2", "fromtoken": "MACfrom0000000000000000000000", "totoken": "` + receiver + `", "amount": "2", "time": 1},
+				{"hash": "0x3", "fromtoken": "MACfrom0000000000000000000000", "totoken": "` + receiver + `", "amount": "abc", "time": 1}
+			]}`
+		},
+	})
+	defer cleanup()
+
+	wm.Config.RescanBackoff = 0
+	wm.Config.OutboxMaxAttempts = 1
+	bs := wm.Blockscanner.(*MACBlockScanner)
+	bs.SetBlockScanTargetFunc(func(target openwallet.ScanTarget) (string, bool) {
+		return "user", target.Address == receiver
+	})
+	wallet := &testNamedObserver{name: "wallet", failures: map[string]int{"0x2": 1}}
+	audit := &testNamedObserver{name: "audit", failures: map[string]int{}}
+	bs.AddObserver(wallet)
+	bs.AddObserver(audit)
+
+	block, err := wm.GetTransactionRecordHight(10)
+	if err != nil {
+		t.Fatalf("GetTransactionRecordHight unexpected error: %v", err)
+	}
+	if err := bs.BatchExtractTransaction(10, block.Hash, block.txDetails); err == nil {
+		t.Fatalf("BatchExtractTransaction with invalid amount should fail")
+	}
+	testWaitObserverQueues(t, bs)
+
+	//按交易和观察者记录失败
+	records, _ := bs.ListUnscanRecords(UnscanRecordQuery{})
+	failures := make([]string, 0)
+	for _, r := range records {
+		failures = append(failures, r.TxID+":"+r.Observer)
+	}
+	sort.Strings(failures)
+	if fmt.Sprint(failures) != "[0x2:wallet 0x3:]" {
+		t.Fatalf("unscan records = %v, want [0x2:wallet 0x3:]", failures)
+	}
+
+	//重扫只通知失败的观察者
+	bs.RescanFailedRecord()
+	testWaitObserverQueues(t, bs)
+
+	sort.Strings(wallet.received)
+	sort.Strings(audit.received)
+	if fmt.Sprint(wallet.received) != "[0x1 0x2]" {
+		t.Errorf("wallet received = %v, want [0x1 0x2]", wallet.received)
+	}
+	if fmt.Sprint(audit.received) != "[0x1 0x2]" {
+		t.Errorf("audit received = %v, want [0x1 0x2]", audit.received)
+	}
+
+	records, _ = bs.ListUnscanRecords(UnscanRecordQuery{})
+	if len(records) != 1 || records[0].TxID != "0x3" || records[0].Attempts != 2 {
+		t.Errorf("unscan records after rescan = %+v", records)
+	}
+}
+
+func TestMACBlockScanner_RescanConfirmedTransaction(t *testing.T) {
+
+	receiver := "MACuser00000000000000000000000"
+	wm, cleanup := testNewOfflineWalletManager(t, map[string]testNodeAction{
+		"GetTransactionRecordHight": func(form url.Values) string {
+			return `{"errCode": 0, "blockhash": "a10", "Content": [
+				{"hash": "0x1", "fromtoken": "MACfrom0000000000000000000000", "totoken": "` + receiver + `", "amount": "1", "time": 1}
+			]}`
+		},
+	})
+	defer cleanup()
+
+	wm.Config.RescanBackoff = 0
+	wm.Config.OutboxMaxAttempts = 1
+	wm.Config.ConfirmationDepth = 3
+	bs := wm.Blockscanner.(*MACBlockScanner)
+	bs.SetBlockScanTargetFunc(func(target openwallet.ScanTarget) (string, bool) {
+		return "user", target.Address == receiver
+	})
+	wallet := &testNamedObserver{name: "wallet", failures: map[string]int{"0x1": 1}}
+	audit := &testNamedObserver{name: "audit", failures: map[string]int{}}
+	bs.AddObserver(wallet)
+	bs.AddObserver(audit)
+
+	block, err := wm.GetTransactionRecordHight(10)
+	if err != nil {
+		t.Fatalf("GetTransactionRecordHight unexpected error: %v", err)
+	}
+	if err := bs.BatchExtractTransaction(10, block.Hash, block.txDetails); err != nil {
+		t.Fatalf("BatchExtractTransaction unexpected error: %v", err)
+	}
+	bs.SaveLocalNewBlock(12, "a12")
+	if err := bs.ReleasePendingExtractData(12); err != nil {
+		t.Fatalf("ReleasePendingExtractData unexpected error: %v", err)
+	}
+	testWaitObserverQueues(t, bs)
+
+	records, _ := bs.ListUnscanRecords(UnscanRecordQuery{})
+	if len(records) != 1 || records[0].Observer != "wallet" || !records[0].Confirmed {
+		t.Fatalf("unscan records = %+v, want confirmed record of wallet", records)
+	}
+
+	//重放已确认的通知
+	bs.RescanFailedRecord()
+	testWaitObserverQueues(t, bs)
+
+	if fmt.Sprint(wallet.received, wallet.confirmed) != "[0x1] [true]" {
+		t.Errorf("wallet received = %v %v, want [0x1] [true]", wallet.received, wallet.confirmed)
+	}
+
+	//重扫整个高度不重复通知已提取的交易
+	if err := bs.RetryUnscanHeight(10); err != nil {
+		t.Fatalf("RetryUnscanHeight unexpected error: %v", err)
+	}
+	testWaitObserverQueues(t, bs)
+
+	if len(wallet.received) != 1 || len(audit.received) != 1 {
+		t.Errorf("received after retry = %v %v, want one notice each", wallet.received, audit.received)
+	}
+	if pending, _ := bs.GetPendingExtractData(); len(pending) != 0 {
+		t.Errorf("pending after retry = %d, want 0", len(pending))
+	}
+	if records, _ := bs.ListUnscanRecords(UnscanRecordQuery{}); len(records) != 0 {
+		t.Errorf("unscan records after retry = %+v", records)
+	}
+}
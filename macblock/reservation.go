@@ -0,0 +1,116 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"github.com/asdine/storm"
+	"github.com/shopspring/decimal"
+	"sync"
+	"time"
+)
+
+//TransferReservation 已发送但节点还没有确认的转账，占用发送地址的余额
+type TransferReservation struct {
+	TxID     string `storm:"id"`
+	From     string `storm:"index"`
+	To       string
+	Amount   decimal.Decimal
+	CreateAt int64
+}
+
+//sendLock 获取发送地址锁，同一地址的余额检查和发送逐笔进行
+func (wm *WalletManager) sendLock(address string) *sync.Mutex {
+	wm.sendMu.Lock()
+	defer wm.sendMu.Unlock()
+	if wm.sendLocks == nil {
+		wm.sendLocks = make(map[string]*sync.Mutex)
+	}
+	lock, ok := wm.sendLocks[address]
+	if !ok {
+		lock = &sync.Mutex{}
+		wm.sendLocks[address] = lock
+	}
+	return lock
+}
+
+//reserveTransfer 记录已发送的转账，在节点确认前占用余额
+func (wm *WalletManager) reserveTransfer(txid, from, to string, amount decimal.Decimal) error {
+	return wm.blockChainDB.Save(&TransferReservation{
+		TxID:     txid,
+		From:     from,
+		To:       to,
+		Amount:   amount,
+		CreateAt: time.Now().Unix(),
+	})
+}
+
+//reservedBalance 地址已发送未确认的金额，节点能查到的转账已计入余额，释放占用
+func (wm *WalletManager) reservedBalance(from string) (decimal.Decimal, error) {
+
+	list, err := wm.GetTransferReservations(from)
+	if err != nil {
+		return decimal.Zero, err
+	}
+
+	reserved := decimal.Zero
+	for _, r := range list {
+		if tx, err := wm.GetTransactionRecordHash(r.TxID); err == nil && tx.TxID == r.TxID {
+			wm.blockChainDB.DeleteStruct(r)
+			continue
+		}
+		reserved = reserved.Add(r.Amount)
+	}
+	return reserved, nil
+}
+
+//availableBalance 地址可用余额，扣除已发送未确认的转账
+func (wm *WalletManager) availableBalance(address string) (decimal.Decimal, error) {
+
+	balance, err := wm.GetAssetBalanceAds(address)
+	if err != nil {
+		return decimal.Zero, err
+	}
+
+	reserved, err := wm.reservedBalance(address)
+	if err != nil {
+		return decimal.Zero, err
+	}
+
+	return balance.AssetBalance.Sub(reserved), nil
+}
+
+//GetTransferReservations 获取地址已发送未确认的转账，地址为空时返回全部
+func (wm *WalletManager) GetTransferReservations(from string) ([]*TransferReservation, error) {
+
+	var (
+		list []*TransferReservation
+		err  error
+	)
+	if len(from) > 0 {
+		err = wm.blockChainDB.Find("From", from, &list)
+	} else {
+		err = wm.blockChainDB.All(&list)
+	}
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return list, nil
+}
+
+//ReleaseTransferReservation 人工释放占用，用于节点丢弃的转账
+func (wm *WalletManager) ReleaseTransferReservation(txid string) error {
+	return wm.blockChainDB.DeleteStruct(&TransferReservation{TxID: txid})
+}
@@ -0,0 +1,254 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"fmt"
+	"github.com/asdine/storm"
+	"github.com/blocktree/openwallet/openwallet"
+	"strings"
+	"sync"
+	"time"
+)
+
+//ScanTargetRecord 扫描地址记录，Memo为true时Address是固定充值地址的备注，用于memoDeposit
+type ScanTargetRecord struct {
+	Address   string `storm:"id" json:"address"`
+	SourceKey string `storm:"index" json:"sourceKey"`
+	Memo      bool   `json:"memo,omitempty"`
+	CreateAt  int64  `json:"createAt"`
+}
+
+//ScanMemoRecord 备注扫描记录，与地址分开保存，备注与地址相同时互不覆盖
+type ScanMemoRecord struct {
+	Memo      string `storm:"id"`
+	SourceKey string `storm:"index"`
+	CreateAt  int64
+}
+
+//ScanTargetRegistry 持久化的扫描地址表，内存索引随修改同步更新
+type ScanTargetRegistry struct {
+	wm    *WalletManager
+	mu    sync.RWMutex
+	index map[string]string //地址对应的sourceKey
+	memos map[string]string //备注对应的sourceKey
+}
+
+//NewScanTargetRegistry 创建扫描地址表并加载已保存的地址
+func NewScanTargetRegistry(wm *WalletManager) (*ScanTargetRegistry, error) {
+	reg := ScanTargetRegistry{
+		wm:    wm,
+		index: make(map[string]string),
+		memos: make(map[string]string),
+	}
+	if err := reg.Reload(); err != nil {
+		return nil, err
+	}
+	return &reg, nil
+}
+
+//Reload 从数据库重建内存索引
+func (reg *ScanTargetRegistry) Reload() error {
+
+	var list []*ScanTargetRecord
+	err := reg.wm.blockChainDB.All(&list)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+
+	var memoList []*ScanMemoRecord
+	err = reg.wm.blockChainDB.All(&memoList)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+
+	index := make(map[string]string, len(list))
+	for _, r := range list {
+		index[r.Address] = r.SourceKey
+	}
+
+	memos := make(map[string]string, len(memoList))
+	for _, r := range memoList {
+		memos[r.Memo] = r.SourceKey
+	}
+
+	reg.mu.Lock()
+	reg.index = index
+	reg.memos = memos
+	reg.mu.Unlock()
+
+	return nil
+}
+
+//AddScanTarget 添加扫描地址，已存在时更新sourceKey
+func (reg *ScanTargetRegistry) AddScanTarget(address, sourceKey string) error {
+	_, err := reg.ImportScanTargets([]*ScanTargetRecord{{Address: address, SourceKey: sourceKey}})
+	return err
+}
+
+//AddMemoScanTarget 添加充值备注，已存在时更新sourceKey
+func (reg *ScanTargetRegistry) AddMemoScanTarget(memo, sourceKey string) error {
+	_, err := reg.ImportScanTargets([]*ScanTargetRecord{{Address: memo, SourceKey: sourceKey, Memo: true}})
+	return err
+}
+
+//RemoveScanTarget 删除扫描地址
+func (reg *ScanTargetRegistry) RemoveScanTarget(address string) error {
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	err := reg.wm.blockChainDB.DeleteStruct(&ScanTargetRecord{Address: address})
+	if err != nil {
+		return err
+	}
+	delete(reg.index, address)
+	return nil
+}
+
+//RemoveMemoScanTarget 删除充值备注
+func (reg *ScanTargetRegistry) RemoveMemoScanTarget(memo string) error {
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	err := reg.wm.blockChainDB.DeleteStruct(&ScanMemoRecord{Memo: memo})
+	if err != nil {
+		return err
+	}
+	delete(reg.memos, memo)
+	return nil
+}
+
+//ImportScanTargets 批量导入扫描地址和充值备注，全部成功或全部失败，返回导入数量
+//地址需要通过CheckAddress，备注去掉首尾空白后不能为空
+func (reg *ScanTargetRegistry) ImportScanTargets(records []*ScanTargetRecord) (int, error) {
+
+	for _, r := range records {
+		if r.Memo {
+			if len(strings.TrimSpace(r.Address)) == 0 {
+				return 0, fmt.Errorf("memo scan target is empty")
+			}
+		} else if err := CheckAddress(r.Address); err != nil {
+			return 0, err
+		}
+		if len(r.SourceKey) == 0 {
+			return 0, fmt.Errorf("address: %s sourceKey is empty", r.Address)
+		}
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	tx, err := reg.wm.blockChainDB.Begin(true)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	for _, r := range records {
+		createAt := r.CreateAt
+		if createAt == 0 {
+			createAt = now
+		}
+		if r.Memo {
+			err = tx.Save(&ScanMemoRecord{Memo: strings.TrimSpace(r.Address), SourceKey: r.SourceKey, CreateAt: createAt})
+		} else {
+			err = tx.Save(&ScanTargetRecord{Address: r.Address, SourceKey: r.SourceKey, CreateAt: createAt})
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	for _, r := range records {
+		if r.Memo {
+			reg.memos[strings.TrimSpace(r.Address)] = r.SourceKey
+		} else {
+			reg.index[r.Address] = r.SourceKey
+		}
+	}
+
+	return len(records), nil
+}
+
+//ExportScanTargets 导出所有扫描地址和充值备注，地址在前
+func (reg *ScanTargetRegistry) ExportScanTargets() ([]*ScanTargetRecord, error) {
+
+	var list []*ScanTargetRecord
+	err := reg.wm.blockChainDB.Select().OrderBy("Address").Find(&list)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	if list == nil {
+		list = make([]*ScanTargetRecord, 0)
+	}
+
+	var memoList []*ScanMemoRecord
+	err = reg.wm.blockChainDB.Select().OrderBy("Memo").Find(&memoList)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	for _, r := range memoList {
+		list = append(list, &ScanTargetRecord{Address: r.Memo, SourceKey: r.SourceKey, Memo: true, CreateAt: r.CreateAt})
+	}
+
+	return list, nil
+}
+
+//SourceKey 查询地址的sourceKey
+func (reg *ScanTargetRegistry) SourceKey(address string) (string, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	key, ok := reg.index[address]
+	return key, ok
+}
+
+//MemoSourceKey 查询充值备注的sourceKey
+func (reg *ScanTargetRegistry) MemoSourceKey(memo string) (string, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	key, ok := reg.memos[memo]
+	return key, ok
+}
+
+//Len 扫描地址和充值备注的数量
+func (reg *ScanTargetRegistry) Len() int {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return len(reg.index) + len(reg.memos)
+}
+
+//ScanTargetFunc 基于内存索引的BlockScanTargetFunc，用于SetBlockScanTargetFunc
+//固定充值地址按备注查找用户时传入账户模型的ScanTarget，查找充值备注
+func (reg *ScanTargetRegistry) ScanTargetFunc() openwallet.BlockScanTargetFunc {
+	return func(target openwallet.ScanTarget) (string, bool) {
+		if target.BalanceModelType == openwallet.BalanceModelTypeAccount {
+			return reg.MemoSourceKey(target.Address)
+		}
+		return reg.SourceKey(target.Address)
+	}
+}
+
+//MemoScanTargetFunc 基于内存索引的MemoScanTargetFunc，用于SetMemoScanTargetFunc
+func (reg *ScanTargetRegistry) MemoScanTargetFunc() MemoScanTargetFunc {
+	return reg.MemoSourceKey
+}
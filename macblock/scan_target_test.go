@@ -0,0 +1,144 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"github.com/blocktree/openwallet/openwallet"
+	"testing"
+)
+
+func TestScanTargetRegistry(t *testing.T) {
+
+	wm, cleanup := testNewOfflineWalletManager(t, nil)
+	defer cleanup()
+
+	reg, err := NewScanTargetRegistry(wm)
+	if err != nil {
+		t.Fatalf("NewScanTargetRegistry unexpected error: %v", err)
+	}
+
+	sender := "MACx6150b0728bVdQDOAABCYFAUN1U"
+	receiver := "MACja4a7fbe76dBwVUBYFAWZVUWNlA"
+
+	scanTargetFunc := reg.ScanTargetFunc()
+	lookup := func(address string) (string, bool) {
+		return scanTargetFunc(openwallet.ScanTarget{Address: address, BalanceModelType: openwallet.BalanceModelTypeAddress})
+	}
+
+	if err := reg.AddScanTarget(sender, "sender"); err != nil {
+		t.Fatalf("AddScanTarget unexpected error: %v", err)
+	}
+	if key, ok := lookup(sender); !ok || key != "sender" {
+		t.Errorf("lookup(%s) = %s, %v", sender, key, ok)
+	}
+
+	//有一个地址不合法时全部不导入
+	_, err = reg.ImportScanTargets([]*ScanTargetRecord{
+		{Address: receiver, SourceKey: "receiver"},
+		{Address: "MACbad", SourceKey: "bad"},
+	})
+	if err == nil || reg.Len() != 1 {
+		t.Errorf("ImportScanTargets with invalid address: error = %v, len = %d", err, reg.Len())
+	}
+
+	n, err := reg.ImportScanTargets([]*ScanTargetRecord{
+		{Address: receiver, SourceKey: "receiver"},
+		{Address: "MACcaf763e4780EMgCOUFAHUFCRRgA", SourceKey: "receiver"},
+	})
+	if err != nil || n != 2 {
+		t.Fatalf("ImportScanTargets = %d, error: %v", n, err)
+	}
+
+	if err := reg.RemoveScanTarget(sender); err != nil {
+		t.Fatalf("RemoveScanTarget unexpected error: %v", err)
+	}
+	if _, ok := lookup(sender); ok {
+		t.Errorf("removed address is still watched")
+	}
+
+	//重启后从数据库恢复
+	restarted, err := NewScanTargetRegistry(wm)
+	if err != nil {
+		t.Fatalf("NewScanTargetRegistry unexpected error: %v", err)
+	}
+	if key, ok := restarted.SourceKey(receiver); !ok || key != "receiver" || restarted.Len() != 2 {
+		t.Errorf("restarted registry = %d addresses, %s: %s", restarted.Len(), receiver, key)
+	}
+
+	list, err := restarted.ExportScanTargets()
+	if err != nil || len(list) != 2 || list[0].Address != "MACcaf763e4780EMgCOUFAHUFCRRgA" || list[0].CreateAt == 0 {
+		t.Errorf("ExportScanTargets = %+v, error: %v", list, err)
+	}
+}
+
+func TestScanTargetRegistry_Memo(t *testing.T) {
+
+	wm, cleanup := testNewOfflineWalletManager(t, nil)
+	defer cleanup()
+
+	tokenAddress := "MACcbc6a02cab9F8ACJYVUJIQBAUlV"
+	wm.Config.tokenAddress = tokenAddress
+	wm.Config.MemoDeposit = true
+
+	reg, err := NewScanTargetRegistry(wm)
+	if err != nil {
+		t.Fatalf("NewScanTargetRegistry unexpected error: %v", err)
+	}
+
+	//备注不需要是合法地址
+	n, err := reg.ImportScanTargets([]*ScanTargetRecord{
+		{Address: "1001", SourceKey: "user1001", Memo: true},
+		{Address: tokenAddress, SourceKey: "exchange"},
+	})
+	if err != nil || n != 2 {
+		t.Fatalf("ImportScanTargets = %d, error: %v", n, err)
+	}
+	if _, err := reg.ImportScanTargets([]*ScanTargetRecord{{Address: " ", SourceKey: "user", Memo: true}}); err == nil {
+		t.Errorf("ImportScanTargets with empty memo should fail")
+	}
+
+	//备注与地址分开查找
+	if _, ok := reg.SourceKey("1001"); ok {
+		t.Errorf("memo should not be watched as an address")
+	}
+
+	bs := wm.Blockscanner.(*MACBlockScanner)
+	bs.SetBlockScanTargetFunc(reg.ScanTargetFunc())
+
+	observer := &testDepositObserver{extracted: make(map[string][]*openwallet.TxExtractData)}
+	bs.AddObserver(observer)
+
+	txs := []*Transaction{
+		{TxID: "0x1", FromToken: "MACja4a7fbe76dBwVUBYFAWZVUWNlA", ToToken: tokenAddress, Amount: "1", Note: "1001", BlockHeight: 10},
+	}
+	if err := bs.BatchExtractTransaction(10, "hash10", txs); err != nil {
+		t.Fatalf("BatchExtractTransaction unexpected error: %v", err)
+	}
+	testWaitObserverQueues(t, bs)
+
+	if deposits := observer.extracted["user1001"]; len(deposits) != 1 {
+		t.Errorf("memo deposits = %d, want 1", len(deposits))
+	}
+
+	list, err := reg.ExportScanTargets()
+	if err != nil || len(list) != 2 || !list[1].Memo || list[1].Address != "1001" {
+		t.Errorf("ExportScanTargets = %+v, error: %v", list, err)
+	}
+
+	if err := reg.RemoveMemoScanTarget("1001"); err != nil || reg.Len() != 1 {
+		t.Errorf("RemoveMemoScanTarget error = %v, len = %d", err, reg.Len())
+	}
+}
@@ -0,0 +1,369 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"fmt"
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/openwallet/openwallet"
+	"sync"
+	"time"
+)
+
+const (
+	//scheduleGrace 执行时间过去多久以内仍然执行，超过视为停机期间错过
+	scheduleGrace = 2 * time.Minute
+	//scheduleMaxSlots 每次检查最多处理的时间点，避免长时间停机后一次处理过多
+	scheduleMaxSlots = 1000
+)
+
+//定时转账执行状态
+const (
+	ScheduleRunRunning = "running" //执行中
+	ScheduleRunSent    = "sent"    //已发送
+	ScheduleRunFailed  = "failed"  //发送失败
+	ScheduleRunSkipped = "skipped" //停机期间错过，未执行
+)
+
+//TransferSchedule 定时转账模版
+type TransferSchedule struct {
+	ID       uint64 `storm:"id,increment"` // primary key
+	Name     string
+	From     string `storm:"index"`
+	To       string
+	Amount   string
+	Memo     string
+	Cron     string //cron表达式：分 时 日 月 周
+	CatchUp  bool   //是否补发停机期间错过的转账
+	Enabled  bool   `storm:"index"`
+	NextRun  int64  //下次执行时间
+	LastRun  int64  //上次执行的时间点
+	CreateAt int64
+	UpdateAt int64
+}
+
+//ScheduleRun 定时转账每个时间点的执行结果
+type ScheduleRun struct {
+	ID         string `storm:"id"` //模版ID和时间点，保证同一时间点只执行一次
+	ScheduleID uint64 `storm:"index"`
+	Slot       int64  //计划执行时间
+	Status     string
+	TxID       string
+	Error      string
+	RunAt      int64
+}
+
+//scheduleRunID 执行记录ID
+func scheduleRunID(scheduleID uint64, slot int64) string {
+	return fmt.Sprintf("%d_%d", scheduleID, slot)
+}
+
+//TransferScheduler 定时转账，到期时通过SendTransaction发送
+type TransferScheduler struct {
+	wm       *WalletManager
+	resolver WalletResolver
+	Interval time.Duration //检查间隔
+	mu       sync.Mutex    //执行锁
+	quit     chan struct{}
+	wg       sync.WaitGroup
+}
+
+//NewTransferScheduler 创建定时转账
+func NewTransferScheduler(wm *WalletManager, resolver WalletResolver) *TransferScheduler {
+	ts := TransferScheduler{
+		wm:       wm,
+		resolver: resolver,
+		Interval: 30 * time.Second,
+	}
+	return &ts
+}
+
+//AddSchedule 添加定时转账模版
+func (ts *TransferScheduler) AddSchedule(schedule *TransferSchedule) error {
+
+	cron, err := ParseCron(schedule.Cron)
+	if err != nil {
+		return err
+	}
+
+	if err := CheckAddress(schedule.To); err != nil {
+		return err
+	}
+
+	value, err := ts.wm.ValidateAmount(schedule.Amount)
+	if err != nil {
+		return err
+	}
+
+	if err := ts.wm.Config.MemoPolicy.Check(schedule.To, schedule.Memo); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	next := cron.Next(now)
+	if next.IsZero() {
+		return fmt.Errorf("cron expression: '%s' never fires", schedule.Cron)
+	}
+
+	schedule.ID = 0
+	schedule.Amount = value.String()
+	schedule.NextRun = next.Unix()
+	schedule.CreateAt = now.Unix()
+	schedule.UpdateAt = now.Unix()
+
+	return ts.wm.blockChainDB.Save(schedule)
+}
+
+//GetSchedule 查询定时转账模版
+func (ts *TransferScheduler) GetSchedule(id uint64) (*TransferSchedule, error) {
+	var schedule TransferSchedule
+	err := ts.wm.blockChainDB.One("ID", id, &schedule)
+	if err != nil {
+		return nil, err
+	}
+	return &schedule, nil
+}
+
+//ListSchedules 查询所有定时转账模版
+func (ts *TransferScheduler) ListSchedules() ([]*TransferSchedule, error) {
+	var list []*TransferSchedule
+	err := ts.wm.blockChainDB.All(&list)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return list, nil
+}
+
+//SetScheduleEnabled 启用或停用定时转账，启用时从当前时间开始计算下次执行时间
+func (ts *TransferScheduler) SetScheduleEnabled(id uint64, enabled bool) error {
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	schedule, err := ts.GetSchedule(id)
+	if err != nil {
+		return err
+	}
+
+	if enabled && !schedule.Enabled {
+		cron, err := ParseCron(schedule.Cron)
+		if err != nil {
+			return err
+		}
+		schedule.NextRun = cron.Next(time.Now()).Unix()
+	}
+	schedule.Enabled = enabled
+	schedule.UpdateAt = time.Now().Unix()
+
+	return ts.wm.blockChainDB.Save(schedule)
+}
+
+//RemoveSchedule 删除定时转账模版，保留执行记录
+func (ts *TransferScheduler) RemoveSchedule(id uint64) error {
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	schedule, err := ts.GetSchedule(id)
+	if err != nil {
+		return err
+	}
+	return ts.wm.blockChainDB.DeleteStruct(schedule)
+}
+
+//ListScheduleRuns 查询定时转账的执行记录
+func (ts *TransferScheduler) ListScheduleRuns(scheduleID uint64) ([]*ScheduleRun, error) {
+	var list []*ScheduleRun
+	err := ts.wm.blockChainDB.Select(q.Eq("ScheduleID", scheduleID)).OrderBy("Slot").Find(&list)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return list, nil
+}
+
+//Start 启动定时检查
+func (ts *TransferScheduler) Start() {
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.quit != nil {
+		return
+	}
+	ts.quit = make(chan struct{})
+
+	ts.wg.Add(1)
+	go func(quit chan struct{}) {
+		defer ts.wg.Done()
+		ticker := time.NewTicker(ts.Interval)
+		defer ticker.Stop()
+		for {
+			ts.RunDue(time.Now())
+			select {
+			case <-ticker.C:
+			case <-quit:
+				return
+			}
+		}
+	}(ts.quit)
+}
+
+//Stop 停止定时检查，等待执行中的转账完成
+func (ts *TransferScheduler) Stop() {
+	ts.mu.Lock()
+	if ts.quit != nil {
+		close(ts.quit)
+		ts.quit = nil
+	}
+	ts.mu.Unlock()
+	ts.wg.Wait()
+}
+
+//RunDue 执行now之前到期的定时转账
+func (ts *TransferScheduler) RunDue(now time.Time) {
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	var list []*TransferSchedule
+	err := ts.wm.blockChainDB.Find("Enabled", true, &list)
+	if err != nil {
+		if err != storm.ErrNotFound {
+			ts.wm.Log.Std.Error("transfer scheduler can not load schedules; unexpected error: %v", err)
+		}
+		return
+	}
+
+	for _, schedule := range list {
+		if schedule.NextRun > now.Unix() {
+			continue
+		}
+		err = ts.runSchedule(schedule, now)
+		if err != nil {
+			ts.wm.Log.Std.Error("schedule: %d can not run; unexpected error: %v", schedule.ID, err)
+		}
+	}
+}
+
+//runSchedule 处理模版到期的时间点，错过的时间点按CatchUp决定补发或跳过
+func (ts *TransferScheduler) runSchedule(schedule *TransferSchedule, now time.Time) error {
+
+	cron, err := ParseCron(schedule.Cron)
+	if err != nil {
+		return err
+	}
+
+	slot := time.Unix(schedule.NextRun, 0)
+	for i := 0; i < scheduleMaxSlots && !slot.IsZero() && !slot.After(now); i++ {
+
+		missed := !schedule.CatchUp && now.Sub(slot) > scheduleGrace
+		ts.runSlot(schedule, slot.Unix(), missed)
+
+		schedule.LastRun = slot.Unix()
+		slot = cron.Next(slot)
+	}
+
+	//超过单次处理上限的时间点直接跳到当前时间之后
+	if !slot.IsZero() && !slot.After(now) {
+		ts.wm.Log.Std.Warning("schedule: %d has more than %d missed runs, skipped to now", schedule.ID, scheduleMaxSlots)
+		slot = cron.Next(now)
+	}
+
+	schedule.NextRun = slot.Unix()
+	schedule.UpdateAt = now.Unix()
+	return ts.wm.blockChainDB.Save(schedule)
+}
+
+//runSlot 执行一个时间点的转账，已有执行记录的时间点不再执行
+//@param missed 停机期间错过的时间点，只记录为跳过
+func (ts *TransferScheduler) runSlot(schedule *TransferSchedule, slot int64, missed bool) {
+
+	run := &ScheduleRun{
+		ID:         scheduleRunID(schedule.ID, slot),
+		ScheduleID: schedule.ID,
+		Slot:       slot,
+		Status:     ScheduleRunRunning,
+		RunAt:      time.Now().Unix(),
+	}
+
+	var exist ScheduleRun
+	err := ts.wm.blockChainDB.One("ID", run.ID, &exist)
+	if err == nil {
+		return
+	}
+	if err != storm.ErrNotFound {
+		ts.wm.Log.Std.Error("schedule: %d can not load run: %s; unexpected error: %v", schedule.ID, run.ID, err)
+		return
+	}
+
+	if missed {
+		ts.wm.Log.Std.Warning("schedule: %d missed run at %s, skipped", schedule.ID, time.Unix(slot, 0).Format(time.RFC3339))
+		run.Status = ScheduleRunSkipped
+		ts.saveRun(run)
+		return
+	}
+
+	//先保存执行记录，发送中途重启也不会重复执行
+	err = ts.wm.blockChainDB.Save(run)
+	if err != nil {
+		ts.wm.Log.Std.Error("schedule: %d can not save run: %s; unexpected error: %v", schedule.ID, run.ID, err)
+		return
+	}
+
+	tx, err := ts.send(schedule, slot)
+	if err != nil {
+		ts.wm.Log.Std.Error("schedule: %d send failed; unexpected error: %v", schedule.ID, err)
+		run.Status = ScheduleRunFailed
+		run.Error = err.Error()
+	} else {
+		run.Status = ScheduleRunSent
+		run.TxID = tx.TxID
+	}
+
+	ts.saveRun(run)
+}
+
+//send 按模版发送转账
+func (ts *TransferScheduler) send(schedule *TransferSchedule, slot int64) (*openwallet.Transaction, error) {
+
+	wallet, password, err := ts.resolver(schedule.From)
+	if err != nil {
+		return nil, err
+	}
+
+	rawTx := &openwallet.RawTransaction{
+		Coin: openwallet.Coin{
+			Symbol:     ts.wm.Symbol(),
+			IsContract: false,
+		},
+		Sid: "schedule_" + scheduleRunID(schedule.ID, slot),
+		To:  map[string]string{schedule.To: schedule.Amount},
+	}
+	if len(schedule.Memo) > 0 {
+		rawTx.SetExtParam("memo", schedule.Memo)
+	}
+	rawTx.SetExtParam(ExtParamRequester, "schedule:"+schedule.Name)
+
+	return ts.wm.SendTransaction(wallet, password, rawTx)
+}
+
+//saveRun 保存执行记录
+func (ts *TransferScheduler) saveRun(run *ScheduleRun) {
+	if err := ts.wm.blockChainDB.Save(run); err != nil {
+		ts.wm.Log.Std.Error("schedule: %d can not save run: %s; unexpected error: %v", run.ScheduleID, run.ID, err)
+	}
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTransferScheduler_RunDue(t *testing.T) {
+
+	sent := 0
+	wm, cleanup := testNewOfflineWalletManager(t, map[string]testNodeAction{
+		"GetAssetBalanceAds": func(form url.Values) string {
+			return `{"errCode": 0, "AssetBalance": "1000"}`
+		},
+		"AssetTransferMN2": func(form url.Values) string {
+			sent++
+			return fmt.Sprintf(`{"errCode": 0, "TranHash": "0x%d"}`, sent)
+		},
+	})
+	defer cleanup()
+
+	resolver := func(address string) (*MACWallet, string, error) {
+		return &MACWallet{Address: address}, "1234qwer", nil
+	}
+	ts := NewTransferScheduler(wm, resolver)
+
+	if err := ts.AddSchedule(&TransferSchedule{From: "MACsender000000000000000000000", To: "MACpartner00000000000000000000", Amount: "1", Cron: "61 * * * *"}); err == nil {
+		t.Errorf("AddSchedule with invalid cron should fail")
+	}
+
+	schedule := &TransferSchedule{
+		Name:    "weekly",
+		From:    "MACsender000000000000000000000",
+		To:      "MACpartner00000000000000000000",
+		Amount:  "12.5",
+		Memo:    "partner fee",
+		Cron:    "*/10 * * * *",
+		Enabled: true,
+	}
+	if err := ts.AddSchedule(schedule); err != nil {
+		t.Fatalf("AddSchedule unexpected error: %v", err)
+	}
+
+	//模拟停机1小时：错过的时间点跳过，只执行刚到期的时间点
+	now := time.Now().Truncate(10 * time.Minute).Add(30 * time.Second)
+	schedule.NextRun = now.Add(-time.Hour).Add(-30 * time.Second).Unix()
+	wm.blockChainDB.Save(schedule)
+
+	ts.RunDue(now)
+	ts.RunDue(now)
+
+	if sent != 1 {
+		t.Errorf("sent = %d, want 1", sent)
+	}
+
+	runs, _ := ts.ListScheduleRuns(schedule.ID)
+	if len(runs) != 7 {
+		t.Fatalf("runs = %d, want 7", len(runs))
+	}
+	for i, run := range runs[:6] {
+		if run.Status != ScheduleRunSkipped {
+			t.Errorf("run: %d status = %s, want skipped", i, run.Status)
+		}
+	}
+	if last := runs[6]; last.Status != ScheduleRunSent || last.TxID != "0x1" {
+		t.Errorf("last run = %+v", last)
+	}
+
+	schedule, _ = ts.GetSchedule(schedule.ID)
+	if schedule.NextRun != now.Add(9*time.Minute+30*time.Second).Unix() {
+		t.Errorf("NextRun = %s", time.Unix(schedule.NextRun, 0))
+	}
+
+	//补发模式执行所有错过的时间点，已执行的时间点不再重复
+	schedule.CatchUp = true
+	schedule.NextRun = now.Add(-time.Hour).Add(-30 * time.Second).Unix()
+	wm.blockChainDB.Save(schedule)
+
+	ts.RunDue(now)
+	if sent != 1 {
+		t.Errorf("slots already recorded were run again, sent = %d", sent)
+	}
+
+	schedule, _ = ts.GetSchedule(schedule.ID)
+	schedule.NextRun = now.Add(-2 * time.Hour).Add(-30 * time.Second).Unix()
+	wm.blockChainDB.Save(schedule)
+
+	ts.RunDue(now)
+	if sent != 7 {
+		t.Errorf("sent = %d, want 7", sent)
+	}
+}
@@ -0,0 +1,464 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"fmt"
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/openwallet/openwallet"
+	"github.com/shopspring/decimal"
+	"sync"
+	"time"
+)
+
+//转账队列状态
+const (
+	TransferStatusPending   = "pending"   //等待发送
+	TransferStatusSending   = "sending"   //发送中
+	TransferStatusApproval  = "approval"  //超过审批阈值，等待提案执行
+	TransferStatusSent      = "sent"      //已发送
+	TransferStatusFailed    = "failed"    //发送失败
+	TransferStatusCancelled = "cancelled" //已取消
+)
+
+//WalletResolver 通过发送地址获取钱包和密码，用于后台发送的转账
+type WalletResolver func(address string) (*MACWallet, string, error)
+
+//TransferItem 转账队列记录
+type TransferItem struct {
+	ID         uint64 `storm:"id,increment"` // primary key
+	Sid        string `storm:"index"`        //业务订单号，用于去重
+	From       string `storm:"index"`
+	To         string
+	Amount     string
+	ExtParam   string
+	Status     string `storm:"index"`
+	ProposalID string //需要审批时的提案
+	TxID       string
+	Error      string
+	CreateAt   int64
+	UpdateAt   int64
+}
+
+//TransferQueue 持久化转账队列，同一发送地址的转账按顺序逐笔发送
+type TransferQueue struct {
+	wm       *WalletManager
+	resolver WalletResolver
+	mu       sync.Mutex             //队列状态锁
+	workers  map[string]bool        //正在发送的地址
+	addrMu   map[string]*sync.Mutex //入队时的地址锁
+	running  bool
+	wg       sync.WaitGroup
+}
+
+//NewTransferQueue 创建转账队列
+func NewTransferQueue(wm *WalletManager, resolver WalletResolver) *TransferQueue {
+	tq := TransferQueue{
+		wm:       wm,
+		resolver: resolver,
+		workers:  make(map[string]bool),
+		addrMu:   make(map[string]*sync.Mutex),
+	}
+	return &tq
+}
+
+//Start 启动队列，恢复重启前未完成的转账
+func (tq *TransferQueue) Start() error {
+
+	tq.mu.Lock()
+	if tq.running {
+		tq.mu.Unlock()
+		return nil
+	}
+	tq.running = true
+	tq.mu.Unlock()
+
+	//重启前发送中的转账无法确认是否已广播，标记为失败，由人工核对
+	var sending []*TransferItem
+	err := tq.wm.blockChainDB.Find("Status", TransferStatusSending, &sending)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	for _, item := range sending {
+		tq.wm.Log.Std.Warning("transfer: %d was interrupted while sending, please check it on chain", item.ID)
+		tq.finish(item, "", fmt.Errorf("interrupted while sending, please check it on chain"))
+	}
+
+	var pending []*TransferItem
+	err = tq.wm.blockChainDB.Find("Status", TransferStatusPending, &pending)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	for _, item := range pending {
+		tq.kick(item.From)
+	}
+
+	return nil
+}
+
+//Stop 停止队列，等待发送中的转账完成，未发送的转账保留到下次启动
+func (tq *TransferQueue) Stop() {
+	tq.mu.Lock()
+	tq.running = false
+	tq.mu.Unlock()
+	tq.wg.Wait()
+}
+
+//Enqueue 转账加入队列，返回队列记录
+//入队时检查金额，并扣除该地址未完成转账占用的余额
+func (tq *TransferQueue) Enqueue(from string, rawTx *openwallet.RawTransaction) (*TransferItem, error) {
+
+	var (
+		to     string
+		amount string
+	)
+
+	if len(rawTx.To) != 1 {
+		return nil, fmt.Errorf("transfer queue only supports one destination per transaction")
+	}
+
+	for k, v := range rawTx.To {
+		to = k
+		amount = v
+	}
+
+	if err := CheckAddress(to); err != nil {
+		return nil, err
+	}
+
+	value, err := tq.wm.ValidateAmount(amount)
+	if err != nil {
+		return nil, err
+	}
+
+	lock := tq.addressLock(from)
+	lock.Lock()
+	defer lock.Unlock()
+
+	//业务订单号已入队，直接返回
+	if len(rawTx.Sid) > 0 {
+		var exist TransferItem
+		err = tq.wm.blockChainDB.One("Sid", rawTx.Sid, &exist)
+		if err == nil {
+			return &exist, nil
+		}
+		if err != storm.ErrNotFound {
+			return nil, err
+		}
+	}
+
+	//先统计占用再查询余额，保证不会少算已广播的转账
+	reserved, err := tq.Reserved(from)
+	if err != nil {
+		return nil, err
+	}
+
+	unconfirmed, err := tq.wm.reservedBalance(from)
+	if err != nil {
+		return nil, err
+	}
+	reserved = reserved.Add(unconfirmed)
+
+	balance, err := tq.wm.GetAssetBalanceAds(from)
+	if err != nil {
+		return nil, err
+	}
+
+	if balance.AssetBalance.Sub(reserved).LessThan(value) {
+		return nil, openwallet.Errorf(openwallet.ErrInsufficientBalanceOfAddress, "address's balance is not enough, %s is reserved by queued transfers", reserved.String())
+	}
+
+	now := time.Now().Unix()
+	item := &TransferItem{
+		Sid:      rawTx.Sid,
+		From:     from,
+		To:       to,
+		Amount:   value.String(),
+		ExtParam: rawTx.ExtParam,
+		Status:   TransferStatusPending,
+		CreateAt: now,
+		UpdateAt: now,
+	}
+
+	err = tq.wm.blockChainDB.Save(item)
+	if err != nil {
+		return nil, err
+	}
+
+	tq.kick(from)
+
+	return item, nil
+}
+
+//Reserved 地址在队列中未完成的转账占用的金额，已发送未确认的转账由WalletManager占用
+func (tq *TransferQueue) Reserved(from string) (decimal.Decimal, error) {
+
+	var list []*TransferItem
+	err := tq.wm.blockChainDB.Select(
+		q.Eq("From", from),
+		q.In("Status", []string{TransferStatusPending, TransferStatusSending, TransferStatusApproval}),
+	).Find(&list)
+	if err != nil && err != storm.ErrNotFound {
+		return decimal.Zero, err
+	}
+
+	reserved := decimal.Zero
+	for _, item := range list {
+		if tq.refresh(item); item.Status != TransferStatusPending && item.Status != TransferStatusSending && item.Status != TransferStatusApproval {
+			continue
+		}
+		amount, err := decimal.NewFromString(item.Amount)
+		if err != nil {
+			return decimal.Zero, err
+		}
+		reserved = reserved.Add(amount)
+	}
+	return reserved, nil
+}
+
+//GetTransferItem 查询队列记录
+func (tq *TransferQueue) GetTransferItem(id uint64) (*TransferItem, error) {
+	var item TransferItem
+	err := tq.wm.blockChainDB.One("ID", id, &item)
+	if err != nil {
+		return nil, err
+	}
+	tq.refresh(&item)
+	return &item, nil
+}
+
+//refresh 等待审批的转账按提案结果更新状态
+func (tq *TransferQueue) refresh(item *TransferItem) {
+
+	if item.Status != TransferStatusApproval {
+		return
+	}
+
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+
+	tq.refreshLocked(item)
+}
+
+//refreshLocked 同refresh，调用方需持有mu
+func (tq *TransferQueue) refreshLocked(item *TransferItem) {
+
+	if item.Status != TransferStatusApproval {
+		return
+	}
+
+	p, err := tq.wm.GetProposal(item.ProposalID)
+	if err != nil {
+		return
+	}
+
+	switch p.Status {
+	case ProposalStatusExecuted:
+		item.Status = TransferStatusSent
+		item.TxID = p.TxID
+	case ProposalStatusRejected, ProposalStatusExpired:
+		item.Status = TransferStatusFailed
+		item.Error = fmt.Sprintf("proposal: %s is %s", p.ID, p.Status)
+	default:
+		return
+	}
+
+	item.UpdateAt = time.Now().Unix()
+	if err := tq.wm.blockChainDB.Save(item); err != nil {
+		tq.wm.Log.Std.Error("transfer queue can not save transfer: %d; unexpected error: %v", item.ID, err)
+	}
+}
+
+//ListTransferItems 按发送地址和状态查询队列记录，参数为空时不过滤
+func (tq *TransferQueue) ListTransferItems(from, status string) ([]*TransferItem, error) {
+
+	matchers := make([]q.Matcher, 0)
+	if len(from) > 0 {
+		matchers = append(matchers, q.Eq("From", from))
+	}
+	if len(status) > 0 {
+		matchers = append(matchers, q.Eq("Status", status))
+	}
+
+	var list []*TransferItem
+	err := tq.wm.blockChainDB.Select(matchers...).OrderBy("ID").Find(&list)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	for _, item := range list {
+		tq.refresh(item)
+	}
+	return list, nil
+}
+
+//Cancel 取消未发送的转账
+func (tq *TransferQueue) Cancel(id uint64) error {
+
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+
+	var item TransferItem
+	err := tq.wm.blockChainDB.One("ID", id, &item)
+	if err != nil {
+		return err
+	}
+	tq.refreshLocked(&item)
+
+	if item.Status != TransferStatusPending {
+		return fmt.Errorf("transfer: %d is %s and can not be cancelled", id, item.Status)
+	}
+
+	item.Status = TransferStatusCancelled
+	item.UpdateAt = time.Now().Unix()
+	return tq.wm.blockChainDB.Save(&item)
+}
+
+//addressLock 获取地址入队锁
+func (tq *TransferQueue) addressLock(address string) *sync.Mutex {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	lock, ok := tq.addrMu[address]
+	if !ok {
+		lock = &sync.Mutex{}
+		tq.addrMu[address] = lock
+	}
+	return lock
+}
+
+//kick 地址没有发送线程时启动一个
+func (tq *TransferQueue) kick(from string) {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	if !tq.running || tq.workers[from] {
+		return
+	}
+	tq.workers[from] = true
+	tq.wg.Add(1)
+	go tq.work(from)
+}
+
+//work 按入队顺序逐笔发送地址的转账
+func (tq *TransferQueue) work(from string) {
+	defer tq.wg.Done()
+	for {
+		item := tq.claim(from)
+		if item == nil {
+			return
+		}
+		tq.process(item)
+	}
+}
+
+//claim 取出地址最早的待发送转账并标记为发送中，没有时结束发送线程
+func (tq *TransferQueue) claim(from string) *TransferItem {
+
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+
+	var item TransferItem
+	err := tq.wm.blockChainDB.Select(
+		q.Eq("From", from),
+		q.Eq("Status", TransferStatusPending),
+	).OrderBy("ID").First(&item)
+	if err != nil || !tq.running {
+		if err != nil && err != storm.ErrNotFound {
+			tq.wm.Log.Std.Error("transfer queue can not load transfers of address: %s; unexpected error: %v", from, err)
+		}
+		delete(tq.workers, from)
+		return nil
+	}
+
+	item.Status = TransferStatusSending
+	item.UpdateAt = time.Now().Unix()
+	err = tq.wm.blockChainDB.Save(&item)
+	if err != nil {
+		tq.wm.Log.Std.Error("transfer queue can not save transfer: %d; unexpected error: %v", item.ID, err)
+		delete(tq.workers, from)
+		return nil
+	}
+
+	return &item
+}
+
+//process 发送一笔转账
+func (tq *TransferQueue) process(item *TransferItem) {
+
+	wallet, password, err := tq.resolver(item.From)
+	if err != nil {
+		tq.finish(item, "", err)
+		return
+	}
+
+	rawTx := &openwallet.RawTransaction{
+		Coin: openwallet.Coin{
+			Symbol:     tq.wm.Symbol(),
+			IsContract: false,
+		},
+		Sid:      item.Sid,
+		To:       map[string]string{item.To: item.Amount},
+		ExtParam: item.ExtParam,
+	}
+
+	tx, err := tq.wm.SendTransaction(wallet, password, rawTx)
+	if approval, ok := err.(*ApprovalRequiredError); ok {
+		tq.wm.Log.Std.Info("transfer: %d requires approval, proposal: %s", item.ID, approval.ProposalID)
+		tq.await(item, approval.ProposalID)
+		return
+	}
+	if err != nil {
+		tq.wm.Log.Std.Error("transfer: %d send failed; unexpected error: %v", item.ID, err)
+		tq.finish(item, "", err)
+		return
+	}
+
+	tq.finish(item, tx.TxID, nil)
+}
+
+//await 转账等待提案审批和执行
+func (tq *TransferQueue) await(item *TransferItem, proposalID string) {
+
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+
+	item.Status = TransferStatusApproval
+	item.ProposalID = proposalID
+	item.UpdateAt = time.Now().Unix()
+
+	if err := tq.wm.blockChainDB.Save(item); err != nil {
+		tq.wm.Log.Std.Error("transfer queue can not save transfer: %d; unexpected error: %v", item.ID, err)
+	}
+}
+
+//finish 保存转账结果
+func (tq *TransferQueue) finish(item *TransferItem, txid string, err error) {
+
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+
+	if err != nil {
+		item.Status = TransferStatusFailed
+		item.Error = err.Error()
+	} else {
+		item.Status = TransferStatusSent
+		item.TxID = txid
+	}
+	item.UpdateAt = time.Now().Unix()
+
+	if saveErr := tq.wm.blockChainDB.Save(item); saveErr != nil {
+		tq.wm.Log.Std.Error("transfer queue can not save transfer: %d; unexpected error: %v", item.ID, saveErr)
+	}
+}
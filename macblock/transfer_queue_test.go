@@ -0,0 +1,317 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"fmt"
+	"github.com/blocktree/openwallet/openwallet"
+	"github.com/shopspring/decimal"
+	"golang.org/x/crypto/ed25519"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTransferQueue_Serialization(t *testing.T) {
+
+	var (
+		mu       sync.Mutex
+		balance  = decimal.New(10, 0)
+		inFlight = 0
+		overlap  = false
+		sent     = 0
+	)
+
+	wm, cleanup := testNewOfflineWalletManager(t, map[string]testNodeAction{
+		"GetAssetBalanceAds": func(form url.Values) string {
+			mu.Lock()
+			defer mu.Unlock()
+			return fmt.Sprintf(`{"errCode": 0, "AssetBalance": "%s"}`, balance.String())
+		},
+		"AssetTransferMN2": func(form url.Values) string {
+			mu.Lock()
+			inFlight++
+			if inFlight > 1 {
+				overlap = true
+			}
+			mu.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+
+			mu.Lock()
+			defer mu.Unlock()
+			inFlight--
+			sent++
+			balance = balance.Sub(decimal.RequireFromString(form.Get("amount")))
+			return fmt.Sprintf(`{"errCode": 0, "TranHash": "0x%d"}`, sent)
+		},
+		//模拟节点发送后立即扣减余额，交易都能查到
+		"GetTransactionRecordHash": func(form url.Values) string {
+			return fmt.Sprintf(`{"errCode": 0, "Content": [{"hash": "%s"}]}`, form.Get("hash"))
+		},
+	})
+	defer cleanup()
+
+	resolver := func(address string) (*MACWallet, string, error) {
+		return &MACWallet{Address: address}, "1234qwer", nil
+	}
+
+	tq := NewTransferQueue(wm, resolver)
+	if err := tq.Start(); err != nil {
+		t.Fatalf("Start unexpected error: %v", err)
+	}
+
+	var (
+		wg       sync.WaitGroup
+		accepted = make(chan *TransferItem, 5)
+	)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			item, err := tq.Enqueue("MACsender000000000000000000000", &openwallet.RawTransaction{To: map[string]string{"MACuser00000000000000000000000": "3"}})
+			if err == nil {
+				accepted <- item
+			}
+		}()
+	}
+	wg.Wait()
+	close(accepted)
+
+	if len(accepted) != 3 {
+		t.Errorf("Enqueue accepted %d transfers, want 3", len(accepted))
+	}
+
+	for i := 0; i < 100; i++ {
+		reserved, _ := tq.Reserved("MACsender000000000000000000000")
+		if reserved.IsZero() {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	tq.Stop()
+
+	for item := range accepted {
+		item, _ = tq.GetTransferItem(item.ID)
+		if item.Status != TransferStatusSent || len(item.TxID) == 0 {
+			t.Errorf("transfer: %d status = %s, error = %s", item.ID, item.Status, item.Error)
+		}
+	}
+
+	if overlap {
+		t.Errorf("transfers of the same address were sent concurrently")
+	}
+	if !balance.Equal(decimal.New(1, 0)) {
+		t.Errorf("balance = %s, want 1", balance.String())
+	}
+}
+
+func TestTransferQueue_CancelAndRecover(t *testing.T) {
+
+	wm, cleanup := testNewOfflineWalletManager(t, map[string]testNodeAction{
+		"GetAssetBalanceAds": func(form url.Values) string {
+			return `{"errCode": 0, "AssetBalance": "10"}`
+		},
+	})
+	defer cleanup()
+
+	tq := NewTransferQueue(wm, nil)
+
+	//队列未启动，转账保留在待发送状态
+	item, err := tq.Enqueue("MACsender000000000000000000000", &openwallet.RawTransaction{Sid: "order-1", To: map[string]string{"MACuser00000000000000000000000": "1"}})
+	if err != nil {
+		t.Fatalf("Enqueue unexpected error: %v", err)
+	}
+
+	again, err := tq.Enqueue("MACsender000000000000000000000", &openwallet.RawTransaction{Sid: "order-1", To: map[string]string{"MACuser00000000000000000000000": "1"}})
+	if err != nil || again.ID != item.ID {
+		t.Errorf("Enqueue with the same sid should return the queued transfer")
+	}
+
+	if err := tq.Cancel(item.ID); err != nil {
+		t.Errorf("Cancel unexpected error: %v", err)
+	}
+	if err := tq.Cancel(item.ID); err == nil {
+		t.Errorf("Cancel should reject a cancelled transfer")
+	}
+
+	reserved, _ := tq.Reserved("MACsender000000000000000000000")
+	if !reserved.IsZero() {
+		t.Errorf("Reserved = %s after cancel, want 0", reserved.String())
+	}
+
+	//模拟重启前发送中的转账
+	interrupted := &TransferItem{From: "MACsender000000000000000000000", To: "MACuser00000000000000000000000", Amount: "1", Status: TransferStatusSending}
+	wm.blockChainDB.Save(interrupted)
+
+	tq.Start()
+	tq.Stop()
+
+	interrupted, _ = tq.GetTransferItem(interrupted.ID)
+	if interrupted.Status != TransferStatusFailed {
+		t.Errorf("interrupted transfer status = %s, want failed", interrupted.Status)
+	}
+}
+
+func TestWalletManager_SendTransaction_Reservation(t *testing.T) {
+
+	var (
+		mu        sync.Mutex
+		sent      = 0
+		confirmed = false
+	)
+
+	//节点余额在交易确认前不变
+	wm, cleanup := testNewOfflineWalletManager(t, map[string]testNodeAction{
+		"GetAssetBalanceAds": func(form url.Values) string {
+			return `{"errCode": 0, "AssetBalance": "10"}`
+		},
+		"AssetTransferMN2": func(form url.Values) string {
+			mu.Lock()
+			defer mu.Unlock()
+			sent++
+			return fmt.Sprintf(`{"errCode": 0, "TranHash": "0x%d"}`, sent)
+		},
+		"GetTransactionRecordHash": func(form url.Values) string {
+			mu.Lock()
+			defer mu.Unlock()
+			if !confirmed {
+				return `{"errCode": 1, "Msg": "not found"}`
+			}
+			return fmt.Sprintf(`{"errCode": 0, "Content": [{"hash": "%s"}]}`, form.Get("hash"))
+		},
+	})
+	defer cleanup()
+
+	wallet := &MACWallet{Address: "MACsender000000000000000000000"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wm.SendTransaction(wallet, "1234qwer", &openwallet.RawTransaction{To: map[string]string{"MACuser00000000000000000000000": "3"}})
+		}()
+	}
+	wg.Wait()
+
+	if sent != 3 {
+		t.Errorf("SendTransaction sent %d transfers, want 3", sent)
+	}
+
+	list, err := wm.GetTransferReservations(wallet.Address)
+	if err != nil || len(list) != 3 {
+		t.Errorf("GetTransferReservations = %d, %v; want 3", len(list), err)
+	}
+
+	//节点确认后释放占用
+	mu.Lock()
+	confirmed = true
+	mu.Unlock()
+
+	reserved, err := wm.reservedBalance(wallet.Address)
+	if err != nil || !reserved.IsZero() {
+		t.Errorf("reservedBalance = %s, %v; want 0", reserved.String(), err)
+	}
+	if list, _ = wm.GetTransferReservations(wallet.Address); len(list) != 0 {
+		t.Errorf("reservations were not released: %d", len(list))
+	}
+}
+
+func TestTransferQueue_Approval(t *testing.T) {
+
+	wm, cleanup := testNewOfflineWalletManager(t, map[string]testNodeAction{
+		"GetAssetBalanceAds": func(form url.Values) string {
+			return `{"errCode": 0, "AssetBalance": "1000"}`
+		},
+	})
+	defer cleanup()
+
+	wm.Config.ApprovalThreshold = decimal.New(100, 0)
+	wm.Config.ApprovalRequired = 1
+	pub, _, _ := ed25519.GenerateKey(nil)
+	wm.AddApprover("alice", pub)
+
+	resolver := func(address string) (*MACWallet, string, error) {
+		return &MACWallet{Address: address}, "1234qwer", nil
+	}
+
+	tq := NewTransferQueue(wm, resolver)
+	if err := tq.Start(); err != nil {
+		t.Fatalf("Start unexpected error: %v", err)
+	}
+
+	item, err := tq.Enqueue("MACsender000000000000000000000", &openwallet.RawTransaction{To: map[string]string{"MACuser00000000000000000000000": "500"}})
+	if err != nil {
+		t.Fatalf("Enqueue unexpected error: %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if item, _ = tq.GetTransferItem(item.ID); item.Status == TransferStatusApproval {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	tq.Stop()
+
+	//超过审批阈值的转账等待提案，不是失败，并继续占用余额
+	if item.Status != TransferStatusApproval || len(item.ProposalID) == 0 {
+		t.Fatalf("transfer status = %s, proposal = %s, error = %s; want approval", item.Status, item.ProposalID, item.Error)
+	}
+	if reserved, _ := tq.Reserved(item.From); !reserved.Equal(decimal.New(500, 0)) {
+		t.Errorf("Reserved = %s, want 500", reserved.String())
+	}
+
+	//提案过期后转账失败
+	p, _ := wm.GetProposal(item.ProposalID)
+	p.ExpireAt = time.Now().Add(-time.Second).Unix()
+	wm.blockChainDB.Save(p)
+
+	if item, _ = tq.GetTransferItem(item.ID); item.Status != TransferStatusFailed {
+		t.Errorf("transfer status = %s, want failed", item.Status)
+	}
+	if reserved, _ := tq.Reserved(item.From); !reserved.IsZero() {
+		t.Errorf("Reserved = %s, want 0", reserved.String())
+	}
+
+	//提案被拒绝后取消转账，不会死锁
+	rejected, err := tq.Enqueue("MACsender000000000000000000000", &openwallet.RawTransaction{To: map[string]string{"MACuser00000000000000000000000": "300"}})
+	if err != nil {
+		t.Fatalf("Enqueue unexpected error: %v", err)
+	}
+	rejected.Status = TransferStatusApproval
+	rejected.ProposalID = item.ProposalID
+	wm.blockChainDB.Save(rejected)
+	p.Status = ProposalStatusRejected
+	wm.blockChainDB.Save(p)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- tq.Cancel(rejected.ID)
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("Cancel of a failed transfer should fail")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Cancel of a rejected approval transfer is blocked")
+	}
+	if rejected, _ = tq.GetTransferItem(rejected.ID); rejected.Status != TransferStatusFailed {
+		t.Errorf("transfer status = %s, want failed", rejected.Status)
+	}
+}
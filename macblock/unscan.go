@@ -0,0 +1,290 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"io"
+	"strings"
+	"time"
+)
+
+//UnscanRecordQuery 未扫记录查询条件，零值的条件不过滤
+type UnscanRecordQuery struct {
+	FromHeight uint64 //最小高度
+	ToHeight   uint64 //最大高度
+	TxID       string
+	Observer   string
+	Reason     string //失败原因包含的关键字
+}
+
+//IsEmpty 是否没有任何过滤条件
+func (query UnscanRecordQuery) IsEmpty() bool {
+	return query.FromHeight == 0 && query.ToHeight == 0 && len(query.TxID) == 0 && len(query.Observer) == 0 && len(query.Reason) == 0
+}
+
+func (query UnscanRecordQuery) match(height uint64, txID, observer, reason string) bool {
+	if height < query.FromHeight {
+		return false
+	}
+	if query.ToHeight > 0 && height > query.ToHeight {
+		return false
+	}
+	if len(query.TxID) > 0 && txID != query.TxID {
+		return false
+	}
+	if len(query.Observer) > 0 && observer != query.Observer {
+		return false
+	}
+	if len(query.Reason) > 0 && !strings.Contains(reason, query.Reason) {
+		return false
+	}
+	return true
+}
+
+//UnscanExport 导出的未扫记录，用于事故报告
+type UnscanExport struct {
+	ExportAt   int64               `json:"exportAt"`
+	Unscan     []*UnscanRecord     `json:"unscan"`
+	DeadLetter []*DeadUnscanRecord `json:"deadLetter"`
+}
+
+//ListUnscanRecords 查询未扫记录，按高度排列
+func (bs *MACBlockScanner) ListUnscanRecords(query UnscanRecordQuery) ([]*UnscanRecord, error) {
+
+	var all []*UnscanRecord
+	err := bs.wm.blockChainDB.Select().OrderBy("BlockHeight", "TxID").Find(&all)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	list := make([]*UnscanRecord, 0)
+	for _, r := range all {
+		if query.match(r.BlockHeight, r.TxID, r.Observer, r.Reason) {
+			list = append(list, r)
+		}
+	}
+	return list, nil
+}
+
+//ListDeadUnscanRecords 查询死信记录，按高度排列
+func (bs *MACBlockScanner) ListDeadUnscanRecords(query UnscanRecordQuery) ([]*DeadUnscanRecord, error) {
+
+	all, err := bs.GetDeadUnscanRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*DeadUnscanRecord, 0)
+	for _, r := range all {
+		if query.match(r.BlockHeight, r.TxID, r.Observer, r.Reason) {
+			list = append(list, r)
+		}
+	}
+	return list, nil
+}
+
+//RetryUnscanHeight 立即重扫指定高度，成功后删除该高度的未扫和死信记录
+//通知失败的交易只重新通知失败的观察者，已提取过的交易不重复通知
+//没有注册观察者时重扫结果无法送达，返回错误，应使用RequeueUnscanRecords
+func (bs *MACBlockScanner) RetryUnscanHeight(height uint64) error {
+
+	if height == 0 {
+		return fmt.Errorf("block height to retry must greater than 0")
+	}
+	if err := bs.requireObservers(); err != nil {
+		return err
+	}
+
+	var (
+		targets    = make(map[string][]string)
+		wholeBlock bool
+		records    []*UnscanRecord
+		dead       []*DeadUnscanRecord
+	)
+
+	err := bs.wm.blockChainDB.Find("BlockHeight", height, &records)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	err = bs.wm.blockChainDB.Find("BlockHeight", height, &dead)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+
+	for _, r := range records {
+		if len(r.TxID) == 0 {
+			wholeBlock = true
+			continue
+		}
+		targets[r.TxID] = addUnscanObserver(targets[r.TxID], r.Observer)
+	}
+	for _, r := range dead {
+		if len(r.TxID) == 0 {
+			wholeBlock = true
+			continue
+		}
+		targets[r.TxID] = addUnscanObserver(targets[r.TxID], r.Observer)
+	}
+
+	//没有交易记录时重扫整个区块，已提取过的交易会被跳过
+	if wholeBlock || len(targets) == 0 {
+		if err := bs.rescanHeight(height, nil); err != nil {
+			return err
+		}
+	}
+
+	if len(targets) == 0 {
+		return nil
+	}
+
+	return bs.rescanHeight(height, targets)
+}
+
+//RetryUnscanTxID 立即重扫指定交易，只重新通知失败的观察者，成功后删除该交易的未扫和死信记录
+func (bs *MACBlockScanner) RetryUnscanTxID(txID string) error {
+
+	if err := bs.requireObservers(); err != nil {
+		return err
+	}
+
+	var (
+		height    uint64
+		observers []string
+		records   []*UnscanRecord
+		dead      []*DeadUnscanRecord
+	)
+
+	err := bs.wm.blockChainDB.Select(q.Eq("TxID", txID)).Find(&records)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	err = bs.wm.blockChainDB.Select(q.Eq("TxID", txID)).Find(&dead)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+
+	for _, r := range records {
+		height = r.BlockHeight
+		observers = addUnscanObserver(observers, r.Observer)
+	}
+	for _, r := range dead {
+		height = r.BlockHeight
+		observers = addUnscanObserver(observers, r.Observer)
+	}
+
+	if height == 0 {
+		return fmt.Errorf("unscan record of txid: %s not found", txID)
+	}
+
+	return bs.rescanHeight(height, map[string][]string{txID: observers})
+}
+
+//requireObservers 重扫前确认有观察者接收结果
+func (bs *MACBlockScanner) requireObservers() error {
+	if len(bs.observerSnapshot()) == 0 {
+		return fmt.Errorf("no observer is registered, rescan results can not be delivered")
+	}
+	return nil
+}
+
+//RequeueUnscanRecords 符合条件的未扫记录在下次重扫时立即处理，死信放回重扫队列，返回数量
+//不通知观察者，由运行中的扫描器重扫
+func (bs *MACBlockScanner) RequeueUnscanRecords(query UnscanRecordQuery) (int, error) {
+
+	bs.unscanMu.Lock()
+	list, err := bs.ListUnscanRecords(query)
+	if err != nil {
+		bs.unscanMu.Unlock()
+		return 0, err
+	}
+	for i, r := range list {
+		r.NextRetryAt = 0
+		if err := bs.wm.blockChainDB.Save(r); err != nil {
+			bs.unscanMu.Unlock()
+			return i, err
+		}
+	}
+	bs.unscanMu.Unlock()
+
+	dead, err := bs.ListDeadUnscanRecords(query)
+	if err != nil {
+		return len(list), err
+	}
+	for i, d := range dead {
+		if err := bs.ReplayDeadUnscanRecord(d.ID); err != nil {
+			return len(list) + i, err
+		}
+	}
+
+	return len(list) + len(dead), nil
+}
+
+//PurgeUnscanRecords 删除符合条件的未扫记录，dead为true时删除死信记录，返回删除数量
+func (bs *MACBlockScanner) PurgeUnscanRecords(query UnscanRecordQuery, dead bool) (int, error) {
+
+	bs.unscanMu.Lock()
+	defer bs.unscanMu.Unlock()
+
+	if dead {
+		list, err := bs.ListDeadUnscanRecords(query)
+		if err != nil {
+			return 0, err
+		}
+		for i, r := range list {
+			if err := bs.wm.blockChainDB.DeleteStruct(r); err != nil {
+				return i, err
+			}
+		}
+		return len(list), nil
+	}
+
+	list, err := bs.ListUnscanRecords(query)
+	if err != nil {
+		return 0, err
+	}
+	for i, r := range list {
+		if err := bs.wm.blockChainDB.DeleteStruct(r); err != nil {
+			return i, err
+		}
+	}
+	return len(list), nil
+}
+
+//ExportUnscanRecords 以JSON导出符合条件的未扫和死信记录
+func (bs *MACBlockScanner) ExportUnscanRecords(w io.Writer, query UnscanRecordQuery) error {
+
+	unscan, err := bs.ListUnscanRecords(query)
+	if err != nil {
+		return err
+	}
+
+	dead, err := bs.ListDeadUnscanRecords(query)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&UnscanExport{
+		ExportAt:   time.Now().Unix(),
+		Unscan:     unscan,
+		DeadLetter: dead,
+	})
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright 2019 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package macblock
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/blocktree/openwallet/openwallet"
+	"net/url"
+	"testing"
+)
+
+func TestMACBlockScanner_UnscanOperator(t *testing.T) {
+
+	wm, cleanup := testNewOfflineWalletManager(t, map[string]testNodeAction{
+		"GetTransactionRecordHight": func(form url.Values) string {
+			if form.Get("height") == "9" {
+				return `{"errCode": 1, "Msg": "node busy"}`
+			}
+			return `{"errCode": 0, "blockhash": "a` + form.Get("height") + `", "Content": [
+				{"hash": "0x1", "fromtoken": "MACfrom0000000000000000000000", "totoken": "MACuser00000000000000000000000", "amount": "1", "time": 1, "note": ""}
+			]}`
+		},
+	})
+	defer cleanup()
+
+	bs := wm.Blockscanner.(*MACBlockScanner)
+	bs.SetBlockScanTargetFunc(func(target openwallet.ScanTarget) (string, bool) {
+		return "", false
+	})
+
+	bs.SaveUnscanRecord(NewUnscanRecord(5, "", "scan failed"))
+	bs.SaveUnscanRecord(NewUnscanRecord(7, "0x1", "notify failed"))
+	bs.SaveUnscanRecord(NewUnscanRecord(9, "", "scan failed"))
+	wm.blockChainDB.Save(&DeadUnscanRecord{ID: NewUnscanRecord(11, "", "").ID, BlockHeight: 11, Reason: "scan failed", Attempts: 10})
+
+	list, err := bs.ListUnscanRecords(UnscanRecordQuery{FromHeight: 6})
+	if err != nil {
+		t.Fatalf("ListUnscanRecords unexpected error: %v", err)
+	}
+	if len(list) != 2 || list[0].BlockHeight != 7 || list[1].BlockHeight != 9 {
+		t.Errorf("unscan records from 6 = %+v", list)
+	}
+	if list, _ := bs.ListUnscanRecords(UnscanRecordQuery{Reason: "notify"}); len(list) != 1 || list[0].TxID != "0x1" {
+		t.Errorf("unscan records by reason = %+v", list)
+	}
+	if dead, _ := bs.ListDeadUnscanRecords(UnscanRecordQuery{ToHeight: 10}); len(dead) != 0 {
+		t.Errorf("dead records to 10 = %+v", dead)
+	}
+
+	//导出
+	var buf bytes.Buffer
+	if err := bs.ExportUnscanRecords(&buf, UnscanRecordQuery{}); err != nil {
+		t.Fatalf("ExportUnscanRecords unexpected error: %v", err)
+	}
+	var export UnscanExport
+	if err := json.Unmarshal(buf.Bytes(), &export); err != nil {
+		t.Fatalf("export is not json: %v", err)
+	}
+	if len(export.Unscan) != 3 || len(export.DeadLetter) != 1 || export.ExportAt == 0 {
+		t.Errorf("export = %s", buf.String())
+	}
+
+	//没有观察者时不能重扫，记录保留
+	if err := bs.RetryUnscanHeight(5); err == nil {
+		t.Errorf("RetryUnscanHeight without observers should fail")
+	}
+	if list, _ := bs.ListUnscanRecords(UnscanRecordQuery{}); len(list) != 3 {
+		t.Errorf("unscan records after refused retry = %+v", list)
+	}
+
+	//放回重扫队列，不删除记录
+	wm.blockChainDB.Save(&UnscanRecord{ID: NewUnscanRecord(13, "", "").ID, BlockHeight: 13, Reason: "scan failed", Attempts: 3, NextRetryAt: 1 << 40})
+	requeued, err := bs.RequeueUnscanRecords(UnscanRecordQuery{FromHeight: 11, ToHeight: 13})
+	if err != nil || requeued != 2 {
+		t.Errorf("RequeueUnscanRecords = %d, %v; want 2, nil", requeued, err)
+	}
+	list, _ = bs.ListUnscanRecords(UnscanRecordQuery{FromHeight: 11})
+	if len(list) != 2 || list[0].NextRetryAt != 0 || list[1].NextRetryAt != 0 {
+		t.Errorf("requeued unscan records = %+v", list)
+	}
+	//恢复原来的记录
+	bs.PurgeUnscanRecords(UnscanRecordQuery{FromHeight: 11}, false)
+	wm.blockChainDB.Save(&DeadUnscanRecord{ID: NewUnscanRecord(11, "", "").ID, BlockHeight: 11, Reason: "scan failed", Attempts: 10})
+
+	//按高度和交易立即重扫
+	bs.AddObserver(&testNamedObserver{name: "wallet", failures: map[string]int{}})
+	if err := bs.RetryUnscanHeight(5); err != nil {
+		t.Errorf("RetryUnscanHeight unexpected error: %v", err)
+	}
+	if err := bs.RetryUnscanTxID("0x1"); err != nil {
+		t.Errorf("RetryUnscanTxID unexpected error: %v", err)
+	}
+	if err := bs.RetryUnscanTxID("0x404"); err == nil {
+		t.Errorf("RetryUnscanTxID unknown txid should fail")
+	}
+	if err := bs.RetryUnscanHeight(9); err == nil {
+		t.Errorf("RetryUnscanHeight on failing node should fail")
+	}
+	if err := bs.RetryUnscanHeight(11); err != nil {
+		t.Errorf("RetryUnscanHeight of dead letter unexpected error: %v", err)
+	}
+
+	list, _ = bs.ListUnscanRecords(UnscanRecordQuery{})
+	if len(list) != 1 || list[0].BlockHeight != 9 || list[0].Attempts != 2 {
+		t.Errorf("unscan records after retry = %+v", list)
+	}
+	if dead, _ := bs.GetDeadUnscanRecords(); len(dead) != 0 {
+		t.Errorf("dead records after retry = %+v", dead)
+	}
+
+	//清理
+	purged, err := bs.PurgeUnscanRecords(UnscanRecordQuery{FromHeight: 9, ToHeight: 9}, false)
+	if err != nil || purged != 1 {
+		t.Errorf("PurgeUnscanRecords = %d, %v; want 1, nil", purged, err)
+	}
+	if list, _ := bs.GetUnscanRecords(); len(list) != 0 {
+		t.Errorf("unscan records after purge = %+v", list)
+	}
+}